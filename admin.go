@@ -0,0 +1,45 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// requireAdminToken only passes requests carrying the admin token as bearer
+// token to the wrapped handler.
+func requireAdminToken(adminToken string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + adminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// configHandler serves the redacted effective configuration as JSON.
+func configHandler(config *configuration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		configLock.RLock()
+		redactedConfig := config.redacted()
+		configLock.RUnlock()
+		if err := json.NewEncoder(w).Encode(redactedConfig); err != nil {
+			log.Errorf("could not write configuration: %v", err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigHandler(t *testing.T) {
+	config := &configuration{
+		PKIMounts:     stringList{"pki", "pki2"},
+		ResponderCert: "/etc/ocsp/responder.pem",
+		ResponderKey:  "/etc/ocsp/responder.key",
+		AdminToken:    "secret",
+	}
+	handler := requireAdminToken(config.AdminToken, configHandler(config))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d without token, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if strings.Contains(recorder.Body.String(), config.ResponderKey) {
+		t.Errorf("configuration %s shows the responder key path", recorder.Body)
+	}
+	var served map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if served["responderCert"] != config.ResponderCert {
+		t.Errorf("got responderCert %v, want %s", served["responderCert"], config.ResponderCert)
+	}
+	if mounts, _ := served["pkimount"].([]interface{}); len(mounts) != 2 || mounts[0] != "pki" || mounts[1] != "pki2" {
+		t.Errorf("got pkimount %v, want [pki pki2]", served["pkimount"])
+	}
+	for _, field := range []string{"responderKey", "adminToken"} {
+		if served[field] != redacted {
+			t.Errorf("got %s %v, want %s", field, served[field], redacted)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// serialAllowlist is a set of serial numbers keyed by their decimal
+// representation.
+type serialAllowlist map[string]struct{}
+
+// loadSerialAllowlist reads a file with one hexadecimal serial number per
+// line. Empty lines and lines starting with # are ignored.
+func loadSerialAllowlist(allowlistFile string) (serialAllowlist, error) {
+	file, err := os.Open(allowlistFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open serial allowlist: %v", err)
+	}
+	defer file.Close()
+	allowlist := serialAllowlist{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serial, err := parseSerial(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of serial allowlist: %v", lineNumber, err)
+		}
+		allowlist[serial.String()] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read serial allowlist: %v", err)
+	}
+	return allowlist, nil
+}
+
+func (source *VaultSource) setAllowlist(allowlist serialAllowlist) {
+	source.allowlistLock.Lock()
+	defer source.allowlistLock.Unlock()
+	source.allowlist = allowlist
+}
+
+// allowed returns whether the source may answer for the serial, all
+// serials are allowed if no allowlist is set.
+func (source *VaultSource) allowed(serial *big.Int) bool {
+	source.allowlistLock.RLock()
+	defer source.allowlistLock.RUnlock()
+	if source.allowlist == nil {
+		return true
+	}
+	_, found := source.allowlist[serial.String()]
+	return found
+}
+
+// reloadAllowlistOnSignal reloads the serial allowlist on SIGHUP, the
+// current allowlist is kept if the file cannot be read.
+func reloadAllowlistOnSignal(allowlistFile string, mounts *mountSet) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		allowlist, err := loadSerialAllowlist(allowlistFile)
+		if err != nil {
+			log.Errorf("Keeping current serial allowlist, reload failed: %v", err)
+			continue
+		}
+		mounts.setAllowlist(allowlist)
+		log.Infof("Reloaded serial allowlist with %d serials", len(allowlist))
+	}
+}
@@ -0,0 +1,43 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSerialAllowlist(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	allowed := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	disallowed := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", allowed, time.Time{})
+	vault.addCertificate("pki", disallowed, time.Time{})
+	allowlistFile := filepath.Join(t.TempDir(), "allowlist")
+	if err := ioutil.WriteFile(allowlistFile, []byte("# allowed serials\n\n"+toVaultSerial(allowed.SerialNumber)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	allowlist, err := loadSerialAllowlist(allowlistFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.setAllowlist(allowlist)
+
+	if _, _, err := source.Response(pki.request(t, allowed.SerialNumber, crypto.SHA1)); err != nil {
+		t.Errorf("allowed serial was not answered: %v", err)
+	}
+	if _, _, err := source.Response(pki.request(t, disallowed.SerialNumber, crypto.SHA1)); !errors.Is(err, errUnknownSerial) {
+		t.Errorf("got error %v for a serial that is not allowed, want unknown serial", err)
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(disallowed.SerialNumber)); reads != 0 {
+		t.Errorf("read the serial that is not allowed %d times from vault", reads)
+	}
+}
@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// auditEntry is a line of the audit log describing a served response.
+type auditEntry struct {
+	Time                 time.Time `json:"time"`
+	Mount                string    `json:"mount"`
+	Serial               string    `json:"serial"`
+	Status               string    `json:"status"`
+	ResponderFingerprint string    `json:"responderFingerprint"`
+	ResponseSHA256       string    `json:"responseSha256"`
+}
+
+// auditLog appends a JSON line per served OCSP response to a file. The file
+// is opened in append mode and reopened on SIGHUP to support log rotation.
+type auditLog struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	audit := &auditLog{path: path}
+	if err := audit.reopen(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// reopen closes the current audit log file and opens the file at the audit
+// log path.
+func (audit *auditLog) reopen() error {
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %v", err)
+	}
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if audit.file != nil {
+		audit.file.Close()
+	}
+	audit.file = file
+	return nil
+}
+
+// record writes the audit entries for a response served for the PKI mount,
+// one for each single response. The responder fingerprint is of the
+// certificate the response is signed with, or of the certificate in the
+// response if that is unknown.
+func (audit *auditLog) record(pkiMount string, response []byte, responderCertificate *x509.Certificate, now time.Time) {
+	parsedResponses, err := parseResponses(response)
+	if err != nil {
+		log.Errorf("Could not parse response for the audit log: %v", err)
+		return
+	}
+	responseHash := sha256.Sum256(response)
+	if responderCertificate == nil && len(parsedResponses) > 0 {
+		responderCertificate = parsedResponses[0].Certificate
+	}
+	var responderFingerprint string
+	if responderCertificate != nil {
+		fingerprint := sha256.Sum256(responderCertificate.Raw)
+		responderFingerprint = hex.EncodeToString(fingerprint[:])
+	}
+	var lines []byte
+	for _, parsedResponse := range parsedResponses {
+		entry := auditEntry{
+			Time:                 now.UTC(),
+			Mount:                pkiMount,
+			Serial:               toVaultSerial(parsedResponse.SerialNumber),
+			Status:               statusName(parsedResponse.Status),
+			ResponseSHA256:       hex.EncodeToString(responseHash[:]),
+			ResponderFingerprint: responderFingerprint,
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Errorf("Could not encode audit log entry: %v", err)
+			return
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if _, err := audit.file.Write(lines); err != nil {
+		log.Errorf("Could not write audit log entry: %v", err)
+	}
+}
+
+// statusName returns the name of an OCSP certificate status.
+func statusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// reopenAuditLogOnSignal reopens the audit log on SIGHUP, so that rotated
+// log files are released.
+func reopenAuditLogOnSignal(audit *auditLog) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := audit.reopen(); err != nil {
+			log.Errorf("Keeping current audit log file: %v", err)
+		}
+	}
+}
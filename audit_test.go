@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readAuditLog returns the entries of the audit log file.
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// useAuditLog makes the source write its audit log to a temporary file and
+// returns the path of the file.
+func useAuditLog(t *testing.T, source *VaultSource) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.file.Close() })
+	source.audit = audit
+	return path
+}
+
+func TestAuditLog(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	path := useAuditLog(t, source)
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+
+	var responseHashes []string
+	for _, certificate := range []*x509.Certificate{good, revoked} {
+		der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseHash := sha256.Sum256(der)
+		responseHashes = append(responseHashes, hex.EncodeToString(responseHash[:]))
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit log entries, want 2", len(entries))
+	}
+	fingerprint := sha256.Sum256(pki.responder.Raw)
+	for i, want := range []auditEntry{
+		{Mount: "pki", Serial: toVaultSerial(good.SerialNumber), Status: "good"},
+		{Mount: "pki", Serial: toVaultSerial(revoked.SerialNumber), Status: "revoked"},
+	} {
+		entry := entries[i]
+		if entry.Mount != want.Mount || entry.Serial != want.Serial || entry.Status != want.Status {
+			t.Errorf("got entry for %s serial %s status %s, want %s serial %s status %s",
+				entry.Mount, entry.Serial, entry.Status, want.Mount, want.Serial, want.Status)
+		}
+		if entry.ResponderFingerprint != hex.EncodeToString(fingerprint[:]) {
+			t.Errorf("got responder fingerprint %s, want the responder certificate", entry.ResponderFingerprint)
+		}
+		if entry.ResponseSHA256 != responseHashes[i] {
+			t.Errorf("got response hash %s, want %s", entry.ResponseSHA256, responseHashes[i])
+		}
+		if entry.Time.IsZero() {
+			t.Error("entry has no time")
+		}
+	}
+}
+
+func TestAuditLogWithoutResponderCertificate(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.omitResponderCert = true
+	path := useAuditLog(t, source)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	// the second response comes from the cache
+	for i := 0; i < 2; i++ {
+		if _, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit log entries, want 2", len(entries))
+	}
+	fingerprint := sha256.Sum256(pki.responder.Raw)
+	for _, entry := range entries {
+		if entry.ResponderFingerprint != hex.EncodeToString(fingerprint[:]) {
+			t.Errorf("got responder fingerprint %q, want the signing responder certificate", entry.ResponderFingerprint)
+		}
+	}
+}
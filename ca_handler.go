@@ -0,0 +1,36 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+)
+
+// caHandler serves the issuer certificates of a VaultSource so that the
+// responder can double as caIssuers endpoint for the authority information
+// access extension. The first issuer is served DER encoded by default, all
+// issuers are served as PEM bundle if the format query parameter is pem.
+func caHandler(source *VaultSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		issuers, _ := source.currentIssuers()
+		if r.URL.Query().Get("format") == "pem" {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			for _, issuer := range issuers {
+				if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw}); err != nil {
+					return
+				}
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		_, _ = w.Write(issuers[0].Raw)
+	})
+}
@@ -0,0 +1,41 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCAHandler(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	server := httptest.NewServer(caHandler(newTestSource(t, vault, "pki", pki)))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/pkix-cert" {
+		t.Errorf("got content type %s, want application/pkix-cert", contentType)
+	}
+	der, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Equal(pki.ca) {
+		t.Errorf("got certificate %v, want the CA certificate", certificate.Subject)
+	}
+}
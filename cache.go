@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a cached OCSP lookup result. Entries for serials that are
+// not answered have no response but the kind of lookup error in notFound.
+type cacheEntry struct {
+	response []byte
+	// etag is the HTTP entity tag of the response
+	etag     string
+	notFound error
+	// responder is the certificate the response is signed with, entries of
+	// caches that only keep the response have none
+	responder *x509.Certificate
+	// expires is the time after which the entry must not be used anymore,
+	// entries with a zero expiry time are kept forever
+	expires time.Time
+}
+
+// newCacheEntry returns a cache entry for the OCSP response signed with the
+// responder certificate that expires at the given time.
+func newCacheEntry(response []byte, responder *x509.Certificate, expires time.Time) cacheEntry {
+	return cacheEntry{response: response, etag: responseETag(response), responder: responder, expires: expires}
+}
+
+// responseETag returns the entity tag of an OCSP response in the format used
+// by the cfssl responder to match If-None-Match headers.
+func responseETag(response []byte) string {
+	return fmt.Sprintf("\"%X\"", sha256.Sum256(response))
+}
+
+func (entry cacheEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+// responseCache stores OCSP lookup results keyed by serial number. get
+// only returns entries that have not expired yet. Implementations must be
+// safe for concurrent use.
+type responseCache interface {
+	get(key string, now time.Time) (cacheEntry, bool)
+	set(key string, entry cacheEntry)
+	clear()
+}
+
+// cacheInspector is implemented by response caches that can report their
+// contents for the /debug/cache endpoint.
+type cacheInspector interface {
+	// inspect returns the number of entries and up to limit of their keys
+	inspect(limit int) (size int, keys []string)
+}
+
+const (
+	cacheBackendMemory = "memory"
+	cacheBackendRedis  = "redis"
+)
+
+// memoryCache is the in-memory responseCache of a single vault-ocsp process.
+type memoryCache struct {
+	lock    sync.RWMutex
+	entries map[string]cacheEntry
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]cacheEntry)}
+}
+
+func (cache *memoryCache) get(key string, now time.Time) (cacheEntry, bool) {
+	cache.lock.RLock()
+	entry, present := cache.entries[key]
+	cache.lock.RUnlock()
+	if !present {
+		return cacheEntry{}, false
+	}
+	if entry.expired(now) {
+		cache.lock.Lock()
+		// the entry may have been replaced in the meantime
+		if current, present := cache.entries[key]; present && current.expired(now) {
+			delete(cache.entries, key)
+		}
+		cache.lock.Unlock()
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (cache *memoryCache) set(key string, entry cacheEntry) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.entries[key] = entry
+}
+
+func (cache *memoryCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.entries = make(map[string]cacheEntry)
+}
+
+func (cache *memoryCache) inspect(limit int) (int, []string) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	keys := make([]string, 0, limit)
+	for key := range cache.entries {
+		if len(keys) == limit {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return len(cache.entries), keys
+}
+
+// responses returns a copy of the entries with a response that have not
+// expired at the given time.
+func (cache *memoryCache) responses(now time.Time) map[string]cacheEntry {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	responses := make(map[string]cacheEntry)
+	for key, entry := range cache.entries {
+		if entry.notFound == nil && !entry.expired(now) {
+			responses[key] = entry
+		}
+	}
+	return responses
+}
+
+// disabledCache is the responseCache used with -noCache, it never stores
+// anything so that every lookup reaches vault.
+type disabledCache struct{}
+
+func (disabledCache) get(key string, now time.Time) (cacheEntry, bool) {
+	return cacheEntry{}, false
+}
+
+func (disabledCache) set(key string, entry cacheEntry) {}
+
+func (disabledCache) clear() {}
@@ -0,0 +1,155 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// cacheSnapshot is the file format of -cacheSnapshot, the cached responses
+// of each PKI mount. Cache entries for unknown serials are not saved.
+type cacheSnapshot struct {
+	Written time.Time                       `json:"written"`
+	Mounts  map[string][]cacheSnapshotEntry `json:"mounts"`
+}
+
+type cacheSnapshotEntry struct {
+	Key      string    `json:"key"`
+	Response []byte    `json:"response"`
+	Expires  time.Time `json:"expires"`
+}
+
+// writeCacheSnapshot saves the responses of the memory caches of the
+// sources to the file. The file is replaced atomically so that a crash
+// while writing keeps the previous snapshot.
+func writeCacheSnapshot(path string, sources []*VaultSource) (int, error) {
+	snapshot := cacheSnapshot{Written: time.Now().UTC(), Mounts: make(map[string][]cacheSnapshotEntry)}
+	saved := 0
+	for _, source := range sources {
+		cache, ok := source.cache.(*memoryCache)
+		if !ok {
+			continue
+		}
+		var entries []cacheSnapshotEntry
+		for key, entry := range cache.responses(source.clk.Now()) {
+			entries = append(entries, cacheSnapshotEntry{Key: key, Response: entry.response, Expires: entry.expires})
+		}
+		snapshot.Mounts[source.pkiMount] = entries
+		saved += len(entries)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("could not create cache snapshot: %v", err)
+	}
+	defer os.Remove(file.Name())
+	if err := json.NewEncoder(file).Encode(snapshot); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("could not write cache snapshot: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("could not write cache snapshot: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return 0, fmt.Errorf("could not replace cache snapshot: %v", err)
+	}
+	return saved, nil
+}
+
+// loadCacheSnapshot fills the memory caches of the sources with the
+// responses of the snapshot file that are still valid. A missing file is
+// not an error, there is no snapshot before the first run.
+func loadCacheSnapshot(path string, sources []*VaultSource) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read cache snapshot: %v", err)
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("could not parse cache snapshot %s: %v", path, err)
+	}
+	restored := 0
+	for _, source := range sources {
+		if _, ok := source.cache.(*memoryCache); !ok {
+			continue
+		}
+		for _, entry := range snapshot.Mounts[source.pkiMount] {
+			if source.restoreCacheEntry(entry) {
+				restored++
+			}
+		}
+	}
+	return restored, nil
+}
+
+// restoreCacheEntry caches the response of a snapshot entry if the entry
+// has not expired, the response is not past its NextUpdate and it is
+// signed by one of the current responders.
+func (source *VaultSource) restoreCacheEntry(snapshotEntry cacheSnapshotEntry) bool {
+	now := source.clk.Now()
+	entry := newCacheEntry(snapshotEntry.Response, nil, snapshotEntry.Expires)
+	if entry.expired(now) {
+		return false
+	}
+	response, err := ocsp.ParseResponse(entry.response, nil)
+	if err != nil {
+		log.Debugf("Skipping unparsable cached response %s of %s: %v", snapshotEntry.Key, source.pkiMount, err)
+		return false
+	}
+	if !response.NextUpdate.IsZero() && !now.Before(response.NextUpdate) {
+		return false
+	}
+	if !source.signedByResponder(response) {
+		log.Debugf("Skipping cached response %s of %s signed by another responder", snapshotEntry.Key, source.pkiMount)
+		return false
+	}
+	source.cache.set(snapshotEntry.Key, entry)
+	return true
+}
+
+// signedByResponder checks the response signature with the certificates
+// of all responders of the source.
+func (source *VaultSource) signedByResponder(response *ocsp.Response) bool {
+	source.responderLock.RLock()
+	defer source.responderLock.RUnlock()
+	for _, responder := range source.responders {
+		if response.CheckSignatureFrom(responder.certificate) == nil {
+			return true
+		}
+	}
+	for _, responder := range source.issuerResponders {
+		if response.CheckSignatureFrom(responder.certificate) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotCachePeriodically writes the cache snapshot of the mounts in the
+// given interval.
+func snapshotCachePeriodically(path string, interval time.Duration, mounts *mountSet) {
+	for range time.Tick(interval) {
+		saveCacheSnapshot(path, mounts)
+	}
+}
+
+func saveCacheSnapshot(path string, mounts *mountSet) {
+	saved, err := writeCacheSnapshot(path, mounts.sources())
+	if err != nil {
+		log.Errorf("Cache snapshot failed: %v", err)
+		return
+	}
+	log.Debugf("Saved %d cached responses to %s", saved, path)
+}
@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.setLifetimes(responseLifetimes{nextUpdate: time.Hour, negativeCacheTTL: time.Hour})
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+	path := "pki/cert/" + toVaultSerial(certificate.SerialNumber)
+	cached, _, err := source.Response(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown serials are not saved
+	if _, _, err := source.Response(pki.request(t, nextTestSerial(), crypto.SHA1)); err == nil {
+		t.Fatal("answered for an unknown serial")
+	}
+	snapshotFile := filepath.Join(t.TempDir(), "cache.json")
+
+	saved, err := writeCacheSnapshot(snapshotFile, []*VaultSource{source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 1 {
+		t.Fatalf("saved %d responses, want 1", saved)
+	}
+
+	t.Run("restored", func(t *testing.T) {
+		restarted := newTestSource(t, vault, "pki", pki)
+		restored, err := loadCacheSnapshot(snapshotFile, []*VaultSource{restarted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored != 1 {
+			t.Fatalf("restored %d responses, want 1", restored)
+		}
+		der, _, err := restarted.Response(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(der, cached) {
+			t.Error("the restored response differs from the saved one")
+		}
+		if reads := vault.readCount(path); reads != 1 {
+			t.Errorf("got %d vault reads, want the restored response without a read", reads)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		restarted := newTestSource(t, vault, "pki", pki)
+		useFakeClock(restarted).Add(2 * time.Hour)
+		if restored, err := loadCacheSnapshot(snapshotFile, []*VaultSource{restarted}); err != nil || restored != 0 {
+			t.Errorf("restored %d responses with error %v after their expiry, want none", restored, err)
+		}
+	})
+
+	t.Run("past NextUpdate", func(t *testing.T) {
+		// the cache entry outlives the response that it holds
+		data, err := ioutil.ReadFile(snapshotFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snapshot cacheSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		snapshot.Mounts["pki"][0].Expires = time.Now().Add(24 * time.Hour)
+		data, err = json.Marshal(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tamperedFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := ioutil.WriteFile(tamperedFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		restarted := newTestSource(t, vault, "pki", pki)
+		useFakeClock(restarted).Add(2 * time.Hour)
+		if restored, err := loadCacheSnapshot(tamperedFile, []*VaultSource{restarted}); err != nil || restored != 0 {
+			t.Errorf("restored %d responses with error %v past their NextUpdate, want none", restored, err)
+		}
+	})
+
+	t.Run("other responder", func(t *testing.T) {
+		// the test responders share their key, the other one has its own
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var signer crypto.Signer = key
+		responder := pki.issueResponder(t, time.Now().Add(24*time.Hour), signer)
+		restarted, err := NewVaultSource("pki", issuerSelection{}, responder, &signer, vault.config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored, err := loadCacheSnapshot(snapshotFile, []*VaultSource{restarted}); err != nil || restored != 0 {
+			t.Errorf("restored %d responses with error %v signed by another responder, want none", restored, err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		restored, err := loadCacheSnapshot(filepath.Join(t.TempDir(), "missing.json"), []*VaultSource{source})
+		if err != nil || restored != 0 {
+			t.Errorf("restored %d responses with error %v from a missing file, want none", restored, err)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestNegativeCache(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	fakeClock := useFakeClock(source)
+	source.setLifetimes(responseLifetimes{nextUpdate: time.Hour, negativeCacheTTL: time.Minute})
+	serial := nextTestSerial()
+	path := "pki/cert/" + toVaultSerial(serial)
+	request := pki.request(t, serial, crypto.SHA1)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := source.Response(request); !errors.Is(err, errUnknownSerial) {
+			t.Fatalf("got error %v, want unknown serial", err)
+		}
+	}
+	if reads := vault.readCount(path); reads != 1 {
+		t.Fatalf("got %d vault reads, want 1 for the cached unknown serial", reads)
+	}
+
+	// the certificate is issued after the first lookup
+	vault.addCertificate("pki", pki.issue(t, serial, time.Now().Add(time.Hour)), time.Time{})
+	fakeClock.Add(59 * time.Second)
+	if _, _, err := source.Response(request); !errors.Is(err, errUnknownSerial) {
+		t.Fatalf("got error %v before the negative cache expired, want unknown serial", err)
+	}
+	fakeClock.Add(time.Second)
+	if _, _, err := source.Response(request); err != nil {
+		t.Fatalf("got error %v after the negative cache expired", err)
+	}
+	if reads := vault.readCount(path); reads != 2 {
+		t.Errorf("got %d vault reads, want 2", reads)
+	}
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.setLifetimes(responseLifetimes{nextUpdate: time.Hour})
+	serial := nextTestSerial()
+	request := pki.request(t, serial, crypto.SHA1)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := source.Response(request); !errors.Is(err, errUnknownSerial) {
+			t.Fatalf("got error %v, want unknown serial", err)
+		}
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(serial)); reads != 2 {
+		t.Errorf("got %d vault reads, want 2 without negative caching", reads)
+	}
+}
+
+func TestGoodResponseCached(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+
+	first, _, err := source.Response(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := source.Response(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("second response differs from the cached one")
+	}
+	if source.cacheHits != 1 || source.cacheMisses != 1 {
+		t.Errorf("got %d cache hits and %d misses, want 1 each", source.cacheHits, source.cacheMisses)
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(certificate.SerialNumber)); reads != 1 {
+		t.Errorf("got %d vault reads, want 1", reads)
+	}
+}
+
+// recordingCache is a responseCache that records the keys of the entries it
+// stores.
+type recordingCache struct {
+	*memoryCache
+	keys []string
+}
+
+func (cache *recordingCache) set(key string, entry cacheEntry) {
+	cache.keys = append(cache.keys, key)
+	cache.memoryCache.set(key, entry)
+}
+
+func TestSourceUsesCacheBackend(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	cache := &recordingCache{memoryCache: newMemoryCache()}
+	source.cache = cache
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := source.Response(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cache.keys) != 1 {
+		t.Fatalf("got %d cache writes, want 1", len(cache.keys))
+	}
+	if entry, found := cache.get(cache.keys[0], time.Now()); !found || entry.expires.IsZero() {
+		t.Errorf("got entry %+v found %v, want the response with its expiry", entry, found)
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(certificate.SerialNumber)); reads != 1 {
+		t.Errorf("got %d vault reads, want 1", reads)
+	}
+}
+
+func TestCacheKeyedByHashAlgorithm(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	cache := &recordingCache{memoryCache: newMemoryCache()}
+	source.cache = cache
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	// the second round is answered from the cache
+	for i := 0; i < 2; i++ {
+		for _, algorithm := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, algorithm))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			if response.IssuerHash != algorithm {
+				t.Errorf("got issuer hash %v for a %v request, want %v", response.IssuerHash, algorithm, algorithm)
+			}
+			if response.SerialNumber.Cmp(certificate.SerialNumber) != 0 || response.Status != ocsp.Good {
+				t.Errorf("got status %d for serial %s, want good for %s", response.Status, response.SerialNumber, certificate.SerialNumber)
+			}
+		}
+	}
+	if len(cache.keys) != 2 || cache.keys[0] == cache.keys[1] {
+		t.Errorf("got cache writes %v, want one per hash algorithm", cache.keys)
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestMounts(t, vault, newTestConfiguration(t, "-noCache"), pki, "pki").sources()[0]
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+	unknown := nextTestSerial()
+
+	for i := 1; i <= 3; i++ {
+		if _, _, err := source.Response(pki.request(t, good.SerialNumber, crypto.SHA1)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := source.Response(pki.request(t, unknown, crypto.SHA1)); !errors.Is(err, errUnknownSerial) {
+			t.Fatalf("got error %v, want unknown serial", err)
+		}
+		for _, serial := range []string{toVaultSerial(good.SerialNumber), toVaultSerial(unknown)} {
+			if reads := vault.readCount("pki/cert/" + serial); reads != i {
+				t.Fatalf("got %d vault reads of %s after %d requests, want one per request", reads, serial, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// certStore looks up the revocation status of certificates in vault.
+type certStore interface {
+	// certificateData returns the certificate and revocation_time fields
+	// of the certificate with the formatted serial number, nil if the
+	// serial is unknown.
+	certificateData(ctx context.Context, serial string) (map[string]interface{}, error)
+}
+
+// readSecret reads a secret like Logical().Read but is cancelled with the
+// context. It returns nil if there is no secret at the path.
+func readSecret(ctx context.Context, client *api.Client, path string) (*api.Secret, error) {
+	request := client.NewRequest(http.MethodGet, "/v1/"+path)
+	response, err := client.RawRequestWithContext(ctx, request)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if response != nil && response.StatusCode == http.StatusNotFound {
+		secret, parseErr := api.ParseSecret(response.Body)
+		switch {
+		case parseErr == io.EOF:
+			return nil, nil
+		case parseErr != nil:
+			return nil, parseErr
+		case secret != nil && (len(secret.Warnings) > 0 || len(secret.Data) > 0):
+			return secret, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.ParseSecret(response.Body)
+}
+
+// certificateFields are the fields of which vault certificate data has at
+// least one.
+var certificateFields = []string{"certificate", "revocation_time", "revocation_time_rfc3339"}
+
+// checkCertificateData returns an error naming the fields of the data if
+// it has none of the certificate fields, like the secrets of a KV mount
+// configured as PKI mount.
+func checkCertificateData(data map[string]interface{}) error {
+	for _, field := range certificateFields {
+		if _, found := data[field]; found {
+			return nil
+		}
+	}
+	fields := make([]string, 0, len(data))
+	for field := range data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fmt.Errorf("data has the fields [%s] instead of %s", strings.Join(fields, ", "), strings.Join(certificateFields, " or "))
+}
+
+const (
+	certPathSerial = "{serial}"
+	certPathMount  = "{mount}"
+	// defaultCertPathTemplate is the cert/<serial> endpoint of the PKI mount
+	defaultCertPathTemplate = certPathMount + "/cert/" + certPathSerial
+)
+
+// validateCertPathTemplate checks that a certificate path template names
+// the serial and has no unknown placeholders.
+func validateCertPathTemplate(pathTemplate string) error {
+	if !strings.Contains(pathTemplate, certPathSerial) {
+		return fmt.Errorf("the certificate path template %s must contain %s", pathTemplate, certPathSerial)
+	}
+	rest := strings.ReplaceAll(strings.ReplaceAll(pathTemplate, certPathSerial, ""), certPathMount, "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("the certificate path template %s has placeholders other than %s and %s", pathTemplate, certPathMount, certPathSerial)
+	}
+	if strings.HasPrefix(pathTemplate, "/") {
+		return fmt.Errorf("the certificate path template %s must be relative to /v1/", pathTemplate)
+	}
+	return nil
+}
+
+// pkiCertStore reads certificates from the cert/<serial> endpoint of a PKI
+// mount or the path given by -certPathTemplate.
+type pkiCertStore struct {
+	client       *api.Client
+	pathTemplate string
+}
+
+func newPKICertStore(client *api.Client, pathTemplate string, pkiMount string) (pkiCertStore, error) {
+	if err := validateCertPathTemplate(pathTemplate); err != nil {
+		return pkiCertStore{}, err
+	}
+	pathTemplate = strings.ReplaceAll(pathTemplate, certPathMount, pkiMount)
+	return pkiCertStore{client: client, pathTemplate: pathTemplate}, nil
+}
+
+func (store pkiCertStore) certificateData(ctx context.Context, serial string) (map[string]interface{}, error) {
+	secret, err := readSecret(ctx, store.client, strings.ReplaceAll(store.pathTemplate, certPathSerial, serial))
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// kvCertStore reads certificates of externally managed PKIs from KV
+// secrets whose path is given by a template. The fields of KV version 2
+// secrets are nested below data.
+type kvCertStore struct {
+	client       *api.Client
+	pathTemplate string
+}
+
+func newKVCertStore(client *api.Client, pathTemplate string, pkiMount string) (kvCertStore, error) {
+	if err := validateCertPathTemplate(pathTemplate); err != nil {
+		return kvCertStore{}, err
+	}
+	pathTemplate = strings.ReplaceAll(pathTemplate, certPathMount, pkiMount)
+	return kvCertStore{client: client, pathTemplate: pathTemplate}, nil
+}
+
+func (store kvCertStore) certificateData(ctx context.Context, serial string) (map[string]interface{}, error) {
+	secret, err := readSecret(ctx, store.client, strings.ReplaceAll(store.pathTemplate, certPathSerial, serial))
+	if err != nil || secret == nil || secret.Data == nil {
+		return nil, err
+	}
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		return nested, nil
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,152 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCertificateDataWithoutSecret(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	// 11 is not in vault at all, 12 has a secret without data
+	vault.set("pki/cert/12", nil)
+
+	for _, serial := range []*big.Int{big.NewInt(0x11), big.NewInt(0x12)} {
+		t.Run(toVaultSerial(serial), func(t *testing.T) {
+			data, err := source.certs.certificateData(context.Background(), toVaultSerial(serial))
+			if err != nil || data != nil {
+				t.Fatalf("got data %v and error %v, want neither", data, err)
+			}
+			request := pki.request(t, serial, crypto.SHA1)
+			if _, _, err := source.Response(request); !errors.Is(err, errUnknownSerial) {
+				t.Errorf("got error %v, want unknown serial", err)
+			}
+		})
+	}
+}
+
+func TestCertStores(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	client := vault.client(t)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	serial := toVaultSerial(certificate.SerialNumber)
+	revokedAt := time.Now().Add(-time.Hour).Unix()
+	fields := map[string]interface{}{"certificate": pemCertificate(certificate), "revocation_time": revokedAt}
+	vault.set("pki/cert/"+serial, fields)
+	vault.set("secret/data/certs/"+serial, map[string]interface{}{"data": fields, "metadata": map[string]interface{}{"version": 1}})
+	pkiStore, err := newPKICertStore(client, defaultCertPathTemplate, "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvStore, err := newKVCertStore(client, "secret/data/certs/{serial}", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range map[string]certStore{"PKI": pkiStore, "KV": kvStore} {
+		t.Run(name, func(t *testing.T) {
+			data, err := store.certificateData(context.Background(), serial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data["certificate"] != fields["certificate"] {
+				t.Errorf("got certificate %v, want the stored certificate", data["certificate"])
+			}
+			if revocationTime, found, err := parseRevocationTime(data); err != nil || !found || revocationTime.Unix() != revokedAt {
+				t.Errorf("got revocation time %v with error %v, want %d", revocationTime, err, revokedAt)
+			}
+			if data, err := store.certificateData(context.Background(), "00-00"); data != nil || err != nil {
+				t.Errorf("got data %v and error %v for an unknown serial, want neither", data, err)
+			}
+		})
+	}
+}
+
+func TestKVCertPath(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.set("secret/data/certs/"+toVaultSerial(certificate.SerialNumber), map[string]interface{}{"data": map[string]interface{}{
+		"certificate":     pemCertificate(certificate),
+		"revocation_time": time.Now().Add(-time.Hour).Unix(),
+	}})
+	config := newTestConfiguration(t, "-kvCertPath", "secret/data/certs/{serial}")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+
+	der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := pki.parse(t, der).Status; status != ocsp.Revoked {
+		t.Errorf("got status %d, want revoked from the KV secret", status)
+	}
+}
+
+func TestCertPathTemplate(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	customPath := "proxy/pki/certs/" + toVaultSerial(certificate.SerialNumber) + "/info"
+	vault.set(customPath, map[string]interface{}{"certificate": pemCertificate(certificate)})
+	config := newTestConfiguration(t, "-certPathTemplate", "proxy/{mount}/certs/{serial}/info")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+
+	der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := pki.parse(t, der).Status; status != ocsp.Good {
+		t.Errorf("got status %d, want good", status)
+	}
+	if reads := vault.readCount(customPath); reads != 1 {
+		t.Errorf("got %d reads of %s, want 1", reads, customPath)
+	}
+
+	for _, pathTemplate := range []string{"{mount}/cert", "{mount}/cert/{serial}/{issuer}", "/v1/{mount}/cert/{serial}"} {
+		if err := validateCertPathTemplate(pathTemplate); err == nil {
+			t.Errorf("accepted invalid template %s", pathTemplate)
+		}
+	}
+	if err := validateCertPathTemplate(defaultCertPathTemplate); err != nil {
+		t.Errorf("default template is invalid: %v", err)
+	}
+}
+
+func TestKVShapedCertificateData(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	logger := captureLog(t)
+	serial := nextTestSerial()
+	// a KV v2 read wraps the secret in data and metadata
+	vault.set("pki/cert/"+toVaultSerial(serial), map[string]interface{}{
+		"data":     map[string]interface{}{"password": "secret"},
+		"metadata": map[string]interface{}{"version": 1},
+	})
+
+	_, _, err := source.Response(pki.request(t, serial, crypto.SHA1))
+	if err == nil {
+		t.Fatal("answered for KV data")
+	}
+	if status := responseStatus(err); status != ocsp.InternalError {
+		t.Errorf("got response status %v for KV data, want internal error", status)
+	}
+	if !logger.contains("does not look like a PKI mount") {
+		t.Error("the misconfigured mount is not logged")
+	}
+	if err := checkCertificateData(map[string]interface{}{"data": nil, "metadata": nil}); err == nil {
+		t.Error("accepted KV data as certificate data")
+	}
+}
@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// parseSerial parses a hexadecimal serial number that may contain the dash
+// or colon separators used by vault and openssl.
+func parseSerial(serial string) (*big.Int, error) {
+	digits := strings.NewReplacer("-", "", ":", "").Replace(strings.TrimSpace(serial))
+	serialNumber, ok := new(big.Int).SetString(digits, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number %s", serial)
+	}
+	return serialNumber, nil
+}
+
+// runCheck looks up the serial number like a live OCSP request for it and
+// prints the resulting status to out. The serial number is looked up in each
+// PKI mount until one of them knows it.
+func runCheck(sources []*VaultSource, serial string, out io.Writer) error {
+	serialNumber, err := parseSerial(serial)
+	if err != nil {
+		return err
+	}
+	vaultSerial := toVaultSerial(serialNumber)
+	for _, source := range sources {
+		status, err := checkSerial(source, serialNumber)
+		if errors.Is(err, errUnknownSerial) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s of %s: %v", vaultSerial, source.pkiMount, err)
+		}
+		fmt.Fprintf(out, "%s: %s\n", vaultSerial, status)
+		return nil
+	}
+	fmt.Fprintf(out, "%s: unknown\n", vaultSerial)
+	return nil
+}
+
+// checkSerial returns the status of the serial number in the PKI mount of
+// the source, errUnknownSerial if the mount does not know it.
+func checkSerial(source *VaultSource, serialNumber *big.Int) (string, error) {
+	issuer, err := source.issuerOf(serialNumber)
+	if err != nil {
+		return "", err
+	}
+	keyHash, err := issuerKeyHash(issuer, crypto.SHA1)
+	if err != nil {
+		return "", err
+	}
+	request := &ocsp.Request{
+		HashAlgorithm: crypto.SHA1,
+		IssuerKeyHash: keyHash,
+		SerialNumber:  serialNumber,
+	}
+	responseBytes, _, err := source.Response(request)
+	if errors.Is(err, errUnknownSerial) {
+		return "", err
+	}
+	if status := responseStatus(err); err != nil && status != ocsp.InternalError {
+		return status.String(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// responses of -omitResponderCert have no certificate to verify them
+	// with, they are verified after parsing
+	response, err := ocsp.ParseResponse(responseBytes, nil)
+	if responseError, ok := err.(ocsp.ResponseError); ok {
+		return responseError.Status.String(), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	if err := verifyResponseSignature(source, issuer, response); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	switch response.Status {
+	case ocsp.Good:
+		return fmt.Sprintf("good, next update %s", response.NextUpdate), nil
+	case ocsp.Revoked:
+		return fmt.Sprintf("revoked at %s", response.RevokedAt), nil
+	default:
+		return "unknown", nil
+	}
+}
+
+// verifyResponseSignature checks that the response is signed by a responder
+// certificate of the issuer or by the issuer itself. Responses without
+// certificate are verified with the responder certificates of the source.
+func verifyResponseSignature(source *VaultSource, issuer *x509.Certificate, response *ocsp.Response) error {
+	candidates := source.responderCertificates()
+	if response.Certificate != nil {
+		candidates = []*x509.Certificate{response.Certificate}
+	}
+	for _, responderCert := range candidates {
+		if !responderCert.Equal(issuer) && responderCert.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if response.CheckSignatureFrom(responderCert) == nil {
+			return nil
+		}
+	}
+	return errors.New("not signed by a responder certificate of the issuer")
+}
@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCheck(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name   string
+		serial string
+		output string
+	}{
+		{"good", toVaultSerial(good.SerialNumber), toVaultSerial(good.SerialNumber) + ": good, next update "},
+		{"revoked", toVaultSerial(revoked.SerialNumber), toVaultSerial(revoked.SerialNumber) + ": revoked at "},
+		{"unknown", "ff:ff", "ff-ff: unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := runCheck([]*VaultSource{source}, test.serial, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(out.String(), test.output) {
+				t.Errorf("got output %q, want %q", out.String(), test.output)
+			}
+		})
+	}
+	if err := runCheck([]*VaultSource{source}, "not a serial", &bytes.Buffer{}); err == nil {
+		t.Error("checked an invalid serial")
+	}
+}
+
+func TestRunCheckWithoutResponderCertificate(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.omitResponderCert = true
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+
+	var out bytes.Buffer
+	if err := runCheck([]*VaultSource{source}, toVaultSerial(good.SerialNumber), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := toVaultSerial(good.SerialNumber) + ": good, next update "; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+
+	// responses signed by a key that is not a responder of the issuer fail
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source.setResponders([]responderPair{{certificate: other.responder, key: &other.responderKey}})
+	if err := runCheck([]*VaultSource{source}, toVaultSerial(good.SerialNumber), &bytes.Buffer{}); err == nil {
+		t.Error("checked a response signed by the responder of another issuer")
+	}
+}
+
+func TestRunCheckMultipleIssuers(t *testing.T) {
+	vault := newFakeVault(t)
+	first := newTestPKI(t, "First CA", time.Now().Add(24*time.Hour))
+	second := newTestPKI(t, "Second CA", time.Now().Add(24*time.Hour))
+	vault.setList("pki/issuers", []string{"first", "second"})
+	vault.set("pki/issuer/first", map[string]interface{}{"certificate": pemCertificate(first.ca)})
+	vault.set("pki/issuer/second", map[string]interface{}{"certificate": pemCertificate(second.ca)})
+	source, err := NewVaultSource("pki", issuerSelection{}, first.responder, &first.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.verifyChain = true
+	source.setResponders([]responderPair{
+		{certificate: first.responder, key: &first.responderKey, issuerKeyID: first.ca.SubjectKeyId},
+		{certificate: second.responder, key: &second.responderKey, issuerKeyID: second.ca.SubjectKeyId},
+	})
+	certificate := second.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	var out bytes.Buffer
+	if err := runCheck([]*VaultSource{source}, toVaultSerial(certificate.SerialNumber), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := toVaultSerial(certificate.SerialNumber) + ": good, next update "; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("got output %q for a certificate of the second issuer, want %q", out.String(), want)
+	}
+}
+
+func TestRunCheckMultipleMounts(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-check", "ff")
+	mounts := newTestMounts(t, vault, config, pki, "pki", "pki2")
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki2", revoked, time.Now().Add(-time.Minute))
+
+	for _, source := range mounts.sources() {
+		if _, ok := source.cache.(disabledCache); !ok {
+			t.Errorf("%s caches responses with -check", source.pkiMount)
+		}
+	}
+	var out bytes.Buffer
+	if err := runCheck(mounts.sources(), toVaultSerial(revoked.SerialNumber), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := toVaultSerial(revoked.SerialNumber) + ": revoked at "; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("got output %q for a certificate of the second mount, want %q", out.String(), want)
+	}
+	out.Reset()
+	if err := runCheck(mounts.sources(), "ff:ff", &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ff-ff: unknown\n"; out.String() != want {
+		t.Errorf("got output %q for a serial of no mount, want %q", out.String(), want)
+	}
+}
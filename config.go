@@ -0,0 +1,480 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const redacted = "<redacted>"
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// duration is a time.Duration that is represented as a duration string like
+// "5m0s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// configuration holds the effective settings of vault-ocsp.
+type configuration struct {
+	ConfigFile              string     `json:"-"`
+	ShowVersion             bool       `json:"-"`
+	LogLevel                string     `json:"logLevel"`
+	PKIMounts               stringList `json:"pkimount"`
+	TokenFile               string     `json:"tokenFile"`
+	AuthMethod              string     `json:"authMethod"`
+	K8sRole                 string     `json:"k8sRole"`
+	K8sJWTPath              string     `json:"k8sJWTPath"`
+	AuthMount               string     `json:"authMount"`
+	VaultCACert             string     `json:"vaultCACert"`
+	VaultCAPath             string     `json:"vaultCAPath"`
+	IssuerRef               string     `json:"issuerRef"`
+	CAChain                 bool       `json:"caChain"`
+	Issuers                 string     `json:"issuers"`
+	DiscoverMounts          bool       `json:"discoverMounts"`
+	DiscoveryInterval       duration   `json:"discoveryInterval"`
+	SerialFormat            string     `json:"serialFormat"`
+	SerialCase              string     `json:"serialCase"`
+	KVCertPath              string     `json:"kvCertPath"`
+	CertPathTemplate        string     `json:"certPathTemplate"`
+	SerialAllowlist         string     `json:"serialAllowlist"`
+	ServerAddrs             stringList `json:"serverAddr"`
+	SocketMode              string     `json:"socketMode"`
+	BasePath                string     `json:"basePath"`
+	ReadTimeout             duration   `json:"readTimeout"`
+	ReadHeaderTimeout       duration   `json:"readHeaderTimeout"`
+	WriteTimeout            duration   `json:"writeTimeout"`
+	IdleTimeout             duration   `json:"idleTimeout"`
+	MaxRequestBytes         int64      `json:"maxRequestBytes"`
+	StrictContentType       bool       `json:"strictContentType"`
+	RateLimit               float64    `json:"rateLimit"`
+	RateBurst               int        `json:"rateBurst"`
+	TrustedProxies          stringList `json:"trustedProxy"`
+	AccessLog               bool       `json:"accessLog"`
+	AuditLog                string     `json:"auditLog"`
+	ResponderCert           string     `json:"responderCert"`
+	ResponderKey            string     `json:"responderKey"`
+	ResponderPEM            string     `json:"responderPEM"`
+	IssuerResponderPEM      stringList `json:"issuerResponderPEM"`
+	MountResponders         string     `json:"mountResponders"`
+	ResponseHeaders         stringList `json:"responseHeader"`
+	ResponderVaultPath      string     `json:"responderVaultPath"`
+	SignerType              string     `json:"signerType"`
+	PKCS11Module            string     `json:"pkcs11Module"`
+	PKCS11Slot              int        `json:"pkcs11Slot"`
+	PKCS11PIN               string     `json:"pkcs11PIN"`
+	PKCS11KeyLabel          string     `json:"pkcs11KeyLabel"`
+	SecondaryResponderCert  string     `json:"secondaryResponderCert"`
+	SecondaryResponderKey   string     `json:"secondaryResponderKey"`
+	ResponderSelection      string     `json:"responderSelection"`
+	SignatureAlgorithm      string     `json:"signatureAlgorithm"`
+	OmitResponderCert       bool       `json:"omitResponderCert"`
+	ThisUpdateSkew          duration   `json:"thisUpdateSkew"`
+	NextUpdate              duration   `json:"nextUpdate"`
+	StaplingNextUpdate      duration   `json:"staplingNextUpdate"`
+	RevokedNextUpdate       duration   `json:"revokedNextUpdate"`
+	ProducedAt              string     `json:"producedAt"`
+	ArchiveCutoff           duration   `json:"archiveCutoff"`
+	CacheMargin             duration   `json:"cacheMargin"`
+	CacheMinAge             duration   `json:"cacheMinAge"`
+	CacheMaxAge             duration   `json:"cacheMaxAge"`
+	NegativeCacheTTL        duration   `json:"negativeCacheTTL"`
+	NoCache                 bool       `json:"noCache"`
+	CacheBackend            string     `json:"cacheBackend"`
+	CacheSnapshot           string     `json:"cacheSnapshot"`
+	CacheSnapshotInterval   duration   `json:"cacheSnapshotInterval"`
+	RedisAddr               string     `json:"redisAddr"`
+	RedisTimeout            duration   `json:"redisTimeout"`
+	MaxConcurrentVaultReads int        `json:"maxConcurrentVaultReads"`
+	VaultReadQueueTimeout   duration   `json:"vaultReadQueueTimeout"`
+	VaultTimeout            duration   `json:"vaultTimeout"`
+	CircuitBreakerThreshold int        `json:"circuitBreakerThreshold"`
+	CircuitBreakerCooldown  duration   `json:"circuitBreakerCooldown"`
+	RetryAfter              duration   `json:"retryAfter"`
+	RetryAfterJitter        duration   `json:"retryAfterJitter"`
+	WarmCache               bool       `json:"warmCache"`
+	CRLRefresh              duration   `json:"crlRefresh"`
+	UnifiedCRL              bool       `json:"unifiedCRL"`
+	CARefresh               duration   `json:"caRefresh"`
+	CertExpiryWarning       duration   `json:"certExpiryWarning"`
+	CertExpiryCheck         duration   `json:"certExpiryCheck"`
+	RefuseExpiredCert       bool       `json:"refuseExpiredCert"`
+	ExpiredCertBehavior     string     `json:"expiredCertBehavior"`
+	AllowExpiredCA          bool       `json:"allowExpiredCA"`
+	VerifyChain             bool       `json:"verifyChain"`
+	SelfTest                bool       `json:"selfTest"`
+	ReadinessProbe          bool       `json:"readinessProbe"`
+	ResponseSizeWarning     int        `json:"responseSizeWarning"`
+	AdminToken              string     `json:"adminToken"`
+	PprofAddr               string     `json:"pprofAddr"`
+	OtelEndpoint            string     `json:"otelEndpoint"`
+	DebugCache              bool       `json:"debugCache"`
+	Check                   string     `json:"check,omitempty"`
+	CAPath                  string     `json:"caPath"`
+	Banner                  string     `json:"banner"`
+}
+
+func (config *configuration) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&config.ConfigFile, "config", "", "JSON file with settings named like the flags, flags given on the command line take precedence")
+	flags.BoolVar(&config.ShowVersion, "version", false, "Print the version and exit")
+	flags.StringVar(&config.LogLevel, "logLevel", "info", "Minimum level of logged messages, debug, info, warning, error or critical")
+	flags.StringVar(&config.TokenFile, "tokenFile", "", "File with the vault token like the token sink of Vault Agent, re-read when it changes, replaces VAULT_TOKEN")
+	flags.StringVar(&config.AuthMethod, "authMethod", "", "Vault auth method to log in with instead of using a token, kubernetes")
+	flags.StringVar(&config.K8sRole, "k8sRole", "", "Vault role to log in as with the kubernetes auth method")
+	flags.StringVar(&config.K8sJWTPath, "k8sJWTPath", defaultK8sJWTPath, "Service account token to log in with the kubernetes auth method")
+	flags.StringVar(&config.AuthMount, "authMount", "", "Mount of the vault auth method if it is not mounted at its default path like kubernetes")
+	flags.StringVar(&config.VaultCACert, "vaultCACert", "", "PEM file with the CA certificates verifying the TLS certificate of vault, replaces VAULT_CACERT")
+	flags.StringVar(&config.VaultCAPath, "vaultCAPath", "", "Directory of PEM files with the CA certificates verifying the TLS certificate of vault, replaces VAULT_CAPATH")
+	flags.Var(&config.PKIMounts, "pkimount", "vault PKI mount to use (default pki), repeat to serve several mounts below /<mount>/")
+	flags.StringVar(&config.IssuerRef, "issuerRef", "", "vault PKI issuer to answer for, all issuers of the mount are used if empty")
+	flags.BoolVar(&config.CAChain, "caChain", false, "Also answer for the CA certificates of the mount's ca_chain like the intermediate and root CAs above the mount's CA")
+	flags.StringVar(&config.Issuers, "issuers", "", "PEM bundle of the CA certificates to answer for instead of the issuers of the PKI mount")
+	flags.BoolVar(&config.DiscoverMounts, "discoverMounts", false, "Serve all PKI mounts listed by vault's sys/mounts below /<mount>/")
+	flags.DurationVar((*time.Duration)(&config.DiscoveryInterval), "discoveryInterval", 5*time.Minute, "Interval for discovering new PKI mounts, 0 disables rediscovery")
+	flags.StringVar(&config.SerialFormat, "serialFormat", serialFormatDash, "Format of serial numbers in vault certificate paths, dash or colon")
+	flags.StringVar(&config.SerialCase, "serialCase", serialCaseLower, "Case of the hex digits of serial numbers in vault certificate paths, lower or upper")
+	flags.StringVar(&config.CertPathTemplate, "certPathTemplate", defaultCertPathTemplate, "Vault path template of certificate reads, {mount} is replaced by the PKI mount and {serial} by the formatted serial number")
+	flags.StringVar(&config.KVCertPath, "kvCertPath", "", "Vault KV path template like secret/data/certs/{serial} to read certificate and revocation_time fields from instead of the PKI mount, {mount} is replaced by the PKI mount")
+	flags.StringVar(&config.SerialAllowlist, "serialAllowlist", "", "File with hexadecimal serial numbers to answer for, one per line, all other serials are treated as unknown")
+	flags.Var(&config.ServerAddrs, "serverAddr", "Server IP and Port to use like :8080 (default) or [::1]:8080, use unix:<path> to listen on a Unix domain socket, repeat to listen on several addresses")
+	flags.StringVar(&config.SocketMode, "socketMode", "0660", "Octal file permissions of the Unix domain socket")
+	flags.StringVar(&config.BasePath, "basePath", "", "Path prefix like /ocsp below which all endpoints are served, for reverse proxies that do not strip it")
+	flags.DurationVar((*time.Duration)(&config.ReadTimeout), "readTimeout", 5*time.Second, "Maximum duration for reading an entire HTTP request, 0 disables the timeout")
+	flags.DurationVar((*time.Duration)(&config.ReadHeaderTimeout), "readHeaderTimeout", 2*time.Second, "Maximum duration for reading HTTP request headers, 0 disables the timeout")
+	flags.DurationVar((*time.Duration)(&config.WriteTimeout), "writeTimeout", 10*time.Second, "Maximum duration for writing an HTTP response, 0 disables the timeout")
+	flags.DurationVar((*time.Duration)(&config.IdleTimeout), "idleTimeout", 60*time.Second, "Maximum time idle keep-alive connections are kept open, 0 disables the timeout")
+	flags.Int64Var(&config.MaxRequestBytes, "maxRequestBytes", 10*1024, "Maximum size of OCSP POST request bodies in bytes")
+	flags.BoolVar(&config.StrictContentType, "strictContentType", true, "Answer OCSP POST requests without the Content-Type application/ocsp-request with 415, disable for lenient clients")
+	flags.Float64Var(&config.RateLimit, "rateLimit", 0, "Maximum OCSP requests per second of each client IP address, requests beyond it are answered with 429, 0 disables the limit")
+	flags.IntVar(&config.RateBurst, "rateBurst", 20, "Number of OCSP requests a client IP address may send at once before -rateLimit applies")
+	flags.Var(&config.TrustedProxies, "trustedProxy", "IP address or CIDR network of a reverse proxy whose X-Forwarded-For header names the client for -rateLimit, repeat for several proxies")
+	flags.BoolVar(&config.AccessLog, "accessLog", false, "Log each OCSP request with its outcome and duration")
+	flags.StringVar(&config.AuditLog, "auditLog", "", "File to append a JSON line per served OCSP response to, reopened on SIGHUP")
+	flags.StringVar(&config.ResponderCert, "responderCert", "", "OCSP responder signing certificate file")
+	flags.StringVar(&config.ResponderKey, "responderKey", "", "OCSP responder signing private key file")
+	flags.StringVar(&config.ResponderPEM, "responderPEM", "", "PEM file containing both the OCSP responder signing certificate and private key, replaces -responderCert and -responderKey")
+	flags.Var(&config.IssuerResponderPEM, "issuerResponderPEM", "PEM file with the certificate and private key of a responder that signs for the issuer named by its authority key identifier only, repeat for several issuers")
+	flags.StringVar(&config.MountResponders, "mountResponders", "", "JSON file mapping PKI mounts to the cert and key files of their own responders, other mounts use the global responder")
+	flags.StringVar(&config.ResponderVaultPath, "responderVaultPath", "", "Vault KV path like secret/data/ocsp with the PEM encoded responder certificate and private_key, replaces -responderCert and -responderKey")
+	flags.StringVar(&config.SignerType, "signerType", signerTypeFile, "Source of the responder signing key, file or pkcs11")
+	flags.StringVar(&config.PKCS11Module, "pkcs11Module", "", "Path of the PKCS#11 module library for the pkcs11 signer type")
+	flags.IntVar(&config.PKCS11Slot, "pkcs11Slot", 0, "PKCS#11 slot number holding the responder key")
+	flags.StringVar(&config.PKCS11PIN, "pkcs11PIN", "", "PIN for logging in to the PKCS#11 token")
+	flags.StringVar(&config.PKCS11KeyLabel, "pkcs11KeyLabel", "", "Label of the responder key pair on the PKCS#11 token")
+	flags.StringVar(&config.SecondaryResponderCert, "secondaryResponderCert", "", "Secondary OCSP responder signing certificate file for responder rollover")
+	flags.StringVar(&config.SecondaryResponderKey, "secondaryResponderKey", "", "Secondary OCSP responder signing private key file for responder rollover")
+	flags.StringVar(&config.ResponderSelection, "responderSelection", responderSelectionPrimary, "Responder used for signing, primary, round-robin or first-valid")
+	flags.StringVar(&config.SignatureAlgorithm, "signatureAlgorithm", "", "Algorithm for signing responses like SHA384-RSA or ECDSA-SHA384, chosen by the responder key type if empty")
+	flags.BoolVar(&config.OmitResponderCert, "omitResponderCert", false, "Leave the responder certificate out of responses to make them smaller, clients must trust the responder certificate directly")
+	flags.DurationVar((*time.Duration)(&config.ThisUpdateSkew), "thisUpdateSkew", 5*time.Minute, "Backdate ThisUpdate of responses by this duration to tolerate client clock skew")
+	flags.DurationVar((*time.Duration)(&config.NextUpdate), "nextUpdate", time.Hour, "Validity of good responses, capped at the expiry of the certificate")
+	flags.DurationVar((*time.Duration)(&config.StaplingNextUpdate), "staplingNextUpdate", 0, "Validity of good responses for requests below /staple/ from servers stapling responses, capped at the expiry of the certificate, 0 disables the stapling path")
+	flags.DurationVar((*time.Duration)(&config.ArchiveCutoff), "archiveCutoff", 0, "Retention period of revocation information, responses carry the archive cutoff extension with ProducedAt minus this period, 0 omits the extension")
+	flags.DurationVar((*time.Duration)(&config.RevokedNextUpdate), "revokedNextUpdate", 0, "Validity of revoked responses, 0 leaves NextUpdate out so that clients may cache them indefinitely")
+	flags.StringVar(&config.ProducedAt, "producedAt", "", "Fixed RFC 3339 ProducedAt time for reproducible responses, the signing time is used if empty")
+	flags.DurationVar((*time.Duration)(&config.CacheMargin), "cacheMargin", 5*time.Minute, "Safety margin subtracted from NextUpdate for HTTP cache lifetimes")
+	flags.DurationVar((*time.Duration)(&config.CacheMinAge), "cacheMinAge", 0, "Minimum HTTP cache lifetime for OCSP responses")
+	flags.DurationVar((*time.Duration)(&config.CacheMaxAge), "cacheMaxAge", 24*time.Hour, "Maximum HTTP cache lifetime for OCSP responses")
+	flags.DurationVar((*time.Duration)(&config.NegativeCacheTTL), "negativeCacheTTL", time.Minute, "Time to cache lookups of serials unknown to vault, of expired certificates answered unauthorized or of certificates not issued by the requested issuer, 0 disables caching of these lookups")
+	flags.BoolVar(&config.NoCache, "noCache", false, "Disable caching of OCSP responses, every request is looked up in vault")
+	flags.StringVar(&config.CacheBackend, "cacheBackend", cacheBackendMemory, "Storage of cached OCSP responses, memory or redis to share them between instances")
+	flags.StringVar(&config.CacheSnapshot, "cacheSnapshot", "", "File the memory cache is saved to periodically and on shutdown and restored from at startup")
+	flags.DurationVar((*time.Duration)(&config.CacheSnapshotInterval), "cacheSnapshotInterval", 5*time.Minute, "Interval of saving the cache to -cacheSnapshot")
+	flags.StringVar(&config.RedisAddr, "redisAddr", "", "Address like redis:6379 of the redis server for the redis cache backend")
+	flags.DurationVar((*time.Duration)(&config.RedisTimeout), "redisTimeout", time.Second, "Timeout for connecting to and each command sent to the redis server")
+	flags.IntVar(&config.MaxConcurrentVaultReads, "maxConcurrentVaultReads", 0, "Maximum number of concurrent vault reads per PKI mount, 0 disables the limit")
+	flags.DurationVar((*time.Duration)(&config.VaultReadQueueTimeout), "vaultReadQueueTimeout", 500*time.Millisecond, "Time requests wait for a vault read slot before they are answered with tryLater")
+	flags.DurationVar((*time.Duration)(&config.VaultTimeout), "vaultTimeout", 5*time.Second, "Maximum duration of vault reads for OCSP requests before they are answered with tryLater, 0 disables the timeout")
+	flags.IntVar(&config.CircuitBreakerThreshold, "circuitBreakerThreshold", 0, "Consecutive failed vault reads of a mount after which its lookups are answered with tryLater without reading for -circuitBreakerCooldown, 0 disables the circuit breaker")
+	flags.DurationVar((*time.Duration)(&config.CircuitBreakerCooldown), "circuitBreakerCooldown", 30*time.Second, "Duration vault reads are suspended after -circuitBreakerThreshold failures before a single read probes vault again")
+	flags.DurationVar((*time.Duration)(&config.RetryAfter), "retryAfter", 5*time.Second, "Retry-After time of tryLater responses")
+	flags.DurationVar((*time.Duration)(&config.RetryAfterJitter), "retryAfterJitter", 5*time.Second, "Maximum random time added to the Retry-After time of tryLater responses")
+	flags.BoolVar(&config.WarmCache, "warmCache", false, "Pre-build responses for all revoked certificates at startup")
+	flags.DurationVar((*time.Duration)(&config.CRLRefresh), "crlRefresh", 0, "Interval for refreshing the CRL used to answer for revoked certificates, 0 disables CRL based lookups")
+	flags.BoolVar(&config.UnifiedCRL, "unifiedCRL", false, "Answer for revoked certificates from the unified CRL of all vault clusters, falls back to the CRL of the mount if vault has no unified CRL, requires -crlRefresh")
+	flags.DurationVar((*time.Duration)(&config.CARefresh), "caRefresh", 0, "Interval for re-fetching the CA certificates of the PKI mounts to pick up rotated issuers, 0 disables the refresh")
+	flags.DurationVar((*time.Duration)(&config.CertExpiryWarning), "certExpiryWarning", 30*24*time.Hour, "Warn if the responder certificate expires within this duration")
+	flags.DurationVar((*time.Duration)(&config.CertExpiryCheck), "certExpiryCheck", 24*time.Hour, "Interval for re-checking responder certificate expiry, 0 disables the check")
+	flags.BoolVar(&config.RefuseExpiredCert, "refuseExpiredCert", false, "Refuse to start with an expired responder certificate")
+	flags.StringVar(&config.ExpiredCertBehavior, "expiredCertBehavior", expiredCertUnauthorized, "Answer for expired certificates that are not revoked, unauthorized, status to answer good or unknown")
+	flags.BoolVar(&config.AllowExpiredCA, "allowExpiredCA", false, "Serve PKI mounts whose CA certificates are all expired instead of refusing to start, the problem is logged as error")
+	flags.BoolVar(&config.VerifyChain, "verifyChain", false, "Answer only for certificates signed by the requested, non-expired issuer, other certificates are answered with unauthorized")
+	flags.BoolVar(&config.SelfTest, "selfTest", true, "Sign and verify a sample response with each responder and issuer at startup")
+	flags.BoolVar(&config.ReadinessProbe, "readinessProbe", false, "Report unhealthy on /healthz until a certificate read from the vault of every PKI mount succeeded")
+	flags.IntVar(&config.ResponseSizeWarning, "responseSizeWarning", 4096, "Log a warning for OCSP responses larger than this number of bytes, 0 disables the warning")
+	flags.Var(&config.ResponseHeaders, "responseHeader", "Header like \"Access-Control-Allow-Origin: *\" added to OCSP responses, repeat to add several headers")
+	flags.StringVar(&config.CAPath, "caPath", "/ca", "HTTP path serving the CA certificate, below the path prefix of each mount when serving several mounts, disabled if empty")
+	flags.StringVar(&config.Banner, "banner", "vault-ocsp responder", "Plain text answered to GET requests without an OCSP request like GET /, empty to answer them as malformed requests")
+	flags.StringVar(&config.Check, "check", "", "Print the OCSP status of the given hexadecimal serial number and exit")
+	flags.StringVar(&config.AdminToken, "adminToken", "", "Bearer token for the /admin endpoints, admin endpoints are disabled if empty")
+	flags.BoolVar(&config.DebugCache, "debugCache", false, "Serve cache statistics and a sample of cached serials on /debug/cache, protected by the admin token if set")
+	flags.StringVar(&config.PprofAddr, "pprofAddr", "", "Address like localhost:6060 to serve net/http/pprof profiles on, disabled if empty")
+	flags.StringVar(&config.OtelEndpoint, "otelEndpoint", "", "OTLP/HTTP collector URL like http://localhost:4318 to export OpenTelemetry traces to, tracing is off if empty")
+}
+
+// parse parses the command line arguments. Settings of the -config file
+// replace the defaults, flags given on the command line take precedence
+// over the file.
+func (config *configuration) parse(flags *flag.FlagSet, args []string) error {
+	config.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.ConfigFile == "" {
+		return nil
+	}
+	file, err := os.Open(config.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("could not open configuration file: %v", err)
+	}
+	defer file.Close()
+	// lists given on the command line replace the lists of the file
+	var lists []*stringList
+	flags.Visit(func(f *flag.Flag) {
+		if list, ok := f.Value.(*stringList); ok {
+			lists = append(lists, list)
+		}
+	})
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("could not parse configuration file %s: %v", config.ConfigFile, err)
+	}
+	for _, list := range lists {
+		*list = nil
+	}
+	return flags.Parse(args)
+}
+
+// applyDefaults fills in the defaults of list flags and normalizes paths.
+func (config *configuration) applyDefaults() {
+	if len(config.ServerAddrs) == 0 {
+		config.ServerAddrs = stringList{":8080"}
+	}
+	config.BasePath = strings.TrimSuffix(config.BasePath, "/")
+	if len(config.PKIMounts) == 0 && !config.DiscoverMounts {
+		config.PKIMounts = stringList{"pki"}
+	}
+}
+
+// logLevels maps the -logLevel names to cfssl log levels.
+var logLevels = map[string]int{
+	"debug":    log.LevelDebug,
+	"info":     log.LevelInfo,
+	"warning":  log.LevelWarning,
+	"error":    log.LevelError,
+	"critical": log.LevelCritical,
+}
+
+// logLevel is the minimum level of logged messages. cfssl reads log.Level
+// without synchronization, so it stays at debug once serving and
+// levelLogger drops the messages below logLevel instead, which lets a
+// reload change the level while requests are logging.
+var logLevel = int32(log.LevelInfo)
+
+// setLogLevel sets the minimum level of logged messages.
+func setLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// currentLogLevel returns the minimum level of logged messages.
+func currentLogLevel() int {
+	return int(atomic.LoadInt32(&logLevel))
+}
+
+// filterLogLevel lets cfssl hand all messages to a levelLogger, it must be
+// called before logging concurrently.
+func filterLogLevel() {
+	log.Level = log.LevelDebug
+	log.SetLogger(levelLogger{})
+}
+
+// levelLogger writes the messages of at least logLevel like the default
+// output of cfssl.
+type levelLogger struct{}
+
+func (levelLogger) print(level int, prefix string, message string) {
+	if level >= currentLogLevel() {
+		stdlog.Printf("[%s] %s", prefix, message)
+	}
+}
+
+func (logger levelLogger) Debug(message string)   { logger.print(log.LevelDebug, "DEBUG", message) }
+func (logger levelLogger) Info(message string)    { logger.print(log.LevelInfo, "INFO", message) }
+func (logger levelLogger) Warning(message string) { logger.print(log.LevelWarning, "WARNING", message) }
+func (logger levelLogger) Err(message string)     { logger.print(log.LevelError, "ERROR", message) }
+func (logger levelLogger) Crit(message string)    { logger.print(log.LevelCritical, "CRITICAL", message) }
+func (logger levelLogger) Emerg(message string)   { logger.print(log.LevelFatal, "FATAL", message) }
+
+// configLock guards the settings that change when the configuration is
+// reloaded.
+var configLock sync.RWMutex
+
+// reloadableSettings are the JSON names of the settings that are applied
+// by a configuration reload, all other settings require a restart.
+var reloadableSettings = map[string]bool{
+	"logLevel":          true,
+	"nextUpdate":        true,
+	"revokedNextUpdate": true,
+	"negativeCacheTTL":  true,
+	"cacheMargin":       true,
+	"cacheMinAge":       true,
+	"cacheMaxAge":       true,
+}
+
+// lifetimes returns the response lifetimes of the configuration.
+func (config *configuration) lifetimes() responseLifetimes {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return responseLifetimes{
+		nextUpdate:         time.Duration(config.NextUpdate),
+		staplingNextUpdate: time.Duration(config.StaplingNextUpdate),
+		revokedNextUpdate:  time.Duration(config.RevokedNextUpdate),
+		negativeCacheTTL:   time.Duration(config.NegativeCacheTTL),
+		cacheControl: cacheControlPolicy{
+			margin: time.Duration(config.CacheMargin),
+			minAge: time.Duration(config.CacheMinAge),
+			maxAge: time.Duration(config.CacheMaxAge),
+		},
+	}
+}
+
+// reload applies the reloadable settings of the reloaded configuration and
+// logs changes of settings that require a restart.
+func (config *configuration) reload(reloaded *configuration) error {
+	level, found := logLevels[reloaded.LogLevel]
+	if !found {
+		return fmt.Errorf("unsupported log level %s", reloaded.LogLevel)
+	}
+	if reloaded.NextUpdate <= 0 {
+		return fmt.Errorf("invalid nextUpdate %s, it has to be positive", time.Duration(reloaded.NextUpdate))
+	}
+	if reloaded.RevokedNextUpdate < 0 {
+		return fmt.Errorf("invalid revokedNextUpdate %s, it must not be negative", time.Duration(reloaded.RevokedNextUpdate))
+	}
+	configLock.Lock()
+	current := reflect.ValueOf(config).Elem()
+	next := reflect.ValueOf(reloaded).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		name := strings.Split(current.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" || reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		if reloadableSettings[name] {
+			current.Field(i).Set(next.Field(i))
+			log.Infof("Applied changed setting %s", name)
+		} else {
+			log.Warningf("Setting %s changed, restart vault-ocsp to apply it", name)
+		}
+	}
+	configLock.Unlock()
+	setLogLevel(level)
+	return nil
+}
+
+// reloadConfigOnSignal parses the command line arguments and configuration
+// file again on SIGHUP and applies the reloadable settings to all mounts.
+func reloadConfigOnSignal(config *configuration, args []string, mounts *mountSet) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		var reloaded configuration
+		if err := reloaded.parse(flags, args); err != nil {
+			log.Errorf("Keeping previous configuration, reload failed: %v", err)
+			continue
+		}
+		reloaded.applyDefaults()
+		if err := config.reload(&reloaded); err != nil {
+			log.Errorf("Keeping previous configuration, reload failed: %v", err)
+			continue
+		}
+		mounts.setLifetimes(config.lifetimes())
+	}
+}
+
+// authMount returns the mount path of the auth method to log in at, the
+// default mount of -authMethod unless -authMount is given.
+func (config *configuration) authMount() string {
+	if config.AuthMount == "" {
+		return config.AuthMethod
+	}
+	return strings.Trim(config.AuthMount, "/")
+}
+
+// issuerSelection returns which CA certificates of the PKI mounts are
+// answered for.
+func (config *configuration) issuerSelection() issuerSelection {
+	return issuerSelection{ref: config.IssuerRef, caChain: config.CAChain}
+}
+
+// redacted returns a copy of the configuration that is safe to show to
+// operators.
+func (config configuration) redacted() configuration {
+	if config.ResponderKey != "" {
+		config.ResponderKey = redacted
+	}
+	if config.ResponderPEM != "" {
+		config.ResponderPEM = redacted
+	}
+	if len(config.IssuerResponderPEM) > 0 {
+		issuerResponderPEM := make(stringList, len(config.IssuerResponderPEM))
+		for i := range issuerResponderPEM {
+			issuerResponderPEM[i] = redacted
+		}
+		config.IssuerResponderPEM = issuerResponderPEM
+	}
+	if config.PKCS11PIN != "" {
+		config.PKCS11PIN = redacted
+	}
+	if config.SecondaryResponderKey != "" {
+		config.SecondaryResponderKey = redacted
+	}
+	if config.AdminToken != "" {
+		config.AdminToken = redacted
+	}
+	return config
+}
@@ -0,0 +1,129 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// writeConfigFile writes the JSON configuration to a temporary file.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestConfigFile(t *testing.T) {
+	configFile := writeConfigFile(t, `{
+		"serverAddr": [":9090", ":9091"],
+		"pkimount": ["pki_int"],
+		"nextUpdate": "2h",
+		"logLevel": "warning"
+	}`)
+	config := newTestConfiguration(t, "-config", configFile, "-logLevel", "debug")
+
+	if want := (stringList{":9090", ":9091"}); !reflect.DeepEqual(config.ServerAddrs, want) {
+		t.Errorf("got serverAddr %v, want %v", config.ServerAddrs, want)
+	}
+	if want := (stringList{"pki_int"}); !reflect.DeepEqual(config.PKIMounts, want) {
+		t.Errorf("got pkimount %v, want %v", config.PKIMounts, want)
+	}
+	if time.Duration(config.NextUpdate) != 2*time.Hour {
+		t.Errorf("got nextUpdate %v, want 2h from the file", time.Duration(config.NextUpdate))
+	}
+	if config.LogLevel != "debug" {
+		t.Errorf("got logLevel %s, want debug from the command line", config.LogLevel)
+	}
+
+	// lists of the command line replace the lists of the file
+	config = newTestConfiguration(t, "-config", configFile, "-serverAddr", ":8443")
+	if want := (stringList{":8443"}); !reflect.DeepEqual(config.ServerAddrs, want) {
+		t.Errorf("got serverAddr %v, want %v", config.ServerAddrs, want)
+	}
+
+	flags := flag.NewFlagSet("vault-ocsp", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := (&configuration{}).parse(flags, []string{"-config", writeConfigFile(t, `{"nextUpdat": "2h"}`)}); err == nil {
+		t.Error("parsed a configuration file with an unknown setting")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	level := currentLogLevel()
+	defer setLogLevel(level)
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t)
+	mounts := newTestMounts(t, vault, config, pki, "pki")
+	logged := captureLog(t)
+
+	reloaded := newTestConfiguration(t, "-nextUpdate", "3h", "-logLevel", "error", "-serverAddr", ":9090")
+	if err := config.reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+	mounts.setLifetimes(config.lifetimes())
+	if nextUpdate := mounts.sources()[0].currentLifetimes().nextUpdate; nextUpdate != 3*time.Hour {
+		t.Errorf("got nextUpdate %v after the reload, want 3h", nextUpdate)
+	}
+	if level := currentLogLevel(); level != log.LevelError {
+		t.Errorf("got log level %d after the reload, want error", level)
+	}
+	if want := (stringList{":8080"}); !reflect.DeepEqual(config.ServerAddrs, want) {
+		t.Errorf("got serverAddr %v after the reload, want the restart to apply it", config.ServerAddrs)
+	}
+	if !logged.contains("Setting serverAddr changed, restart vault-ocsp to apply it") {
+		t.Error("changed serverAddr was not logged")
+	}
+
+	if err := config.reload(newTestConfiguration(t, "-logLevel", "verbose")); err == nil {
+		t.Error("reloaded an unsupported log level")
+	}
+	if time.Duration(config.NextUpdate) != 3*time.Hour {
+		t.Errorf("got nextUpdate %v after a failed reload, want the previous 3h", time.Duration(config.NextUpdate))
+	}
+}
+
+func TestLevelLogger(t *testing.T) {
+	level := currentLogLevel()
+	defer setLogLevel(level)
+	var output bytes.Buffer
+	stdlog.SetOutput(&output)
+	defer stdlog.SetOutput(os.Stderr)
+
+	// reloads change the level while other goroutines log
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			levelLogger{}.Debug("concurrent message")
+		}
+	}()
+	setLogLevel(log.LevelWarning)
+	<-done
+
+	output.Reset()
+	levelLogger{}.Info("dropped message")
+	levelLogger{}.Warning("logged message")
+	if strings.Contains(output.String(), "dropped message") {
+		t.Errorf("logged %q below the warning level", output.String())
+	}
+	if !strings.Contains(output.String(), "[WARNING] logged message") {
+		t.Errorf("got output %q, want the warning", output.String())
+	}
+}
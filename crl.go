@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// crlRevocations holds the revoked certificates of a parsed CRL keyed by
+// the issuer that signed the CRL and the serial number.
+type crlRevocations map[crlKey]pkix.RevokedCertificate
+
+// crlKey identifies a CRL entry, serial numbers are only unique per issuer.
+type crlKey struct {
+	issuer string
+	serial string
+}
+
+func newCRLKey(issuer *x509.Certificate, serialNumber *big.Int) crlKey {
+	return crlKey{issuer: string(issuer.Raw), serial: serialNumber.String()}
+}
+
+// fetchCRL reads the CRL of the PKI mount and verifies its signature
+// against the issuers of the mount. With unifiedCRL the unified CRL with
+// the revocations of all clusters is read, the local CRL of the mount is
+// read if vault does not provide a unified CRL.
+func (source *VaultSource) fetchCRL() (crlRevocations, error) {
+	issuers, _ := source.currentIssuers()
+	if source.unifiedCRL {
+		crlBytes, err := source.readCRL("unified-crl")
+		if err == nil {
+			return parseCRL(crlBytes, issuers)
+		}
+		log.Warningf("Unified CRL of %s is not available, using the local CRL: %v", source.pkiMount, err)
+	}
+	crlBytes, err := source.readCRL("crl")
+	if err != nil {
+		return nil, err
+	}
+	return parseCRL(crlBytes, issuers)
+}
+
+// readCRL reads the DER encoded CRL at the path below the PKI mount.
+func (source *VaultSource) readCRL(path string) ([]byte, error) {
+	vaultRequest := source.vaultClient.NewRequest(http.MethodGet, fmt.Sprintf("/v1/%s/%s", source.pkiMount, path))
+	vaultResponse, err := source.vaultClient.RawRequest(vaultRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting CRL from vault: %v", err)
+	}
+	defer vaultResponse.Body.Close()
+	crlBytes, err := ioutil.ReadAll(vaultResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CRL data from vault: %v", err)
+	}
+	return crlBytes, nil
+}
+
+func parseCRL(crlBytes []byte, issuers []*x509.Certificate) (crlRevocations, error) {
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CRL: %v", err)
+	}
+	var signer *x509.Certificate
+	for _, issuer := range issuers {
+		if issuer.CheckCRLSignature(crl) == nil {
+			signer = issuer
+			break
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("CRL is not signed by an issuer of the mount")
+	}
+	revocations := make(crlRevocations, len(crl.TBSCertList.RevokedCertificates))
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		revocations[newCRLKey(signer, revoked.SerialNumber)] = revoked
+	}
+	return revocations, nil
+}
+
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// crlReason returns the reason code of a CRL entry, entries without a valid
+// reason code extension are unspecified.
+func crlReason(revoked pkix.RevokedCertificate) int {
+	for _, extension := range revoked.Extensions {
+		if !extension.Id.Equal(oidCRLReason) {
+			continue
+		}
+		var reason asn1.Enumerated
+		if _, err := asn1.Unmarshal(extension.Value, &reason); err != nil {
+			log.Warningf("Invalid CRL reason for serial %s: %v", toVaultSerial(revoked.SerialNumber), err)
+			return ocsp.Unspecified
+		}
+		if reason < ocsp.Unspecified || reason > ocsp.AACompromise || reason == 7 {
+			// 7 is not assigned
+			return ocsp.Unspecified
+		}
+		return int(reason)
+	}
+	return ocsp.Unspecified
+}
+
+// crlRevocation returns the CRL entry for the serial number of the issuer if
+// CRL based lookups are enabled and the serial is revoked.
+func (source *VaultSource) crlRevocation(issuer *x509.Certificate, serialNumber *big.Int) (pkix.RevokedCertificate, bool) {
+	source.crlLock.RLock()
+	defer source.crlLock.RUnlock()
+	if source.crl == nil {
+		return pkix.RevokedCertificate{}, false
+	}
+	revoked, found := source.crl[newCRLKey(issuer, serialNumber)]
+	return revoked, found
+}
+
+// updateCRL fetches the current CRL and replaces the previous one, the
+// previous CRL is kept if the CRL cannot be fetched.
+func (source *VaultSource) updateCRL() error {
+	revocations, err := source.fetchCRL()
+	if err != nil {
+		return err
+	}
+	source.crlLock.Lock()
+	source.crl = revocations
+	source.crlLock.Unlock()
+	log.Infof("Loaded CRL of %s with %d revoked certificates", source.pkiMount, len(revocations))
+	return nil
+}
+
+// refreshCRL periodically updates the CRL.
+func (source *VaultSource) refreshCRL(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := source.updateCRL(); err != nil {
+				log.Errorf("Keeping previous CRL, refresh failed: %v", err)
+			}
+		case <-source.stopped:
+			return
+		}
+	}
+}
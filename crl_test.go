@@ -0,0 +1,182 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// crl returns a DER encoded CRL of the CA with the revoked entries.
+func (pki *testPKI) crl(t *testing.T, revoked ...pkix.RevokedCertificate) []byte {
+	t.Helper()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              nextTestSerial(),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: revoked,
+	}, pki.ca, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCRLRevocation(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	revokedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	vault.setRaw("pki/crl", pki.crl(t, pkix.RevokedCertificate{SerialNumber: certificate.SerialNumber, RevocationTime: revokedAt}))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t, "-crlRefresh", "1h"), pki, "pki")
+	source := mounts.sources()[0]
+
+	der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := pki.parse(t, der)
+	if response.Status != ocsp.Revoked {
+		t.Fatalf("got status %d, want revoked", response.Status)
+	}
+	if !response.RevokedAt.Equal(revokedAt) {
+		t.Errorf("got revocation time %v, want %v", response.RevokedAt, revokedAt)
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(certificate.SerialNumber)); reads != 0 {
+		t.Errorf("read the certificate %d times from vault, want the CRL only", reads)
+	}
+}
+
+func TestCRLRevocationOfOtherIssuer(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	serial := big.NewInt(0x42)
+	revocations, err := parseCRL(other.crl(t, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: time.Now()}),
+		[]*x509.Certificate{pki.ca, other.ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.crl = revocations
+
+	if _, found := source.crlRevocation(other.ca, serial); !found {
+		t.Error("serial is not revoked for the issuer of the CRL")
+	}
+	if _, found := source.crlRevocation(pki.ca, serial); found {
+		t.Error("revocation of another issuer applies to the same serial")
+	}
+}
+
+// reasonExtension returns the CRL entry extension with the reason code.
+func reasonExtension(t *testing.T, reason int) pkix.Extension {
+	t.Helper()
+	value, err := asn1.Marshal(asn1.Enumerated(reason))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidCRLReason, Value: value}
+}
+
+func TestCRLReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []pkix.Extension
+		reason     int
+	}{
+		{"no reason", nil, ocsp.Unspecified},
+		{"key compromise", []pkix.Extension{reasonExtension(t, ocsp.KeyCompromise)}, ocsp.KeyCompromise},
+		{"superseded", []pkix.Extension{reasonExtension(t, ocsp.Superseded)}, ocsp.Superseded},
+		{"unassigned", []pkix.Extension{reasonExtension(t, 7)}, ocsp.Unspecified},
+		{"invalid", []pkix.Extension{{Id: oidCRLReason, Value: []byte{0xff}}}, ocsp.Unspecified},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			revoked := pkix.RevokedCertificate{SerialNumber: big.NewInt(0x42), Extensions: test.extensions}
+			if reason := crlReason(revoked); reason != test.reason {
+				t.Errorf("got reason %d, want %d", reason, test.reason)
+			}
+		})
+	}
+}
+
+func TestCRLRevocationReasonInResponse(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.setRaw("pki/crl", pki.crl(t, pkix.RevokedCertificate{
+		SerialNumber:   certificate.SerialNumber,
+		RevocationTime: time.Now().Add(-time.Hour),
+		Extensions:     []pkix.Extension{reasonExtension(t, ocsp.KeyCompromise)},
+	}))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t, "-crlRefresh", "1h"), pki, "pki")
+
+	der, _, err := mounts.sources()[0].Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := pki.parse(t, der); response.RevocationReason != ocsp.KeyCompromise {
+		t.Errorf("got revocation reason %d, want key compromise", response.RevocationReason)
+	}
+}
+
+func TestUnifiedCRL(t *testing.T) {
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	revokedLocally := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	revokedElsewhere := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	localCRL := pki.crl(t, pkix.RevokedCertificate{SerialNumber: revokedLocally.SerialNumber, RevocationTime: time.Now().Add(-time.Hour)})
+	// the unified CRL also has the revocations of the other clusters
+	unifiedCRL := pki.crl(t,
+		pkix.RevokedCertificate{SerialNumber: revokedLocally.SerialNumber, RevocationTime: time.Now().Add(-time.Hour)},
+		pkix.RevokedCertificate{SerialNumber: revokedElsewhere.SerialNumber, RevocationTime: time.Now().Add(-time.Hour)})
+	tests := []struct {
+		name    string
+		unified bool
+		want    int
+	}{
+		{"unified CRL", true, ocsp.Revoked},
+		{"without unified CRL", false, ocsp.Good},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault := newFakeVault(t)
+			vault.setRaw("pki/crl", localCRL)
+			if test.unified {
+				vault.setRaw("pki/unified-crl", unifiedCRL)
+			}
+			for _, certificate := range []*x509.Certificate{revokedLocally, revokedElsewhere} {
+				vault.addCertificate("pki", certificate, time.Time{})
+			}
+			mounts := newTestMounts(t, vault, newTestConfiguration(t, "-crlRefresh", "1h", "-unifiedCRL"), pki, "pki")
+			source := mounts.sources()[0]
+			if reads := vault.readCount("pki/unified-crl"); reads != 1 {
+				t.Errorf("read the unified CRL %d times, want 1", reads)
+			}
+			// the local CRL is only read if there is no unified CRL
+			if reads, want := vault.readCount("pki/crl"), map[bool]int{true: 0, false: 1}[test.unified]; reads != want {
+				t.Errorf("read the local CRL %d times, want %d", reads, want)
+			}
+
+			expected := map[*x509.Certificate]int{revokedLocally: ocsp.Revoked, revokedElsewhere: test.want}
+			for certificate, status := range expected {
+				der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if response := pki.parse(t, der); response.Status != status {
+					t.Errorf("got status %d for serial %s, want %d", response.Status, certificate.SerialNumber, status)
+				}
+			}
+		})
+	}
+}
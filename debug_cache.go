@@ -0,0 +1,69 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// debugCacheSample is the number of cached serials listed per mount.
+const debugCacheSample = 10
+
+// cacheDebugHandler serves human readable cache statistics of all mounts.
+// Only serial numbers of cached entries are shown, never response bytes.
+func cacheDebugHandler(mounts *mountSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, source := range mounts.sources() {
+			writeCacheStats(w, source)
+		}
+	})
+}
+
+func writeCacheStats(w http.ResponseWriter, source *VaultSource) {
+	fmt.Fprintf(w, "mount %s\n", source.pkiMount)
+	fmt.Fprintf(w, "  hits: %d\n", atomic.LoadUint64(&source.cacheHits))
+	fmt.Fprintf(w, "  misses: %d\n", atomic.LoadUint64(&source.cacheMisses))
+	inspector, ok := source.cache.(cacheInspector)
+	if !ok {
+		// shared caches like redis cannot be attributed to this process
+		fmt.Fprintf(w, "  entries: unknown for %T\n", source.cache)
+		return
+	}
+	size, keys := inspector.inspect(debugCacheSample)
+	fmt.Fprintf(w, "  entries: %d\n", size)
+	serials := make([]string, 0, len(keys))
+	for _, key := range keys {
+		serials = append(serials, cacheKeySerial(key, source.serialStyle))
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		fmt.Fprintf(w, "  cached: %s\n", serial)
+	}
+}
+
+// cacheKeySerial returns the serial number of a cache key in vault format,
+// cache keys are <issuer key hash>/<decimal serial>[/<algorithms>].
+func cacheKeySerial(key string, style serialStyle) string {
+	parts := strings.Split(key, "/")
+	if len(parts) < 2 {
+		return key
+	}
+	serial, ok := new(big.Int).SetString(parts[1], 10)
+	if !ok {
+		return key
+	}
+	return formatSerial(serial, style)
+}
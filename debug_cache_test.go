@@ -0,0 +1,51 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheDebugHandler(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t, "-debugCache"), pki, "pki")
+	source := mounts.sources()[0]
+	var serials []string
+	for i := 0; i < 2; i++ {
+		certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+		vault.addCertificate("pki", certificate, time.Time{})
+		serials = append(serials, toVaultSerial(certificate.SerialNumber))
+		// the first certificate is answered from the cache the second time
+		for j := 0; j < 2-i; j++ {
+			if _, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sort.Strings(serials)
+
+	recorder := httptest.NewRecorder()
+	cacheDebugHandler(mounts).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/cache", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", recorder.Code)
+	}
+	want := "mount pki\n  hits: 1\n  misses: 2\n  entries: 2\n  cached: " + strings.Join(serials, "\n  cached: ") + "\n"
+	if recorder.Body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", recorder.Body.String(), want)
+	}
+
+	recorder = httptest.NewRecorder()
+	cacheDebugHandler(mounts).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug/cache", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for POST, want 405", recorder.Code)
+	}
+}
@@ -0,0 +1,29 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// The source of a PKI mount is served by a cfssl compatible responder, the
+// vault address and token are taken from the api.Config and its
+// environment.
+func ExampleNewVaultSource() {
+	responderCert, responderKey, err := loadResponder("responder.pem", "responder-key.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+	source, err := NewVaultSource("pki", issuerSelection{}, responderCert, &responderKey, api.DefaultConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.stop()
+	http.Handle("/", newResponder(source))
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
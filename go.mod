@@ -3,7 +3,16 @@ module github.com/T-Systems-MMS/vault-ocsp
 go 1.15
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/cloudflare/cfssl v1.6.1
+	github.com/hashicorp/go-rootcerts v1.0.2
 	github.com/hashicorp/vault/api v1.3.0
+	github.com/jmhodges/clock v0.0.0-20160418191101-880ee4c33548
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 )
@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const (
+	// drainTimeout bounds the wait for in-flight requests when draining.
+	drainTimeout      = 30 * time.Second
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// healthState tracks in-flight OCSP requests and whether the server is
+// draining. A draining server still answers requests, but reports itself
+// unhealthy so that load balancers stop sending new ones.
+type healthState struct {
+	lock     sync.Mutex
+	draining bool
+	inFlight int
+	// unready is set until the readiness probe succeeded
+	unready bool
+}
+
+// track counts the requests handled by the wrapped handler as in-flight.
+func (health *healthState) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health.lock.Lock()
+		health.inFlight++
+		health.lock.Unlock()
+		defer func() {
+			health.lock.Lock()
+			health.inFlight--
+			health.lock.Unlock()
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (health *healthState) status() (draining bool, inFlight int) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	return health.draining, health.inFlight
+}
+
+func (health *healthState) ready() bool {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	return !health.unready
+}
+
+func (health *healthState) setReady() {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	health.unready = false
+}
+
+func (health *healthState) startDraining() {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	health.draining = true
+}
+
+// healthHandler answers 200 OK while the server takes requests and
+// 503 Service Unavailable before the readiness probe succeeded and once it
+// is draining.
+func healthHandler(health *healthState) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if draining, _ := health.status(); draining {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		if !health.ready() {
+			http.Error(w, "waiting for vault", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// drainHandler flips /healthz to unhealthy and answers once all in-flight
+// OCSP requests are done, so that the server can be terminated without
+// failing requests. Draining cannot be undone.
+func drainHandler(health *healthState) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		health.startDraining()
+		log.Info("Draining, reporting unhealthy on /healthz")
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		deadline := time.Now().Add(drainTimeout)
+		for {
+			_, inFlight := health.status()
+			if inFlight == 0 {
+				log.Info("Drained, no requests in flight")
+				fmt.Fprintln(w, "drained")
+				return
+			}
+			if time.Now().After(deadline) {
+				http.Error(w, fmt.Sprintf("%d requests still in flight", inFlight), http.StatusServiceUnavailable)
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
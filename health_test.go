@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthStatus returns the status code of /healthz.
+func healthStatus(health *healthState) int {
+	recorder := httptest.NewRecorder()
+	healthHandler(health).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	return recorder.Code
+}
+
+func TestDrain(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t)
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	health := &healthState{}
+	handler := health.track(ocspHandler(config, source))
+	drain := requireAdminToken("secret", drainHandler(health))
+
+	if status := healthStatus(health); status != http.StatusOK {
+		t.Fatalf("got /healthz status %d before draining, want %d", status, http.StatusOK)
+	}
+	recorder := httptest.NewRecorder()
+	drain.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/drain", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d draining without token, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	if status := healthStatus(health); status != http.StatusOK {
+		t.Fatalf("got /healthz status %d after a rejected drain, want %d", status, http.StatusOK)
+	}
+
+	// a slow vault read keeps a request in flight while draining
+	vault.setDelay(300 * time.Millisecond)
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	answered := make(chan int)
+	go func() {
+		answered <- postOCSP(handler, der, nil).Code
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, inFlight := health.status(); inFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the OCSP request never got in flight")
+		}
+	}
+
+	drained := make(chan *httptest.ResponseRecorder)
+	go func() {
+		request := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		drain.ServeHTTP(recorder, request)
+		drained <- recorder
+	}()
+	for deadline := time.Now().Add(2 * time.Second); healthStatus(health) != http.StatusServiceUnavailable; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("/healthz did not become unhealthy while draining")
+		}
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain answered with a request in flight")
+	default:
+	}
+
+	if code := <-answered; code != http.StatusOK {
+		t.Errorf("got status %d for the in-flight request, want %d", code, http.StatusOK)
+	}
+	if recorder := <-drained; recorder.Code != http.StatusOK {
+		t.Errorf("got drain status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if _, inFlight := health.status(); inFlight != 0 {
+		t.Errorf("drained with %d requests in flight", inFlight)
+	}
+	if status := healthStatus(health); status != http.StatusServiceUnavailable {
+		t.Errorf("got /healthz status %d after draining, want %d", status, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,336 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hashicorp/vault/api"
+)
+
+// issuerSelection defines which CA certificates of a PKI mount are
+// answered for.
+type issuerSelection struct {
+	// ref restricts the issuers to the referenced issuer if set
+	ref string
+	// caChain adds the certificates of the mount's CA chain
+	caChain bool
+}
+
+// fetchIssuers returns the issuer certificates of a PKI mount and, if
+// selected, the certificates of its CA chain.
+func fetchIssuers(client *api.Client, pkiMount string, selection issuerSelection) ([]*x509.Certificate, error) {
+	issuers, err := fetchMountIssuers(client, pkiMount, selection.ref)
+	if err != nil || !selection.caChain {
+		return issuers, err
+	}
+	chain, err := fetchCAChain(client, pkiMount)
+	if err != nil {
+		return nil, err
+	}
+	for _, certificate := range chain {
+		if !containsCertificate(issuers, certificate) {
+			issuers = append(issuers, certificate)
+		}
+	}
+	return issuers, nil
+}
+
+// fetchMountIssuers returns the issuer certificates of a PKI mount. If
+// issuerRef is set only the referenced issuer is used, otherwise all issuers
+// of the mount are listed. Vault versions without multi issuer support fall
+// back to the CA certificate of the mount.
+func fetchMountIssuers(client *api.Client, pkiMount string, issuerRef string) ([]*x509.Certificate, error) {
+	if issuerRef != "" {
+		issuer, err := fetchIssuer(client, pkiMount, issuerRef)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{issuer}, nil
+	}
+	issuerList, err := client.Logical().List(fmt.Sprintf("%s/issuers", pkiMount))
+	if err != nil {
+		log.Debugf("Could not list issuers of %s, falling back to CA certificate: %v", pkiMount, err)
+	}
+	var issuerIDs []interface{}
+	if issuerList != nil && issuerList.Data != nil {
+		issuerIDs, _ = issuerList.Data["keys"].([]interface{})
+	}
+	if len(issuerIDs) == 0 {
+		caCertificate, err := fetchCACertificate(client, pkiMount)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{caCertificate}, nil
+	}
+	issuers := make([]*x509.Certificate, 0, len(issuerIDs))
+	for _, issuerID := range issuerIDs {
+		issuer, err := fetchIssuer(client, pkiMount, fmt.Sprint(issuerID))
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, issuer)
+	}
+	return issuers, nil
+}
+
+func fetchCACertificate(client *api.Client, pkiMount string) (*x509.Certificate, error) {
+	vaultRequest := client.NewRequest(http.MethodGet, fmt.Sprintf("/v1/%s/ca", pkiMount))
+	vaultResponse, err := client.RawRequest(vaultRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting CA certificate from vault: %v", err)
+	}
+	defer vaultResponse.Body.Close()
+	caCertificateBytes, err := ioutil.ReadAll(vaultResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate data from vault: %v", err)
+	}
+	caCertificate, err := x509.ParseCertificate(caCertificateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA certificate data from vault: %v", err)
+	}
+	return caCertificate, nil
+}
+
+// fetchCAChain returns the certificates of the ca_chain endpoint of a PKI
+// mount, the CA certificate of the mount and the intermediates and root
+// above it.
+func fetchCAChain(client *api.Client, pkiMount string) ([]*x509.Certificate, error) {
+	vaultRequest := client.NewRequest(http.MethodGet, fmt.Sprintf("/v1/%s/ca_chain", pkiMount))
+	vaultResponse, err := client.RawRequest(vaultRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error getting CA chain from vault: %v", err)
+	}
+	defer vaultResponse.Body.Close()
+	chainPEM, err := ioutil.ReadAll(vaultResponse.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA chain data from vault: %v", err)
+	}
+	chain, err := parsePEMCertificates(chainPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA chain from vault: %v", err)
+	}
+	return chain, nil
+}
+
+// containsCertificate returns whether the certificate is in the list.
+func containsCertificate(certificates []*x509.Certificate, certificate *x509.Certificate) bool {
+	for _, candidate := range certificates {
+		if candidate.Equal(certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+func fetchIssuer(client *api.Client, pkiMount string, issuerRef string) (*x509.Certificate, error) {
+	secret, err := client.Logical().Read(fmt.Sprintf("%s/issuer/%s", pkiMount, issuerRef))
+	if err != nil {
+		return nil, fmt.Errorf("error getting issuer %s from vault: %v", issuerRef, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("issuer %s not found in vault", issuerRef)
+	}
+	certificatePEM, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("no certificate data for issuer %s in vault", issuerRef)
+	}
+	issuer, err := parsePEMCertificate(certificatePEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate of issuer %s: %v", issuerRef, err)
+	}
+	return issuer, nil
+}
+
+// currentIssuers returns the issuers of the source and their key hashes.
+func (source *VaultSource) currentIssuers() ([]*x509.Certificate, issuerKeyHashes) {
+	source.issuerLock.RLock()
+	defer source.issuerLock.RUnlock()
+	return source.issuers, source.issuerKeyHashes
+}
+
+// setIssuers replaces the issuers of the source.
+func (source *VaultSource) setIssuers(issuers []*x509.Certificate) error {
+	keyHashes, err := computeIssuerKeyHashes(issuers)
+	if err != nil {
+		return err
+	}
+	source.issuerLock.Lock()
+	source.issuers = issuers
+	source.issuerKeyHashes = keyHashes
+	source.issuerLock.Unlock()
+	return nil
+}
+
+// validIssuers returns the issuers that are not expired at the given time,
+// expired issuers of the PKI mount are logged and dropped because clients
+// reject responses for their certificates. It fails if no issuer is valid.
+func validIssuers(pkiMount string, issuers []*x509.Certificate, now time.Time) ([]*x509.Certificate, error) {
+	valid := make([]*x509.Certificate, 0, len(issuers))
+	for _, issuer := range issuers {
+		if now.After(issuer.NotAfter) {
+			log.Warningf("Not answering for CA certificate %v of %s, it expired at %s", issuer.Subject.CommonName, pkiMount, issuer.NotAfter)
+			continue
+		}
+		valid = append(valid, issuer)
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("all CA certificates of %s are expired", pkiMount)
+	}
+	return valid, nil
+}
+
+// refreshIssuers fetches the issuers of the PKI mount in the given interval
+// so that rotated CA certificates are picked up. The previous issuers are
+// kept if vault cannot be read.
+func (source *VaultSource) refreshIssuers(interval time.Duration, selection issuerSelection) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			issuers, err := fetchIssuers(source.vaultClient, source.pkiMount, selection)
+			if err != nil {
+				log.Errorf("Keeping previous issuers of %s, refresh failed: %v", source.pkiMount, err)
+				continue
+			}
+			if issuers, err = validIssuers(source.pkiMount, issuers, source.clk.Now()); err != nil {
+				log.Errorf("Keeping previous issuers of %s, refresh failed: %v", source.pkiMount, err)
+				continue
+			}
+			current, _ := source.currentIssuers()
+			if sameCertificates(issuers, current) {
+				continue
+			}
+			if err := source.setIssuers(issuers); err != nil {
+				log.Errorf("Keeping previous issuers of %s, refresh failed: %v", source.pkiMount, err)
+				continue
+			}
+			for _, issuer := range issuers {
+				log.Infof("Found CA certificate %v of %s after refresh", issuer.Subject.CommonName, source.pkiMount)
+			}
+		case <-source.stopped:
+			return
+		}
+	}
+}
+
+// loadIssuerBundle reads the CA certificates of a PEM bundle file.
+func loadIssuerBundle(bundleFile string) ([]*x509.Certificate, error) {
+	bundle, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read issuer bundle: %v", err)
+	}
+	issuers, err := parsePEMCertificates(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse issuer certificate: %v", err)
+	}
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("no certificates in issuer bundle %s", bundleFile)
+	}
+	return issuers, nil
+}
+
+func parsePEMCertificate(certificatePEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return nil, errors.New("could not decode PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// issuerKeyHash computes the hash of the issuer's public key as used in
+// the CertID of OCSP requests.
+func issuerKeyHash(issuer *x509.Certificate, algorithm crypto.Hash) ([]byte, error) {
+	if !algorithm.Available() {
+		return nil, fmt.Errorf("hash algorithm %d not linked into binary", algorithm)
+	}
+	h := algorithm.New()
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		log.Errorf("Error parsing CA certificate public key info: %v", err)
+		return nil, err
+	}
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+// requestHashes are the hash algorithms OCSP requests may use to identify
+// the issuer.
+var requestHashes = []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// issuerKeyHashes holds the public key hashes of issuers per hash
+// algorithm, in the order of the issuers.
+type issuerKeyHashes map[crypto.Hash][][]byte
+
+// computeIssuerKeyHashes computes the key hashes of the issuers for all
+// request hash algorithms. Algorithms not linked into the binary are left
+// out, matchIssuer treats requests using them as malformed.
+func computeIssuerKeyHashes(issuers []*x509.Certificate) (issuerKeyHashes, error) {
+	hashes := issuerKeyHashes{}
+	for _, algorithm := range requestHashes {
+		if !algorithm.Available() {
+			continue
+		}
+		for _, issuer := range issuers {
+			issuerHash, err := issuerKeyHash(issuer, algorithm)
+			if err != nil {
+				return nil, fmt.Errorf("error building CA certificate hash with algorithm %d: %v", algorithm, err)
+			}
+			hashes[algorithm] = append(hashes[algorithm], issuerHash)
+		}
+	}
+	return hashes, nil
+}
+
+// matchIssuer returns the issuer whose public key hash matches the given
+// issuer key hash or nil if none matches.
+func matchIssuer(issuers []*x509.Certificate, hashes issuerKeyHashes, algorithm crypto.Hash, keyHash []byte) (*x509.Certificate, error) {
+	issuerHashes, found := hashes[algorithm]
+	if !found {
+		return nil, fmt.Errorf("unsupported issuer hash algorithm %d", algorithm)
+	}
+	for i, issuerHash := range issuerHashes {
+		if bytes.Equal(keyHash, issuerHash) {
+			return issuers[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// parsePEMCertificates parses all CERTIFICATE blocks of PEM data, other
+// blocks are skipped.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certificates, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+}
@@ -0,0 +1,336 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMultipleIssuers(t *testing.T) {
+	vault := newFakeVault(t)
+	first := newTestPKI(t, "First CA", time.Now().Add(24*time.Hour))
+	second := newTestPKI(t, "Second CA", time.Now().Add(24*time.Hour))
+	vault.setList("pki/issuers", []string{"first", "second"})
+	vault.set("pki/issuer/first", map[string]interface{}{"certificate": pemCertificate(first.ca)})
+	vault.set("pki/issuer/second", map[string]interface{}{"certificate": pemCertificate(second.ca)})
+	source, err := NewVaultSource("pki", issuerSelection{}, first.responder, &first.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuers, _ := source.currentIssuers(); len(issuers) != 2 {
+		t.Fatalf("got %d issuers, want 2", len(issuers))
+	}
+
+	for _, pki := range []*testPKI{first, second} {
+		t.Run(pki.ca.Subject.CommonName, func(t *testing.T) {
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA256))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the responder of the first CA signs for both
+			response, err := ocsp.ParseResponse(der, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != ocsp.Good || response.SerialNumber.Cmp(certificate.SerialNumber) != 0 {
+				t.Errorf("got status %d for serial %v, want good for %v", response.Status, response.SerialNumber, certificate.SerialNumber)
+			}
+		})
+	}
+
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	if _, _, err := source.Response(other.request(t, nextTestSerial(), crypto.SHA256)); !errors.Is(err, errIssuerMismatch) {
+		t.Errorf("got error %v for another CA, want issuer mismatch", err)
+	}
+}
+
+func TestIssuerResponders(t *testing.T) {
+	vault := newFakeVault(t)
+	first := newTestPKI(t, "First CA", time.Now().Add(24*time.Hour))
+	second := newTestPKI(t, "Second CA", time.Now().Add(24*time.Hour))
+	vault.setList("pki/issuers", []string{"first", "second"})
+	vault.set("pki/issuer/first", map[string]interface{}{"certificate": pemCertificate(first.ca)})
+	vault.set("pki/issuer/second", map[string]interface{}{"certificate": pemCertificate(second.ca)})
+	source, err := NewVaultSource("pki", issuerSelection{}, first.responder, &first.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first CA has no responder of its own and falls back to the
+	// global responder
+	global := first.issueResponder(t, time.Now().Add(24*time.Hour), first.responderKey)
+	source.setResponders([]responderPair{
+		{certificate: global, key: &first.responderKey},
+		{certificate: second.responder, key: &second.responderKey, issuerKeyID: second.ca.SubjectKeyId},
+	})
+
+	for _, test := range []struct {
+		pki       *testPKI
+		responder *x509.Certificate
+	}{{first, global}, {second, second.responder}} {
+		t.Run(test.pki.ca.Subject.CommonName, func(t *testing.T) {
+			certificate := test.pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			der, _, err := source.Response(test.pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := test.pki.parse(t, der); !response.Certificate.Equal(test.responder) {
+				t.Errorf("response is signed by responder %v, want %v", response.Certificate.SerialNumber, test.responder.SerialNumber)
+			}
+		})
+	}
+}
+
+func TestCAChain(t *testing.T) {
+	vault := newFakeVault(t)
+	root := newTestPKI(t, "Root CA", time.Now().Add(48*time.Hour))
+	intermediate := root.intermediate(t, "Intermediate CA", time.Now().Add(24*time.Hour))
+	vault.addPKIMount("pki", intermediate)
+	vault.setRaw("pki/ca_chain", []byte(pemCertificate(intermediate.ca)+pemCertificate(root.ca)))
+	responders := []responderPair{
+		{certificate: intermediate.responder, key: &intermediate.responderKey},
+		{certificate: root.responder, key: &root.responderKey, issuerKeyID: root.ca.SubjectKeyId},
+	}
+	source, err := NewVaultSource("pki", issuerSelection{caChain: true}, intermediate.responder, &intermediate.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.setResponders(responders)
+	if issuers, _ := source.currentIssuers(); len(issuers) != 2 {
+		t.Fatalf("got %d issuers, want the intermediate and the root CA", len(issuers))
+	}
+
+	for _, pki := range []*testPKI{intermediate, root} {
+		t.Run(pki.ca.Subject.CommonName, func(t *testing.T) {
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Good {
+				t.Errorf("got status %d, want good", response.Status)
+			}
+		})
+	}
+
+	// without -caChain only the CA of the mount is answered for
+	mountOnly, err := NewVaultSource("pki", issuerSelection{}, intermediate.responder, &intermediate.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountOnly.setResponders(responders)
+	if _, _, err := mountOnly.Response(root.request(t, nextTestSerial(), crypto.SHA1)); !errors.Is(err, errIssuerMismatch) {
+		t.Errorf("got error %v for the root CA without -caChain, want issuer mismatch", err)
+	}
+}
+
+func TestIssuerKeyHashesCached(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	// requests must be matched against the cached hashes, a recomputed
+	// hash of the CA would match the real key hash instead
+	cachedHash := bytes.Repeat([]byte{0x42}, crypto.SHA1.Size())
+	_, keyHashes := source.currentIssuers()
+	keyHashes[crypto.SHA1] = [][]byte{cachedHash}
+
+	for i := 0; i < 10; i++ {
+		request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+		if _, _, err := source.Response(request); !errors.Is(err, errIssuerMismatch) {
+			t.Fatalf("got error %v for the recomputed hash, want issuer mismatch", err)
+		}
+		request.IssuerKeyHash = cachedHash
+		if _, _, err := source.Response(request); err != nil {
+			t.Fatalf("request with the cached hash failed: %v", err)
+		}
+	}
+}
+
+func TestUnavailableHashAlgorithm(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	// MD4 is not linked into the binary, crypto.MD4.New would panic
+	if crypto.MD4.Available() {
+		t.Skip("MD4 is linked into the test binary")
+	}
+	if _, err := issuerKeyHash(pki.ca, crypto.MD4); err == nil {
+		t.Error("hashed the CA key with an unavailable hash algorithm")
+	}
+
+	request := pki.request(t, nextTestSerial(), crypto.SHA1)
+	request.HashAlgorithm = crypto.MD4
+	_, _, err := source.Response(request)
+	if !errors.Is(err, errMalformedRequest) {
+		t.Fatalf("got error %v, want malformed request", err)
+	}
+	if status := responseStatus(err); status != ocsp.Malformed {
+		t.Errorf("got response status %v, want malformed", status)
+	}
+}
+
+func TestIssuerBundle(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	first := newTestPKI(t, "First CA", time.Now().Add(24*time.Hour))
+	second := newTestPKI(t, "Second CA", time.Now().Add(24*time.Hour))
+	// the mount has a CA of its own that the bundle replaces
+	vault.addPKIMount("pki", newTestPKI(t, "Mount CA", time.Now().Add(24*time.Hour)))
+	bundleFile := filepath.Join(t.TempDir(), "issuers.pem")
+	if err := ioutil.WriteFile(bundleFile, []byte(pemCertificate(first.ca)+pemCertificate(second.ca)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	issuers, err := loadIssuerBundle(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responders []responderPair
+	for _, pki := range []*testPKI{first, second} {
+		responders = append(responders, responderPair{certificate: pki.responder, key: &pki.responderKey, issuerKeyID: pki.ca.SubjectKeyId})
+	}
+	mounts := newMountSet(mountSettings{config: newTestConfiguration(t), serialStyle: vaultSerialStyle, issuers: issuers}, responders, nil)
+	if err := mounts.add("pki"); err != nil {
+		t.Fatal(err)
+	}
+	source := mounts.sources()[0]
+	defer source.stop()
+
+	for _, pki := range []*testPKI{first, second} {
+		t.Run(pki.ca.Subject.CommonName, func(t *testing.T) {
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Good {
+				t.Errorf("got status %d, want good", response.Status)
+			}
+		})
+	}
+
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	if _, _, err := source.Response(other.request(t, nextTestSerial(), crypto.SHA1)); responseStatus(err) != ocsp.Unauthorized {
+		t.Errorf("got error %v for a CA outside the bundle, want unauthorized", err)
+	}
+}
+
+// waitForIssuer waits until the issuer is the only issuer of the source.
+func waitForIssuer(t *testing.T, source *VaultSource, issuer *x509.Certificate) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if issuers, _ := source.currentIssuers(); len(issuers) == 1 && issuers[0].Equal(issuer) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("issuer %v was not loaded", issuer.Subject)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRefreshIssuers(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-caRefresh", "20ms")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+
+	rotated := newTestPKI(t, "Rotated CA", time.Now().Add(24*time.Hour))
+	vault.addPKIMount("pki", rotated)
+	waitForIssuer(t, source, rotated.ca)
+	certificate := rotated.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	der, _, err := source.Response(rotated.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatalf("request for the rotated CA failed: %v", err)
+	}
+	// the responder of the previous CA still signs, its certificate is
+	// only verified by clients
+	if response, err := ocsp.ParseResponse(der, nil); err != nil || response.Status != ocsp.Good {
+		t.Errorf("got response %v with error %v, want good", response, err)
+	}
+	if _, _, err := source.Response(pki.request(t, nextTestSerial(), crypto.SHA1)); !errors.Is(err, errIssuerMismatch) {
+		t.Errorf("got error %v for the previous CA, want issuer mismatch", err)
+	}
+
+	// failed refreshes keep the current issuer
+	vault.setFailing(true)
+	time.Sleep(100 * time.Millisecond)
+	if issuers, _ := source.currentIssuers(); len(issuers) != 1 || !issuers[0].Equal(rotated.ca) {
+		t.Errorf("got issuers %v after failed refreshes, want the rotated CA", issuers)
+	}
+}
+
+func TestExpiredIssuers(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	vault.addPKIMount("pki", newTestPKI(t, "Mount CA", time.Now().Add(24*time.Hour)))
+	valid := newTestPKI(t, "Valid CA", time.Now().Add(24*time.Hour))
+	expired := newTestPKI(t, "Expired CA", time.Now().Add(-time.Hour))
+	tests := []struct {
+		name    string
+		bundle  []*testPKI
+		args    []string
+		issuers []*x509.Certificate
+	}{
+		{"expired issuer dropped", []*testPKI{expired, valid}, nil, []*x509.Certificate{valid.ca}},
+		{"all expired", []*testPKI{expired}, nil, nil},
+		{"all expired allowed", []*testPKI{expired}, []string{"-allowExpiredCA"}, []*x509.Certificate{expired.ca}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var issuers []*x509.Certificate
+			var responders []responderPair
+			for _, pki := range test.bundle {
+				issuers = append(issuers, pki.ca)
+				responders = append(responders, responderPair{certificate: pki.responder, key: &pki.responderKey, issuerKeyID: pki.ca.SubjectKeyId})
+			}
+			mounts := newMountSet(mountSettings{config: newTestConfiguration(t, test.args...), serialStyle: vaultSerialStyle, issuers: issuers}, responders, nil)
+			err := mounts.add("pki")
+			if test.issuers == nil {
+				if err == nil {
+					mounts.sources()[0].stop()
+					t.Fatal("serving a mount without valid CA certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := mounts.sources()[0]
+			defer source.stop()
+			if served, _ := source.currentIssuers(); !sameCertificates(served, test.issuers) {
+				t.Errorf("got %d issuers, want %d", len(served), len(test.issuers))
+			}
+		})
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		vault := newFakeVault(t)
+		pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+		source := newTestMounts(t, vault, newTestConfiguration(t, "-caRefresh", "20ms"), pki, "pki").sources()[0]
+
+		vault.addPKIMount("pki", expired)
+		time.Sleep(100 * time.Millisecond)
+		if issuers, _ := source.currentIssuers(); len(issuers) != 1 || !issuers[0].Equal(pki.ca) {
+			t.Errorf("got issuers %v after refreshing an expired CA, want the previous CA", issuers)
+		}
+	})
+}
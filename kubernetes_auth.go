@@ -0,0 +1,123 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	authMethodKubernetes = "kubernetes"
+	defaultK8sJWTPath    = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// loginRetryInterval is the wait between failed logins.
+	loginRetryInterval = 10 * time.Second
+)
+
+// kubernetesLogin logs in to vault with the service account token of the
+// pod using the kubernetes auth method.
+type kubernetesLogin struct {
+	client  *api.Client
+	mount   string
+	role    string
+	jwtPath string
+}
+
+// newKubernetesLogin creates the login with its own vault client, which
+// never carries a token itself.
+func newKubernetesLogin(mount string, role string, jwtPath string) (*kubernetesLogin, error) {
+	client, err := newVaultClient(nil)
+	if err != nil {
+		return nil, err
+	}
+	client.ClearToken()
+	return &kubernetesLogin{client: client, mount: strings.Trim(mount, "/"), role: role, jwtPath: jwtPath}, nil
+}
+
+// login returns the auth secret of a new login. The service account token
+// is read for each login, kubernetes rotates projected tokens.
+func (login *kubernetesLogin) login() (*api.Secret, error) {
+	data, err := ioutil.ReadFile(login.jwtPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %v", err)
+	}
+	jwt := strings.TrimSpace(string(data))
+	if jwt == "" {
+		return nil, errors.New("service account token is empty")
+	}
+	secret, err := login.client.Logical().Write(fmt.Sprintf("auth/%s/login", login.mount), map[string]interface{}{
+		"role": login.role,
+		"jwt":  jwt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes login as role %s failed: %v", login.role, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("kubernetes login as role %s returned no token", login.role)
+	}
+	log.Infof("Logged in to vault as kubernetes role %s, token valid for %s",
+		login.role, time.Duration(secret.Auth.LeaseDuration)*time.Second)
+	return secret, nil
+}
+
+// keepLoggedIn renews the token of the login secret until it cannot be
+// renewed any longer and then logs in again, setting the new token on the
+// clients. Failed logins are retried, the clients keep the previous token
+// meanwhile.
+func (login *kubernetesLogin) keepLoggedIn(tokens *tokenClients, secret *api.Secret) {
+	for {
+		if !login.waitForExpiry(secret) {
+			return
+		}
+		for {
+			var err error
+			if secret, err = login.login(); err == nil {
+				break
+			}
+			log.Errorf("Keeping current vault token: %v", err)
+			time.Sleep(loginRetryInterval)
+		}
+		tokens.set(secret.Auth.ClientToken)
+	}
+}
+
+// waitForExpiry renews a renewable token for as long as vault allows and
+// waits two thirds of the lifetime of other tokens. It returns false for
+// tokens that do not expire.
+func (login *kubernetesLogin) waitForExpiry(secret *api.Secret) bool {
+	if secret.Auth.LeaseDuration <= 0 {
+		return false
+	}
+	if !secret.Auth.Renewable {
+		time.Sleep(time.Duration(secret.Auth.LeaseDuration) * time.Second * 2 / 3)
+		return true
+	}
+	watcher, err := login.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		log.Errorf("Could not renew vault token, logging in again: %v", err)
+		return true
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+	for {
+		select {
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Warningf("Vault token renewal failed, logging in again: %v", err)
+			} else {
+				log.Info("Vault token reached its maximum lifetime, logging in again")
+			}
+			return true
+		case renewal := <-watcher.RenewCh():
+			log.Debugf("Renewed vault token, valid for %s", time.Duration(renewal.Secret.Auth.LeaseDuration)*time.Second)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// writeJWTFile writes a service account token to a temporary file.
+func writeJWTFile(t *testing.T, jwt string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte(jwt+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loginSecret returns the body of a vault login with the token.
+func loginSecret(token string, leaseDuration int, renewable bool) map[string]interface{} {
+	return map[string]interface{}{"auth": map[string]interface{}{
+		"client_token":   token,
+		"lease_duration": leaseDuration,
+		"renewable":      renewable,
+	}}
+}
+
+func TestAuthMount(t *testing.T) {
+	tests := []struct {
+		args  []string
+		mount string
+	}{
+		{[]string{"-authMethod", authMethodKubernetes}, "kubernetes"},
+		{[]string{"-authMethod", authMethodKubernetes, "-authMount", "k8s-prod"}, "k8s-prod"},
+		{[]string{"-authMethod", authMethodKubernetes, "-authMount", "/clusters/prod/"}, "clusters/prod"},
+		{[]string{"-authMethod", authMethodKubernetes, "-authMount", "/"}, ""},
+	}
+	for _, test := range tests {
+		if mount := newTestConfiguration(t, test.args...).authMount(); mount != test.mount {
+			t.Errorf("got auth mount %q for %v, want %q", mount, test.args, test.mount)
+		}
+	}
+}
+
+func TestKubernetesLoginMount(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	vault.setWrite("auth/k8s-prod/login", func(body map[string]interface{}) (int, interface{}) {
+		if body["role"] != "ocsp" || body["jwt"] != "service-account-jwt" {
+			return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role or jwt"}}
+		}
+		return http.StatusOK, loginSecret("login-token", 0, false)
+	})
+
+	config := newTestConfiguration(t, "-authMethod", authMethodKubernetes, "-authMount", "/k8s-prod/", "-k8sRole", "ocsp")
+	login, err := newKubernetesLogin(config.authMount(), config.K8sRole, writeJWTFile(t, "service-account-jwt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := login.login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Auth.ClientToken != "login-token" {
+		t.Errorf("got token %s, want login-token", secret.Auth.ClientToken)
+	}
+	if reads := vault.readCount("auth/k8s-prod/login"); reads != 1 {
+		t.Errorf("logged in %d times at the custom mount, want 1", reads)
+	}
+	if reads := vault.readCount("auth/kubernetes/login"); reads != 0 {
+		t.Errorf("logged in %d times at the default mount, want 0", reads)
+	}
+}
+
+func TestKubernetesLogin(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	var logins int32
+	vault.setWrite("auth/kubernetes/login", func(body map[string]interface{}) (int, interface{}) {
+		if body["role"] != "ocsp" {
+			return http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role"}}
+		}
+		if atomic.AddInt32(&logins, 1) == 1 {
+			// the first token expires soon and cannot be renewed
+			return http.StatusOK, loginSecret("first-token", 1, false)
+		}
+		return http.StatusOK, loginSecret("second-token", 0, false)
+	})
+	jwtPath := writeJWTFile(t, "service-account-jwt")
+
+	login, err := newKubernetesLogin(authMethodKubernetes, "ocsp", jwtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := login.login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := newTokenClients(secret.Auth.ClientToken)
+	client := vault.client(t)
+	tokens.register(client)
+	if client.Token() != "first-token" {
+		t.Fatalf("got client token %s, want first-token", client.Token())
+	}
+	// returns once the second token, which does not expire, is set
+	login.keepLoggedIn(tokens, secret)
+	if client.Token() != "second-token" {
+		t.Errorf("got client token %s after the token expired, want second-token", client.Token())
+	}
+
+	t.Run("rejected role", func(t *testing.T) {
+		login, err := newKubernetesLogin(authMethodKubernetes, "other", jwtPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := login.login(); err == nil {
+			t.Error("login with a rejected role succeeded")
+		}
+	})
+	t.Run("empty service account token", func(t *testing.T) {
+		login, err := newKubernetesLogin(authMethodKubernetes, "ocsp", writeJWTFile(t, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := login.login(); err == nil {
+			t.Error("login with an empty service account token succeeded")
+		}
+	})
+	t.Run("no token", func(t *testing.T) {
+		vault.setWrite("auth/kubernetes/login", func(body map[string]interface{}) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{}
+		})
+		if _, err := login.login(); err == nil {
+			t.Error("login without a token in the response succeeded")
+		}
+	})
+}
@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+const unixSocketPrefix = "unix:"
+
+// listen creates a listener for the server address. Addresses prefixed with
+// unix: are Unix domain socket paths, all other addresses are TCP addresses.
+func listen(serverAddr string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(serverAddr, unixSocketPrefix) {
+		return net.Listen("tcp", serverAddr)
+	}
+	socketPath := strings.TrimPrefix(serverAddr, unixSocketPrefix)
+	// remove a stale socket left behind by a previous instance
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %s: %v", socketPath, err)
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, socketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not set permissions of socket %s: %v", socketPath, err)
+	}
+	return listener, nil
+}
+
+// newServer returns the HTTP server for the handler with the timeouts of
+// the configuration.
+func newServer(config *configuration, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+	}
+}
+
+// serve serves HTTP requests on all listeners until the server is shut
+// down. If serving on one of the listeners fails the server is closed.
+func serve(server *http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			if err == http.ErrServerClosed {
+				err = nil
+			} else if err != nil {
+				err = fmt.Errorf("serving on %s: %v", listener.Addr(), err)
+			}
+			errs <- err
+		}(listener)
+	}
+	var serveErr error
+	for range listeners {
+		if err := <-errs; err != nil && serveErr == nil {
+			serveErr = err
+			server.Close()
+		}
+	}
+	return serveErr
+}
+
+// shutdownOnSignal gracefully shuts the server down on SIGINT or SIGTERM
+// and closes done once in-flight requests are answered. Closing the
+// listeners removes Unix domain socket files.
+func shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	defer close(done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	log.Infof("Received %v, shutting down", received)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown failed: %v", err)
+	}
+}
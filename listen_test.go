@@ -0,0 +1,216 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestServeUnixSocket(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	socketPath := filepath.Join(t.TempDir(), "ocsp.sock")
+	listener, err := listen(unixSocketPrefix+socketPath, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("got socket %v with error %v, want mode 0660", info, err)
+	}
+	server := &http.Server{Handler: ocspHandler(newTestConfiguration(t), source)}
+	served := make(chan error, 1)
+	go func() { served <- serve(server, []net.Listener{listener}) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	requestDER, err := pki.request(t, certificate.SerialNumber, crypto.SHA1).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Post("http://ocsp/", ocspRequestContentType, bytes.NewReader(requestDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := pki.parse(t, der).Status; status != ocsp.Good {
+		t.Errorf("got status %d, want good", status)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket %s remained after shutdown: %v", socketPath, err)
+	}
+}
+
+func TestShutdownOnSignalWaitsForRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+	served := make(chan error, 1)
+	go func() { served <- serve(server, []net.Listener{listener}) }()
+	requested := make(chan error, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err == nil {
+			response.Body.Close()
+		}
+		requested <- err
+	}()
+	<-started
+
+	// SIGTERM must not end the test before the shutdown listens for it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+waitForServe:
+	for {
+		if err := process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-served:
+			if err != nil {
+				t.Fatal(err)
+			}
+			break waitForServe
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("server was not shut down")
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown finished while a request was in flight")
+	default:
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish after the request was answered")
+	}
+	if err := <-requested; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	first, err := listen("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := listen("[::1]:0", 0)
+	if err != nil {
+		t.Logf("no IPv6 loopback, listening on a second IPv4 port: %v", err)
+		if second, err = listen("127.0.0.1:0", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listeners := []net.Listener{first, second}
+	server := &http.Server{Handler: ocspHandler(newTestConfiguration(t), source)}
+	served := make(chan error, 1)
+	go func() { served <- serve(server, listeners) }()
+
+	requestDER := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	for _, listener := range listeners {
+		response, err := http.Post("http://"+listener.Addr().String()+"/", ocspRequestContentType, bytes.NewReader(requestDER))
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := pki.parse(t, der).Status; status != ocsp.Good {
+			t.Errorf("got status %d from %s, want good", status, listener.Addr())
+		}
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	for _, listener := range listeners {
+		if connection, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			connection.Close()
+			t.Errorf("%s still accepts connections after shutdown", listener.Addr())
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name                                               string
+		args                                               []string
+		readTimeout, readHeaderTimeout, writeTimeout, idle time.Duration
+	}{
+		{"defaults", nil, 5 * time.Second, 2 * time.Second, 10 * time.Second, time.Minute},
+		{"flags", []string{"-readTimeout", "1s", "-readHeaderTimeout", "500ms", "-writeTimeout", "3s", "-idleTimeout", "0"},
+			time.Second, 500 * time.Millisecond, 3 * time.Second, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newServer(newTestConfiguration(t, test.args...), http.NotFoundHandler())
+			if server.ReadTimeout != test.readTimeout || server.ReadHeaderTimeout != test.readHeaderTimeout ||
+				server.WriteTimeout != test.writeTimeout || server.IdleTimeout != test.idle {
+				t.Errorf("got timeouts read %s, header %s, write %s, idle %s, want %s, %s, %s, %s",
+					server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout,
+					test.readTimeout, test.readHeaderTimeout, test.writeTimeout, test.idle)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Metrics are published via expvar and served on /admin/metrics.
+var (
+	responsesTotal     = expvar.NewInt("responses_total")
+	responseBytesTotal = expvar.NewInt("response_bytes_total")
+	responseBytesMax   = expvar.NewInt("response_bytes_max")
+	responsesOversized = expvar.NewInt("responses_oversized_total")
+	vaultReadsRejected = expvar.NewInt("vault_reads_rejected_total")
+	lookupErrors       = expvar.NewMap("lookup_errors_total")
+
+	responseBytesMaxLock sync.Mutex
+)
+
+// recordResponseSize updates the response size metrics.
+func recordResponseSize(size int) {
+	responsesTotal.Add(1)
+	responseBytesTotal.Add(int64(size))
+	responseBytesMaxLock.Lock()
+	defer responseBytesMaxLock.Unlock()
+	if int64(size) > responseBytesMax.Value() {
+		responseBytesMax.Set(int64(size))
+	}
+}
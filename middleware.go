@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspRequestContentType is the media type of OCSP POST requests defined by
+// RFC 6960.
+const ocspRequestContentType = "application/ocsp-request"
+
+// limitRequests rejects OCSP requests with methods other than GET and POST
+// and POST requests with bodies larger than maxRequestBytes before they are
+// passed to the wrapped OCSP responder. With strictContentType POST
+// requests must have the OCSP request content type.
+func limitRequests(maxRequestBytes int64, strictContentType bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if strictContentType {
+				mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				if err != nil || mediaType != ocspRequestContentType {
+					log.Infof("Rejected OCSP request from %s with content type %q", r.RemoteAddr, r.Header.Get("Content-Type"))
+					http.Error(w, "content type must be "+ocspRequestContentType, http.StatusUnsupportedMediaType)
+					return
+				}
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+			if err != nil {
+				if int64(len(body)) >= maxRequestBytes {
+					log.Infof("Rejected OCSP request from %s exceeding %d bytes", r.RemoteAddr, maxRequestBytes)
+					http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "could not read request", http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// stripBasePath strips the base path from request paths before passing the
+// requests to the wrapped handler. Requests for paths outside of the base
+// path are answered with 404.
+func stripBasePath(basePath string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path != basePath && !strings.HasPrefix(path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped := new(http.Request)
+		*stripped = *r
+		stripped.URL = new(url.URL)
+		*stripped.URL = *r.URL
+		stripped.URL.Path = strings.TrimPrefix(path, basePath)
+		if stripped.URL.Path == "" {
+			stripped.URL.Path = "/"
+		}
+		stripped.URL.RawPath = ""
+		handler.ServeHTTP(w, stripped)
+	})
+}
+
+// recordingResponseWriter keeps the status code and body written to the
+// wrapped ResponseWriter.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// ocspOutcome returns the serial number and status of a written OCSP
+// response, comma separated for responses with several single responses.
+func ocspOutcome(body []byte) (serial string, status string) {
+	if len(body) == 0 {
+		return "-", "-"
+	}
+	responses, err := parseResponses(body)
+	if err != nil {
+		if responseError, ok := err.(ocsp.ResponseError); ok {
+			return "-", responseError.Status.String()
+		}
+		return "-", "-"
+	}
+	serials := make([]string, len(responses))
+	statuses := make([]string, len(responses))
+	for i, response := range responses {
+		serials[i] = toVaultSerial(response.SerialNumber)
+		statuses[i] = statusName(response.Status)
+	}
+	return strings.Join(serials, ","), strings.Join(statuses, ",")
+}
+
+// accessLog logs method, path, mount, serial, OCSP status, HTTP status and
+// duration of each request handled by the wrapped handler, including the
+// requests it rejects. mountOf returns the PKI mount of a request.
+func accessLog(mountOf func(*http.Request) string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		serial, status := ocspOutcome(recorder.body.Bytes())
+		log.Infof("access method=%s path=%q mount=%s serial=%s ocsp_status=%s http_status=%d duration=%s",
+			r.Method, r.URL.Path, mountOf(r), serial, status, recorder.status, time.Since(start))
+	})
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// echoHandler answers with the request body.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	_, _ = w.Write(body)
+})
+
+func TestLimitRequests(t *testing.T) {
+	handler := limitRequests(16, false, echoHandler)
+	tests := []struct {
+		name   string
+		method string
+		body   []byte
+		status int
+	}{
+		{"GET", http.MethodGet, nil, http.StatusOK},
+		{"small POST", http.MethodPost, bytes.Repeat([]byte{1}, 16), http.StatusOK},
+		{"oversized POST", http.MethodPost, bytes.Repeat([]byte{1}, 17), http.StatusRequestEntityTooLarge},
+		{"PUT", http.MethodPut, nil, http.StatusMethodNotAllowed},
+		{"DELETE", http.MethodDelete, nil, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(test.method, "/", bytes.NewReader(test.body)))
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == http.StatusOK && !bytes.Equal(recorder.Body.Bytes(), test.body) {
+				t.Errorf("handler got body %x, want %x", recorder.Body.Bytes(), test.body)
+			}
+			if test.status == http.StatusMethodNotAllowed && recorder.Header().Get("Allow") != "GET, POST" {
+				t.Errorf("got Allow %q, want GET, POST", recorder.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	handler := stripBasePath("/ocsp", mounts)
+	encoded := base64.StdEncoding.EncodeToString(marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1)))
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"with prefix", "/ocsp/pki/" + encoded, http.StatusOK},
+		{"without prefix", "/pki/" + encoded, http.StatusNotFound},
+		{"prefix of another path", "/ocspx/pki/" + encoded, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == http.StatusOK {
+				if status := pki.parse(t, recorder.Body.Bytes()).Status; status != ocsp.Good {
+					t.Errorf("got status %d, want good", status)
+				}
+			}
+		})
+	}
+
+	var path string
+	handler = stripBasePath("/ocsp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { path = r.URL.Path }))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ocsp", nil))
+	if path != "/" {
+		t.Errorf("base path was passed on as %q, want /", path)
+	}
+}
+
+func TestPOSTContentType(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	vault.addCertificate("pki", certificate, time.Time{})
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	strict := ocspHandler(newTestConfiguration(t), mounts.sources()[0])
+	lenient := ocspHandler(newTestConfiguration(t, "-strictContentType=false"), mounts.sources()[0])
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		contentType string
+		status      int
+	}{
+		{"OCSP request", strict, "application/ocsp-request", http.StatusOK},
+		{"with parameter", strict, "application/ocsp-request; charset=binary", http.StatusOK},
+		{"form", strict, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"missing", strict, "", http.StatusUnsupportedMediaType},
+		{"lenient form", lenient, "application/x-www-form-urlencoded", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := postOCSP(test.handler, der, http.Header{"Content-Type": {test.contentType}})
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == http.StatusOK {
+				pki.parse(t, recorder.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki", "team/pki")
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("team/pki", certificate, time.Time{})
+	logged := captureLog(t)
+	// one request per client while the test runs
+	handler := accessLog(mounts.mountOf, limitClientRate(newClientRateLimit(0.001, 1, nil), mounts))
+	send := func(method string, path string, remoteAddr string, body []byte) {
+		request := httptest.NewRequest(method, path, bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/ocsp-request")
+		request.RemoteAddr = remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	send(http.MethodPost, "/team/pki/", "192.0.2.1:1234", der)
+	send(http.MethodPut, "/pki/", "192.0.2.2:1234", nil)
+	send(http.MethodPost, "/team/pki/", "192.0.2.1:1234", der)
+	send(http.MethodPost, "/other/", "192.0.2.3:1234", der)
+	for _, entry := range []string{
+		`method=POST path="/team/pki/" mount=team/pki serial=` + toVaultSerial(certificate.SerialNumber) + ` ocsp_status=good http_status=200`,
+		`method=PUT path="/pki/" mount=pki serial=- ocsp_status=- http_status=405`,
+		`method=POST path="/team/pki/" mount=team/pki serial=- ocsp_status=- http_status=429`,
+		`method=POST path="/other/" mount=- serial=- ocsp_status=- http_status=404`,
+	} {
+		if !logged.contains(entry) {
+			t.Errorf("access log has no entry %s", entry)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hashicorp/vault/api"
+)
+
+// mountSettings are the settings shared by the sources of all PKI mounts.
+type mountSettings struct {
+	config      *configuration
+	serialStyle serialStyle
+	producedAt  time.Time
+	audit       *auditLog
+	// issuers replace the issuers of the PKI mounts if set
+	issuers []*x509.Certificate
+	// redis is the client of the shared response cache, nil for in-memory
+	// caches
+	redis *redisClient
+}
+
+// newMountSource creates the source for a PKI mount and prepares it for
+// serving requests.
+func newMountSource(settings mountSettings, pkiMount string, responders []responderPair, allowlist serialAllowlist) (*VaultSource, error) {
+	config := settings.config
+	var vaultSource *VaultSource
+	var err error
+	if settings.issuers != nil {
+		client, err := newVaultClient(nil)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing vault client: %v", err)
+		}
+		vaultSource, err = newVaultSource(client, pkiMount, settings.issuers, responders[0].certificate, responders[0].key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		vaultSource, err = NewVaultSource(pkiMount, config.issuerSelection(), responders[0].certificate, responders[0].key, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	issuers, _ := vaultSource.currentIssuers()
+	if valid, err := validIssuers(pkiMount, issuers, vaultSource.clk.Now()); err == nil {
+		if len(valid) < len(issuers) {
+			if err := vaultSource.setIssuers(valid); err != nil {
+				return nil, err
+			}
+		}
+	} else if !config.AllowExpiredCA {
+		return nil, err
+	} else {
+		log.Errorf("Issuer problem of %s, responses for its certificates are rejected by clients: %v", pkiMount, err)
+	}
+	vaultSource.setResponders(responders)
+	// -check reads the status from vault instead of a cached response
+	if config.NoCache || config.Check != "" {
+		vaultSource.cache = disabledCache{}
+	} else if settings.redis != nil {
+		vaultSource.cache = newRedisCache(settings.redis, pkiMount)
+	}
+	vaultSource.setAllowlist(allowlist)
+	vaultSource.audit = settings.audit
+	if config.KVCertPath != "" {
+		if vaultSource.certs, err = newKVCertStore(vaultSource.vaultClient, config.KVCertPath, pkiMount); err != nil {
+			return nil, err
+		}
+	} else if config.CertPathTemplate != defaultCertPathTemplate {
+		if vaultSource.certs, err = newPKICertStore(vaultSource.vaultClient, config.CertPathTemplate, pkiMount); err != nil {
+			return nil, err
+		}
+	}
+	vaultSource.responderSelection = config.ResponderSelection
+	vaultSource.responseSizeWarning = config.ResponseSizeWarning
+	vaultSource.serialStyle = settings.serialStyle
+	vaultSource.thisUpdateSkew = time.Duration(config.ThisUpdateSkew)
+	vaultSource.producedAt = settings.producedAt
+	vaultSource.archiveCutoff = time.Duration(config.ArchiveCutoff)
+	vaultSource.signatureAlgorithm, _ = parseSignatureAlgorithm(config.SignatureAlgorithm)
+	vaultSource.vaultTimeout = time.Duration(config.VaultTimeout)
+	vaultSource.verifyChain = config.VerifyChain
+	vaultSource.expiredCertBehavior = config.ExpiredCertBehavior
+	vaultSource.omitResponderCert = config.OmitResponderCert
+	vaultSource.vaultReads = newVaultReadLimit(config.MaxConcurrentVaultReads, time.Duration(config.VaultReadQueueTimeout))
+	vaultSource.vaultBreaker = newVaultBreaker(pkiMount, config.CircuitBreakerThreshold, time.Duration(config.CircuitBreakerCooldown), vaultSource.clk)
+	vaultSource.setLifetimes(config.lifetimes())
+	if config.SelfTest {
+		if err := vaultSource.selfTest(); err != nil {
+			return nil, fmt.Errorf("self-test failed: %v", err)
+		}
+		log.Infof("Self-test for %s passed", pkiMount)
+	}
+	if config.CARefresh > 0 && settings.issuers == nil {
+		go vaultSource.refreshIssuers(time.Duration(config.CARefresh), config.issuerSelection())
+	}
+	if config.CRLRefresh > 0 {
+		vaultSource.unifiedCRL = config.UnifiedCRL
+		if err := vaultSource.updateCRL(); err != nil {
+			log.Errorf("Could not load CRL of %s, using per serial lookups until the next refresh: %v", pkiMount, err)
+		}
+		go vaultSource.refreshCRL(time.Duration(config.CRLRefresh))
+	}
+	if config.WarmCache && config.Check == "" {
+		warmed, err := vaultSource.warmCache()
+		if err != nil {
+			log.Errorf("Cache warmup of %s failed: %v", pkiMount, err)
+		}
+		log.Infof("Cached the responses of %d revoked certificates of %s", warmed, pkiMount)
+	}
+	return vaultSource, nil
+}
+
+// mountHandlers are the HTTP handlers of a served PKI mount.
+type mountHandlers struct {
+	source *VaultSource
+	ocsp   http.Handler
+	ca     http.Handler
+}
+
+// mountSet is the set of served PKI mounts. Mounts may be added while
+// serving by mount discovery, new mounts get the current responders and
+// serial allowlist.
+type mountSet struct {
+	settings mountSettings
+
+	lock       sync.RWMutex
+	mounts     map[string]mountHandlers
+	order      []string
+	responders []responderPair
+	allowlist  serialAllowlist
+	// discovered marks the mounts added by discovery, which are removed
+	// again when they disappear from vault
+	discovered map[string]bool
+}
+
+func newMountSet(settings mountSettings, responders []responderPair, allowlist serialAllowlist) *mountSet {
+	return &mountSet{
+		settings:   settings,
+		mounts:     make(map[string]mountHandlers),
+		discovered: make(map[string]bool),
+		responders: responders,
+		allowlist:  allowlist,
+	}
+}
+
+// add creates the source of a PKI mount and starts serving it.
+func (mounts *mountSet) add(pkiMount string) error {
+	mounts.lock.RLock()
+	responders, allowlist := mounts.responders, mounts.allowlist
+	mounts.lock.RUnlock()
+	source, err := newMountSource(mounts.settings, pkiMount, respondersOfMount(responders, pkiMount), allowlist)
+	if err != nil {
+		return err
+	}
+	handlers := mountHandlers{source: source, ocsp: ocspHandler(mounts.settings.config, source)}
+	if mounts.settings.config.CAPath != "" {
+		handlers.ca = caHandler(source)
+	}
+	mounts.lock.Lock()
+	defer mounts.lock.Unlock()
+	if previous, found := mounts.mounts[pkiMount]; found {
+		previous.source.stop()
+	} else {
+		mounts.order = append(mounts.order, pkiMount)
+	}
+	mounts.mounts[pkiMount] = handlers
+	return nil
+}
+
+// remove stops serving a PKI mount.
+func (mounts *mountSet) remove(pkiMount string) {
+	mounts.lock.Lock()
+	defer mounts.lock.Unlock()
+	handlers, found := mounts.mounts[pkiMount]
+	if !found {
+		return
+	}
+	handlers.source.stop()
+	delete(mounts.mounts, pkiMount)
+	for i, served := range mounts.order {
+		if served == pkiMount {
+			mounts.order = append(mounts.order[:i:i], mounts.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// discoveredMounts returns the served mounts that were added by discovery.
+func (mounts *mountSet) discoveredMounts() []string {
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	var discovered []string
+	for _, pkiMount := range mounts.order {
+		if mounts.discovered[pkiMount] {
+			discovered = append(discovered, pkiMount)
+		}
+	}
+	return discovered
+}
+
+// served returns whether the PKI mount is served.
+func (mounts *mountSet) served(pkiMount string) bool {
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	_, found := mounts.mounts[pkiMount]
+	return found
+}
+
+// sources returns the sources of all served mounts in the order they were
+// added.
+func (mounts *mountSet) sources() []*VaultSource {
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	sources := make([]*VaultSource, len(mounts.order))
+	for i, pkiMount := range mounts.order {
+		sources[i] = mounts.mounts[pkiMount].source
+	}
+	return sources
+}
+
+func (mounts *mountSet) setResponders(responders []responderPair) {
+	mounts.lock.Lock()
+	mounts.responders = responders
+	mounts.lock.Unlock()
+	for _, source := range mounts.sources() {
+		source.setResponders(respondersOfMount(responders, source.pkiMount))
+	}
+}
+
+// respondersOfMount returns the responders that sign for the PKI mount.
+// Responders mapped to the mount replace the responders of all mounts,
+// responders of individual issuers are kept.
+func respondersOfMount(responders []responderPair, pkiMount string) []responderPair {
+	var own, shared []responderPair
+	for _, responder := range responders {
+		switch responder.pkiMount {
+		case pkiMount:
+			own = append(own, responder)
+		case "":
+			shared = append(shared, responder)
+		}
+	}
+	if len(own) == 0 {
+		return shared
+	}
+	for _, responder := range shared {
+		if responder.issuerKeyID != nil {
+			own = append(own, responder)
+		}
+	}
+	return own
+}
+
+func (mounts *mountSet) responderCertificates() []*x509.Certificate {
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	certificates := make([]*x509.Certificate, len(mounts.responders))
+	for i, responder := range mounts.responders {
+		certificates[i] = responder.certificate
+	}
+	return certificates
+}
+
+// setLifetimes applies reloaded response lifetimes to all served mounts,
+// mounts added later read them from the configuration.
+func (mounts *mountSet) setLifetimes(lifetimes responseLifetimes) {
+	for _, source := range mounts.sources() {
+		source.setLifetimes(lifetimes)
+	}
+}
+
+func (mounts *mountSet) setAllowlist(allowlist serialAllowlist) {
+	mounts.lock.Lock()
+	mounts.allowlist = allowlist
+	mounts.lock.Unlock()
+	for _, source := range mounts.sources() {
+		source.setAllowlist(allowlist)
+	}
+}
+
+// ServeHTTP routes requests below /<mount>/ to the OCSP handler of the
+// mount and /<mount><caPath> to its CA certificate handler. Mounts may
+// contain slashes, the longest matching mount wins.
+func (mounts *mountSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pkiMount, handlers := mounts.match(r.URL.Path)
+	if pkiMount == "" {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := "/" + pkiMount
+	if handlers.ca != nil && r.URL.Path == prefix+mounts.settings.config.CAPath {
+		handlers.ca.ServeHTTP(w, r)
+		return
+	}
+	http.StripPrefix(prefix, handlers.ocsp).ServeHTTP(w, r)
+}
+
+// match returns the served mount with the longest path prefix of the
+// request path and its handlers, an empty mount if none matches.
+func (mounts *mountSet) match(path string) (pkiMount string, handlers mountHandlers) {
+	mounts.lock.RLock()
+	defer mounts.lock.RUnlock()
+	for candidate, candidateHandlers := range mounts.mounts {
+		if len(candidate) > len(pkiMount) && strings.HasPrefix(path, "/"+candidate+"/") {
+			pkiMount, handlers = candidate, candidateHandlers
+		}
+	}
+	return pkiMount, handlers
+}
+
+// mountOf returns the served mount the request is for, - if it is for none.
+func (mounts *mountSet) mountOf(r *http.Request) string {
+	if pkiMount, _ := mounts.match(r.URL.Path); pkiMount != "" {
+		return pkiMount
+	}
+	return "-"
+}
+
+// errMountsForbidden is returned by discoverPKIMounts if the vault token may
+// not list the secrets engine mounts.
+var errMountsForbidden = errors.New("listing mounts via sys/mounts is forbidden")
+
+// discoverPKIMounts returns the paths of all PKI secrets engine mounts
+// without trailing slash, sorted by path.
+func discoverPKIMounts(client *api.Client) ([]string, error) {
+	secret, err := client.Logical().Read("sys/mounts")
+	if err != nil {
+		if responseErr, ok := err.(*api.ResponseError); ok && responseErr.StatusCode == http.StatusForbidden {
+			return nil, errMountsForbidden
+		}
+		return nil, fmt.Errorf("could not read sys/mounts: %v", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("no mount data in sys/mounts response")
+	}
+	var pkiMounts []string
+	for path, mount := range secret.Data {
+		mountInfo, ok := mount.(map[string]interface{})
+		if !ok || mountInfo["type"] != "pki" {
+			continue
+		}
+		pkiMounts = append(pkiMounts, strings.TrimSuffix(path, "/"))
+	}
+	sort.Strings(pkiMounts)
+	return pkiMounts, nil
+}
+
+// discoverMounts adds all PKI mounts that are not served yet. Mounts that
+// cannot be initialized are retried on the next discovery. Discovered
+// mounts that no longer exist are removed, discovered mounts whose issuers
+// changed are rebuilt.
+func (mounts *mountSet) discoverMounts(client *api.Client) error {
+	pkiMounts, err := discoverPKIMounts(client)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(pkiMounts))
+	for _, pkiMount := range pkiMounts {
+		present[pkiMount] = true
+	}
+	for _, pkiMount := range mounts.discoveredMounts() {
+		if !present[pkiMount] {
+			mounts.remove(pkiMount)
+			log.Infof("Stopped serving PKI mount %s, it no longer exists", pkiMount)
+			continue
+		}
+		changed, err := mounts.issuersChanged(client, pkiMount)
+		if err != nil {
+			log.Errorf("Could not check the issuers of PKI mount %s: %v", pkiMount, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := mounts.add(pkiMount); err != nil {
+			log.Errorf("Could not rebuild PKI mount %s with its new issuers, serving the previous issuers: %v", pkiMount, err)
+			continue
+		}
+		log.Infof("Rebuilt PKI mount %s, its issuers changed", pkiMount)
+	}
+	for _, pkiMount := range pkiMounts {
+		if mounts.served(pkiMount) {
+			continue
+		}
+		if err := mounts.add(pkiMount); err != nil {
+			log.Errorf("Could not serve discovered PKI mount %s: %v", pkiMount, err)
+			continue
+		}
+		mounts.lock.Lock()
+		mounts.discovered[pkiMount] = true
+		mounts.lock.Unlock()
+		log.Infof("Serving discovered PKI mount %s below /%s/", pkiMount, pkiMount)
+	}
+	return nil
+}
+
+// issuersChanged returns whether the issuers of a served PKI mount differ
+// from the issuers in vault. Issuers from an issuer bundle never change.
+func (mounts *mountSet) issuersChanged(client *api.Client, pkiMount string) (bool, error) {
+	if mounts.settings.issuers != nil {
+		return false, nil
+	}
+	mounts.lock.RLock()
+	handlers, found := mounts.mounts[pkiMount]
+	mounts.lock.RUnlock()
+	if !found {
+		return false, nil
+	}
+	issuers, err := fetchIssuers(client, pkiMount, mounts.settings.config.issuerSelection())
+	if err != nil {
+		return false, err
+	}
+	// the served issuers lack the expired ones unless all of them expired
+	if valid, err := validIssuers(pkiMount, issuers, handlers.source.clk.Now()); err == nil {
+		issuers = valid
+	}
+	current, _ := handlers.source.currentIssuers()
+	return !sameCertificates(issuers, current), nil
+}
+
+// sameCertificates returns whether both lists contain the same certificates
+// in the same order.
+func sameCertificates(a []*x509.Certificate, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshMounts discovers new PKI mounts in the given interval.
+func (mounts *mountSet) refreshMounts(client *api.Client, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := mounts.discoverMounts(client); err != nil {
+			log.Errorf("Mount discovery failed, serving the known mounts: %v", err)
+		}
+	}
+}
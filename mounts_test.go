@@ -0,0 +1,239 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestAddMount(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki)
+	vault.addPKIMount("pki", pki)
+
+	if err := mounts.add("pki"); err != nil {
+		t.Fatalf("could not add existing mount: %v", err)
+	}
+	if err := mounts.add("missing"); err == nil {
+		t.Error("added a mount that does not exist")
+	}
+	vault.setFailing(true)
+	if err := mounts.add("pki2"); err == nil {
+		t.Error("added a mount while vault is down")
+	}
+	if !mounts.served("pki") || mounts.served("missing") || mounts.served("pki2") {
+		t.Errorf("got served mounts %v, want only pki", mounts.order)
+	}
+}
+
+func TestMountRouting(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki", "pki/intermediate")
+	certificates := map[string]*x509.Certificate{}
+	for _, pkiMount := range []string{"pki", "pki/intermediate"} {
+		certificates[pkiMount] = pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+		vault.addCertificate(pkiMount, certificates[pkiMount], time.Time{})
+	}
+
+	tests := []struct {
+		name        string
+		pkiMount    string
+		certificate string
+		answered    bool
+	}{
+		{"first mount", "pki", "pki", true},
+		{"nested mount", "pki/intermediate", "pki/intermediate", true},
+		{"certificate of the nested mount", "pki", "pki/intermediate", false},
+		{"certificate of the first mount", "pki/intermediate", "pki", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der := marshalRequest(t, pki.request(t, certificates[test.certificate].SerialNumber, crypto.SHA1))
+			recorder := httptest.NewRecorder()
+			mounts.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+				"/"+test.pkiMount+"/"+base64.StdEncoding.EncodeToString(der), nil))
+			if !test.answered {
+				if !bytes.Equal(recorder.Body.Bytes(), unauthorizedErrorResponse) {
+					t.Errorf("got %x, want an unauthorized response", recorder.Body.Bytes())
+				}
+				return
+			}
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", recorder.Code)
+			}
+			if response := pki.parse(t, recorder.Body.Bytes()); response.Status != ocsp.Good {
+				t.Errorf("got status %d, want good", response.Status)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	mounts.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/other/MAA=", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown mount, want 404", recorder.Code)
+	}
+
+	// -caPath is served below the path prefix of each mount
+	recorder = httptest.NewRecorder()
+	mounts.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/pki/intermediate/ca", nil))
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), pki.ca.Raw) {
+		t.Errorf("got status %d and %d bytes for /pki/intermediate/ca, want the CA certificate", recorder.Code, recorder.Body.Len())
+	}
+}
+
+func TestBogusMountRequests(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	der := marshalRequest(t, pki.request(t, nextTestSerial(), crypto.SHA1))
+	reads := vault.totalReads()
+
+	for i := 0; i < 100; i++ {
+		recorder := httptest.NewRecorder()
+		mounts.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/bogus%d/", i), bytes.NewReader(der)))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("got status %d for a bogus mount, want 404", recorder.Code)
+		}
+	}
+	if got := vault.totalReads() - reads; got != 0 {
+		t.Errorf("requests for bogus mounts made %d vault requests", got)
+	}
+	if len(mounts.sources()) != 1 {
+		t.Errorf("got %d mounts, want only pki", len(mounts.sources()))
+	}
+}
+
+func TestDiscoverMounts(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki)
+	client := vault.client(t)
+	setMounts := func(types map[string]string) {
+		data := map[string]interface{}{}
+		for path, mountType := range types {
+			data[path] = map[string]interface{}{"type": mountType}
+			if mountType == "pki" {
+				vault.addPKIMount(strings.TrimSuffix(path, "/"), pki)
+			}
+		}
+		vault.set("sys/mounts", data)
+	}
+
+	setMounts(map[string]string{"pki/": "pki", "secret/": "kv", "sys/": "system"})
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	if !mounts.served("pki") || mounts.served("secret") {
+		t.Fatalf("got served mounts %v, want pki", mounts.order)
+	}
+
+	setMounts(map[string]string{"pki/": "pki", "pki_int/": "pki"})
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	if !mounts.served("pki") || !mounts.served("pki_int") {
+		t.Fatalf("got served mounts %v, want pki and pki_int", mounts.order)
+	}
+
+	setMounts(map[string]string{"pki_int/": "pki"})
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	if mounts.served("pki") || !mounts.served("pki_int") {
+		t.Fatalf("got served mounts %v after removing pki, want pki_int", mounts.order)
+	}
+
+	vault.setStatus("sys/mounts", http.StatusForbidden)
+	if err := mounts.discoverMounts(client); err != errMountsForbidden {
+		t.Errorf("got error %v, want %v", err, errMountsForbidden)
+	}
+	if !mounts.served("pki_int") {
+		t.Error("stopped serving the known mounts when discovery is forbidden")
+	}
+}
+
+func TestDiscoverMountsRebuildsRotatedCA(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki)
+	client := vault.client(t)
+	vault.addPKIMount("pki", pki)
+	vault.set("sys/mounts", map[string]interface{}{"pki/": map[string]interface{}{"type": "pki"}})
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	previous := mounts.sources()[0]
+
+	// unchanged mounts are kept
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	if mounts.sources()[0] != previous {
+		t.Fatal("rebuilt a mount whose CA did not change")
+	}
+
+	renewed := pki.renew(t, time.Now().Add(48*time.Hour))
+	vault.addPKIMount("pki", renewed)
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	source := mounts.sources()[0]
+	if source == previous {
+		t.Fatal("mount was not rebuilt after its CA rotated")
+	}
+	if issuers, _ := source.currentIssuers(); len(issuers) != 1 || !issuers[0].Equal(renewed.ca) {
+		t.Errorf("rebuilt mount serves issuers %v, want the rotated CA", issuers)
+	}
+	certificate := renewed.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	recorder := httptest.NewRecorder()
+	mounts.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		"/pki/"+base64.StdEncoding.EncodeToString(marshalRequest(t, renewed.request(t, certificate.SerialNumber, crypto.SHA1))), nil))
+	if status := renewed.parse(t, recorder.Body.Bytes()).Status; status != ocsp.Good {
+		t.Errorf("got status %d from the rebuilt mount, want good", status)
+	}
+}
+
+func TestDiscoverMountsWithExpiredIssuer(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	expired := newTestPKI(t, "Expired CA", time.Now().Add(-time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki)
+	client := vault.client(t)
+	vault.setList("pki/issuers", []string{"expired", "valid"})
+	vault.set("pki/issuer/expired", map[string]interface{}{"certificate": pemCertificate(expired.ca)})
+	vault.set("pki/issuer/valid", map[string]interface{}{"certificate": pemCertificate(pki.ca)})
+	vault.set("sys/mounts", map[string]interface{}{"pki/": map[string]interface{}{"type": "pki"}})
+	if err := mounts.discoverMounts(client); err != nil {
+		t.Fatal(err)
+	}
+	previous := mounts.sources()[0]
+	if issuers, _ := previous.currentIssuers(); len(issuers) != 1 || !issuers[0].Equal(pki.ca) {
+		t.Fatalf("got issuers %v, want the valid CA only", issuers)
+	}
+
+	// the expired issuer that is still in vault is no change
+	for i := 0; i < 2; i++ {
+		if err := mounts.discoverMounts(client); err != nil {
+			t.Fatal(err)
+		}
+		if mounts.sources()[0] != previous {
+			t.Fatal("rebuilt a mount whose valid issuers did not change")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// MultiResponseWithPreferences is like ResponseWithPreferences for OCSP
+// requests with several single requests. The serials are looked up
+// concurrently, each through the cache, and answered in one response. All
+// single requests must be for the same issuer. Serials that cannot be
+// answered, because they are unknown, expired or not issued by the CA, get
+// an unknown single response; the response fails as a whole only if a
+// request is malformed or a lookup fails.
+func (source *VaultSource) MultiResponseWithPreferences(ctx context.Context, requests []*ocsp.Request, preferred []x509.SignatureAlgorithm) ([]byte, http.Header, error) {
+	response, responderCertificate, err := source.multiResponse(ctx, requests, preferred)
+	if err != nil {
+		lookupErrors.Add(errorKindName(err), 1)
+		return nil, nil, err
+	}
+	serials := make([]string, len(requests))
+	for i, request := range requests {
+		serials[i] = toVaultSerial(request.SerialNumber)
+	}
+	source.recordServed(response, responderCertificate, strings.Join(serials, ","))
+	headers := source.currentLifetimes().cacheControl.headers(response, source.clk.Now())
+	if headers != nil {
+		headers.Set("ETag", responseETag(response))
+	}
+	return response, headers, nil
+}
+
+func (source *VaultSource) multiResponse(ctx context.Context, requests []*ocsp.Request, preferred []x509.SignatureAlgorithm) ([]byte, *x509.Certificate, error) {
+	if len(requests) > maxSingleRequests {
+		return nil, nil, lookupError(errMalformedRequest, fmt.Errorf("request contains %d single requests, more than the %d allowed", len(requests), maxSingleRequests))
+	}
+	first := requests[0]
+	for _, request := range requests[1:] {
+		if request.HashAlgorithm != first.HashAlgorithm || !bytes.Equal(request.IssuerKeyHash, first.IssuerKeyHash) {
+			return nil, nil, lookupError(errIssuerMismatch, errors.New("single requests are for different issuers"))
+		}
+	}
+
+	stapling := isStapling(ctx)
+	entries := make([]cacheEntry, len(requests))
+	errs := make([]error, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, request *ocsp.Request) {
+			defer wg.Done()
+			entries[i], errs[i] = source.lookupResponse(ctx, request, preferred, stapling)
+		}(i, request)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && responseStatus(err) != ocsp.Unauthorized {
+			return nil, nil, err
+		}
+	}
+
+	// the cached responses are signed for a single serial, their contents
+	// are signed again as one response
+	templates := make([]ocsp.Response, len(entries))
+	for i, entry := range entries {
+		if errs[i] != nil {
+			templates[i] = ocsp.Response{
+				SerialNumber: requests[i].SerialNumber,
+				Status:       ocsp.Unknown,
+				ThisUpdate:   source.clk.Now().Add(-source.thisUpdateSkew),
+				IssuerHash:   requests[i].HashAlgorithm,
+			}
+			continue
+		}
+		parsed, err := ocsp.ParseResponse(entry.response, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse cached response for serial %s: %v", toVaultSerial(requests[i].SerialNumber), err)
+		}
+		templates[i] = ocsp.Response{
+			SerialNumber:     parsed.SerialNumber,
+			Status:           parsed.Status,
+			ThisUpdate:       parsed.ThisUpdate,
+			NextUpdate:       parsed.NextUpdate,
+			RevokedAt:        parsed.RevokedAt,
+			RevocationReason: parsed.RevocationReason,
+			IssuerHash:       parsed.IssuerHash,
+		}
+	}
+	issuers, keyHashes := source.currentIssuers()
+	issuer, err := matchIssuer(issuers, keyHashes, first.HashAlgorithm, first.IssuerKeyHash)
+	if err != nil {
+		return nil, nil, lookupError(errMalformedRequest, err)
+	}
+	if issuer == nil {
+		return nil, nil, lookupError(errIssuerMismatch, errors.New("request issuer key hash does not match a CA subject key hash"))
+	}
+	response, responderCertificate, err := source.buildResponses(ctx, issuer, templates, preferred)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not build response %v", err)
+	}
+	return response, responderCertificate, nil
+}
@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMultiRequest(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name     string
+		requests []*ocsp.Request
+		statuses []int
+	}{
+		{"good and revoked", []*ocsp.Request{
+			pki.request(t, good.SerialNumber, crypto.SHA1),
+			pki.request(t, revoked.SerialNumber, crypto.SHA1),
+		}, []int{ocsp.Good, ocsp.Revoked}},
+		{"one unknown", []*ocsp.Request{
+			pki.request(t, good.SerialNumber, crypto.SHA1),
+			pki.request(t, nextTestSerial(), crypto.SHA1),
+		}, []int{ocsp.Good, ocsp.Unknown}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, _, err := source.MultiResponseWithPreferences(context.Background(), test.requests, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses, err := parseResponses(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(responses) != len(test.requests) {
+				t.Fatalf("got %d single responses, want %d", len(responses), len(test.requests))
+			}
+			for i, response := range responses {
+				if response.SerialNumber.Cmp(test.requests[i].SerialNumber) != 0 {
+					t.Errorf("single response %d is for serial %s, want %s", i, response.SerialNumber, test.requests[i].SerialNumber)
+				}
+				if response.Status != test.statuses[i] {
+					t.Errorf("single response %d has status %d, want %d", i, response.Status, test.statuses[i])
+				}
+			}
+		})
+	}
+
+	t.Run("vault unavailable", func(t *testing.T) {
+		vault.setFailing(true)
+		defer vault.setFailing(false)
+		requests := []*ocsp.Request{
+			pki.request(t, good.SerialNumber, crypto.SHA1),
+			pki.request(t, nextTestSerial(), crypto.SHA1),
+		}
+		_, _, err := source.MultiResponseWithPreferences(context.Background(), requests, nil)
+		if status := responseStatus(err); status != ocsp.TryLater {
+			t.Errorf("got error %v with status %d, want tryLater", err, status)
+		}
+	})
+}
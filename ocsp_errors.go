@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+
+	cfocsp "github.com/cloudflare/cfssl/ocsp"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Kinds of lookup errors, lookups return errors that match one of them
+// with errors.Is.
+var (
+	errMalformedRequest   = errors.New("malformed request")
+	errIssuerMismatch     = errors.New("issuer mismatch")
+	errUnknownSerial      = cfocsp.ErrNotFound
+	errCertificateExpired = errors.New("certificate expired")
+	errVaultUnavailable   = errors.New("vault unavailable")
+)
+
+// errorKinds define the OCSP response status answered for each kind of
+// lookup error and the name it is counted under in the metrics.
+var errorKinds = []struct {
+	kind   error
+	name   string
+	status ocsp.ResponseStatus
+}{
+	{errMalformedRequest, "malformed_request", ocsp.Malformed},
+	{errIssuerMismatch, "issuer_mismatch", ocsp.Unauthorized},
+	{errUnknownSerial, "unknown_serial", ocsp.Unauthorized},
+	{errCertificateExpired, "certificate_expired", ocsp.Unauthorized},
+	{errVaultUnavailable, "vault_unavailable", ocsp.TryLater},
+}
+
+// ocspError is a lookup error of one of the error kinds.
+type ocspError struct {
+	kind error
+	err  error
+}
+
+func (e *ocspError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ocspError) Unwrap() error {
+	return e.err
+}
+
+func (e *ocspError) Is(target error) bool {
+	return target == e.kind
+}
+
+// lookupError returns err as an error of the given kind.
+func lookupError(kind error, err error) error {
+	return &ocspError{kind: kind, err: err}
+}
+
+// responseStatus returns the OCSP response status to answer a lookup error
+// with, errors of no known kind are internal errors.
+func responseStatus(err error) ocsp.ResponseStatus {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.kind) {
+			return kind.status
+		}
+	}
+	return ocsp.InternalError
+}
+
+// errorKindByName returns the kind of lookup errors with the metrics name,
+// nil for unknown names.
+func errorKindByName(name string) error {
+	for _, kind := range errorKinds {
+		if kind.name == name {
+			return kind.kind
+		}
+	}
+	return nil
+}
+
+// errorKindName returns the metrics name of the kind of a lookup error.
+func errorKindName(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.kind) {
+			return kind.name
+		}
+	}
+	return "internal_error"
+}
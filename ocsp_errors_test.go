@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestLookupErrorKinds(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	expired := pki.issue(t, nextTestSerial(), time.Now().Add(-time.Minute))
+	vault.addCertificate("pki", expired, time.Time{})
+	unsupportedHash := pki.request(t, nextTestSerial(), crypto.SHA1)
+	unsupportedHash.HashAlgorithm = crypto.MD5
+	tests := []struct {
+		name    string
+		request *ocsp.Request
+		failing bool
+		kind    error
+		metric  string
+		status  ocsp.ResponseStatus
+	}{
+		{"unsupported hash", unsupportedHash, false, errMalformedRequest, "malformed_request", ocsp.Malformed},
+		{"issuer mismatch", other.request(t, nextTestSerial(), crypto.SHA1), false, errIssuerMismatch, "issuer_mismatch", ocsp.Unauthorized},
+		{"unknown serial", pki.request(t, nextTestSerial(), crypto.SHA1), false, errUnknownSerial, "unknown_serial", ocsp.Unauthorized},
+		{"expired certificate", pki.request(t, expired.SerialNumber, crypto.SHA1), false, errCertificateExpired, "certificate_expired", ocsp.Unauthorized},
+		{"vault unavailable", pki.request(t, nextTestSerial(), crypto.SHA1), true, errVaultUnavailable, "vault_unavailable", ocsp.TryLater},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault.setFailing(test.failing)
+			_, _, err := source.Response(test.request)
+			if !errors.Is(err, test.kind) {
+				t.Fatalf("got error %v, want %v", err, test.kind)
+			}
+			for _, kind := range errorKinds {
+				if kind.kind != test.kind && errors.Is(err, kind.kind) {
+					t.Errorf("error %v is also of kind %v", err, kind.kind)
+				}
+			}
+			if name := errorKindName(err); name != test.metric {
+				t.Errorf("got metrics name %s, want %s", name, test.metric)
+			}
+			if status := responseStatus(err); status != test.status {
+				t.Errorf("got response status %v, want %v", status, test.status)
+			}
+		})
+	}
+
+	if err := errors.New("other"); errorKindName(err) != "internal_error" || responseStatus(err) != ocsp.InternalError {
+		t.Errorf("errors of no kind are not internal errors")
+	}
+}
@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxSingleRequests limits the number of single requests answered for one
+// OCSP request, each of them may need a vault read.
+const maxSingleRequests = 16
+
+type ocspRequestASN1 struct {
+	TBSRequest        tbsRequest
+	OptionalSignature asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type tbsRequest struct {
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []singleRequest
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type singleRequest struct {
+	Cert                    certID
+	SingleRequestExtensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+// parseRequests parses all single requests of a DER encoded OCSP request.
+// ocsp.ParseRequest only returns the first of them. Single requests with
+// unknown hash algorithms get a zero HashAlgorithm.
+func parseRequests(der []byte) ([]*ocsp.Request, error) {
+	var request ocspRequestASN1
+	rest, err := asn1.Unmarshal(der, &request)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data in OCSP request")
+	}
+	if len(request.TBSRequest.RequestList) == 0 {
+		return nil, errors.New("OCSP request contains no request body")
+	}
+	requests := make([]*ocsp.Request, len(request.TBSRequest.RequestList))
+	for i, single := range request.TBSRequest.RequestList {
+		requests[i] = &ocsp.Request{
+			HashAlgorithm:  hashForOID(single.Cert.HashAlgorithm.Algorithm),
+			IssuerNameHash: single.Cert.NameHash,
+			IssuerKeyHash:  single.Cert.IssuerKeyHash,
+			SerialNumber:   single.Cert.SerialNumber,
+		}
+	}
+	return requests, nil
+}
+
+func hashForOID(oid asn1.ObjectIdentifier) crypto.Hash {
+	for hash, hashOID := range hashOIDs {
+		if hashOID.Equal(oid) {
+			return hash
+		}
+	}
+	return 0
+}
@@ -0,0 +1,331 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.golang file.
+
+// Response creation adapted from golang.org/x/crypto/ocsp. CreateResponse
+// in that package always sets ProducedAt to the current time, the variant
+// in this file lets the caller define it.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type responseASN1 struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []singleResponse
+}
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+var idPKIXOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// idPKIXOCSPArchiveCutoff is the single response extension of RFC 6960
+// section 4.4.4.
+var idPKIXOCSPArchiveCutoff = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 6}
+
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+var signatureAlgorithmDetails = []struct {
+	algo       x509.SignatureAlgorithm
+	oid        asn1.ObjectIdentifier
+	pubKeyAlgo x509.PublicKeyAlgorithm
+	hash       crypto.Hash
+}{
+	{x509.SHA1WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, x509.RSA, crypto.SHA1},
+	{x509.SHA256WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.RSA, crypto.SHA256},
+	{x509.SHA384WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.RSA, crypto.SHA384},
+	{x509.SHA512WithRSA, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.RSA, crypto.SHA512},
+	{x509.ECDSAWithSHA1, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, x509.ECDSA, crypto.SHA1},
+	{x509.ECDSAWithSHA256, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSA, crypto.SHA256},
+	{x509.ECDSAWithSHA384, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSA, crypto.SHA384},
+	{x509.ECDSAWithSHA512, asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSA, crypto.SHA512},
+}
+
+// signingParamsForPublicKey returns the hash function and signature
+// algorithm identifier to sign with the given public key. If
+// requestedSigAlgo is zero a default for the key type is chosen.
+func signingParamsForPublicKey(pub crypto.PublicKey, requestedSigAlgo x509.SignatureAlgorithm) (crypto.Hash, pkix.AlgorithmIdentifier, error) {
+	var pubType x509.PublicKeyAlgorithm
+	defaultSigAlgo := x509.UnknownSignatureAlgorithm
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		pubType = x509.RSA
+		defaultSigAlgo = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		pubType = x509.ECDSA
+		switch pub.Curve {
+		case elliptic.P224(), elliptic.P256():
+			defaultSigAlgo = x509.ECDSAWithSHA256
+		case elliptic.P384():
+			defaultSigAlgo = x509.ECDSAWithSHA384
+		case elliptic.P521():
+			defaultSigAlgo = x509.ECDSAWithSHA512
+		default:
+			return 0, pkix.AlgorithmIdentifier{}, errors.New("unknown elliptic curve")
+		}
+	default:
+		return 0, pkix.AlgorithmIdentifier{}, errors.New("only RSA and ECDSA keys supported")
+	}
+
+	if requestedSigAlgo == x509.UnknownSignatureAlgorithm {
+		requestedSigAlgo = defaultSigAlgo
+	}
+	for _, details := range signatureAlgorithmDetails {
+		if details.algo != requestedSigAlgo {
+			continue
+		}
+		if details.pubKeyAlgo != pubType {
+			return 0, pkix.AlgorithmIdentifier{}, errors.New("requested signature algorithm does not match private key type")
+		}
+		sigAlgo := pkix.AlgorithmIdentifier{Algorithm: details.oid}
+		if pubType == x509.RSA {
+			sigAlgo.Parameters = asn1.RawValue{Tag: 5 /* ASN.1 NULL */}
+		}
+		return details.hash, sigAlgo, nil
+	}
+	return 0, pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signature algorithm %v", requestedSigAlgo)
+}
+
+// createResponse creates a DER encoded OCSP response for the template like
+// ocsp.CreateResponse, but with the given ProducedAt time. If
+// template.IssuerHash is not set, SHA1 is used.
+func createResponse(issuer, responderCert *x509.Certificate, template ocsp.Response, producedAt time.Time, priv crypto.Signer) ([]byte, error) {
+	return createResponses(issuer, responderCert, []ocsp.Response{template}, producedAt, priv)
+}
+
+// createResponses is createResponse with a single response for each
+// template. Certificate and SignatureAlgorithm are taken from the first
+// template.
+func createResponses(issuer, responderCert *x509.Certificate, templates []ocsp.Response, producedAt time.Time, priv crypto.Signer) ([]byte, error) {
+	if len(templates) == 0 {
+		return nil, errors.New("no response templates")
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return nil, err
+	}
+
+	innerResponses := make([]singleResponse, len(templates))
+	for i, template := range templates {
+		innerResponse, err := createSingleResponse(issuer, publicKeyInfo.PublicKey, template)
+		if err != nil {
+			return nil, err
+		}
+		innerResponses[i] = innerResponse
+	}
+	template := templates[0]
+
+	tbsResponseData := responseData{
+		Version: 0,
+		RawResponderID: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        1, // Name (explicit tag)
+			IsCompound: true,
+			Bytes:      responderCert.RawSubject,
+		},
+		ProducedAt: producedAt.UTC(),
+		Responses:  innerResponses,
+	}
+
+	tbsResponseDataDER, err := asn1.Marshal(tbsResponseData)
+	if err != nil {
+		return nil, err
+	}
+
+	hashFunc, signatureAlgorithm, err := signingParamsForPublicKey(priv.Public(), template.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	responseHash := hashFunc.New()
+	responseHash.Write(tbsResponseDataDER)
+	signature, err := priv.Sign(rand.Reader, responseHash.Sum(nil), hashFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	response := basicResponse{
+		TBSResponseData:    tbsResponseData,
+		SignatureAlgorithm: signatureAlgorithm,
+		Signature: asn1.BitString{
+			Bytes:     signature,
+			BitLength: 8 * len(signature),
+		},
+	}
+	if template.Certificate != nil {
+		response.Certificates = []asn1.RawValue{
+			{FullBytes: template.Certificate.Raw},
+		}
+	}
+	responseDER, err := asn1.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(responseASN1{
+		Status: asn1.Enumerated(ocsp.Success),
+		Response: responseBytes{
+			ResponseType: idPKIXOCSPBasic,
+			Response:     responseDER,
+		},
+	})
+}
+
+func createSingleResponse(issuer *x509.Certificate, issuerPublicKey asn1.BitString, template ocsp.Response) (singleResponse, error) {
+	if template.IssuerHash == 0 {
+		template.IssuerHash = crypto.SHA1
+	}
+	hashOID, found := hashOIDs[template.IssuerHash]
+	if !found {
+		return singleResponse{}, errors.New("unsupported issuer hash algorithm")
+	}
+	if !template.IssuerHash.Available() {
+		return singleResponse{}, fmt.Errorf("issuer hash algorithm %v not linked into binary", template.IssuerHash)
+	}
+	h := template.IssuerHash.New()
+	h.Write(issuerPublicKey.RightAlign())
+	issuerKeyHash := h.Sum(nil)
+
+	h.Reset()
+	h.Write(issuer.RawSubject)
+	issuerNameHash := h.Sum(nil)
+
+	innerResponse := singleResponse{
+		CertID: certID{
+			HashAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  hashOID,
+				Parameters: asn1.RawValue{Tag: 5 /* ASN.1 NULL */},
+			},
+			NameHash:      issuerNameHash,
+			IssuerKeyHash: issuerKeyHash,
+			SerialNumber:  template.SerialNumber,
+		},
+		ThisUpdate:       template.ThisUpdate.UTC(),
+		NextUpdate:       template.NextUpdate.UTC(),
+		SingleExtensions: template.ExtraExtensions,
+	}
+
+	switch template.Status {
+	case ocsp.Good:
+		innerResponse.Good = true
+	case ocsp.Unknown:
+		innerResponse.Unknown = true
+	case ocsp.Revoked:
+		innerResponse.Revoked = revokedInfo{
+			RevocationTime: template.RevokedAt.UTC(),
+			Reason:         asn1.Enumerated(template.RevocationReason),
+		}
+	}
+	return innerResponse, nil
+}
+
+// parseResponses parses all single responses of a DER encoded OCSP
+// response without verifying the signature. ocsp.ParseResponse fails for
+// responses with more than one of them.
+func parseResponses(der []byte) ([]*ocsp.Response, error) {
+	var response responseASN1
+	if _, err := asn1.Unmarshal(der, &response); err != nil {
+		return nil, err
+	}
+	if response.Status != asn1.Enumerated(ocsp.Success) || !response.Response.ResponseType.Equal(idPKIXOCSPBasic) {
+		parsed, err := ocsp.ParseResponse(der, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*ocsp.Response{parsed}, nil
+	}
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(response.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+	if len(basic.TBSResponseData.Responses) <= 1 {
+		parsed, err := ocsp.ParseResponse(der, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*ocsp.Response{parsed}, nil
+	}
+	responses := make([]*ocsp.Response, len(basic.TBSResponseData.Responses))
+	for i, single := range basic.TBSResponseData.Responses {
+		parsed, err := ocsp.ParseResponseForCert(der, &x509.Certificate{SerialNumber: single.CertID.SerialNumber}, nil)
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = parsed
+	}
+	return responses, nil
+}
+
+// archiveCutoffExtension returns the archive cutoff extension telling
+// clients that revocation information is retained back to cutoff.
+func archiveCutoffExtension(cutoff time.Time) (pkix.Extension, error) {
+	value, err := asn1.MarshalWithParams(cutoff.UTC(), "generalized")
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("could not encode archive cutoff: %v", err)
+	}
+	return pkix.Extension{Id: idPKIXOCSPArchiveCutoff, Value: value}, nil
+}
@@ -0,0 +1,33 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// pprofHandler serves the runtime profiles of net/http/pprof below
+// /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// servePprof serves the profiling endpoints on their own listener so that
+// they are never reachable through the OCSP addresses.
+func servePprof(listener net.Listener) {
+	if err := http.Serve(listener, pprofHandler()); err != nil {
+		log.Errorf("Profiling server on %s stopped: %v", listener.Addr(), err)
+	}
+}
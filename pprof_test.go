@@ -0,0 +1,34 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPprofHandlers(t *testing.T) {
+	if config := newTestConfiguration(t); config.PprofAddr != "" {
+		t.Fatalf("profiling is served on %s by default", config.PprofAddr)
+	}
+	config := newTestConfiguration(t, "-pprofAddr", "127.0.0.1:0")
+	listener, err := listen(config.PprofAddr, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go servePprof(listener)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		response, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("got status %d for %s, want 200", response.StatusCode, path)
+		}
+	}
+}
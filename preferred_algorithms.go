@@ -0,0 +1,91 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+)
+
+// idPKIXOCSPPrefSigAlgs is the OID of the preferred signature algorithms
+// request extension defined in RFC 6960 section 4.4.7.
+var idPKIXOCSPPrefSigAlgs = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 8}
+
+// ocspRequestExtensions is the part of an OCSP request needed to get to the
+// request extensions, the request list is parsed by golang.org/x/crypto/ocsp.
+type ocspRequestExtensions struct {
+	TBSRequest struct {
+		Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+		RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+		RequestList       asn1.RawValue
+		RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+	}
+}
+
+type preferredSignatureAlgorithm struct {
+	SigIdentifier  pkix.AlgorithmIdentifier
+	CertIdentifier pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// parsePreferredSignatureAlgorithms returns the signature algorithms a
+// client prefers in the order of its preference. Algorithms vault-ocsp
+// cannot sign with are skipped, so are the SHA-1 based algorithms clients
+// must not be able to downgrade responses to. Requests without or with an
+// unparseable extension have no preferences.
+func parsePreferredSignatureAlgorithms(requestDER []byte) []x509.SignatureAlgorithm {
+	var request ocspRequestExtensions
+	if _, err := asn1.Unmarshal(requestDER, &request); err != nil {
+		return nil
+	}
+	for _, extension := range request.TBSRequest.RequestExtensions {
+		if !extension.Id.Equal(idPKIXOCSPPrefSigAlgs) {
+			continue
+		}
+		var preferences []preferredSignatureAlgorithm
+		if _, err := asn1.Unmarshal(extension.Value, &preferences); err != nil {
+			return nil
+		}
+		var algorithms []x509.SignatureAlgorithm
+		for _, preference := range preferences {
+			for _, details := range signatureAlgorithmDetails {
+				if details.hash == crypto.SHA1 {
+					continue
+				}
+				if details.oid.Equal(preference.SigIdentifier.Algorithm) {
+					algorithms = append(algorithms, details.algo)
+				}
+			}
+		}
+		return algorithms
+	}
+	return nil
+}
+
+// signatureAlgorithmFor returns the first of the preferred algorithms the
+// responder key can sign with or the default algorithm.
+func signatureAlgorithmFor(responderKey crypto.Signer, preferred []x509.SignatureAlgorithm, defaultAlgorithm x509.SignatureAlgorithm) x509.SignatureAlgorithm {
+	for _, algorithm := range preferred {
+		if _, _, err := signingParamsForPublicKey(responderKey.Public(), algorithm); err == nil {
+			return algorithm
+		}
+	}
+	return defaultAlgorithm
+}
+
+// preferenceCacheKey returns the suffix of cache keys for responses signed
+// according to the preferred algorithms.
+func preferenceCacheKey(preferred []x509.SignatureAlgorithm) string {
+	if len(preferred) == 0 {
+		return ""
+	}
+	names := make([]string, len(preferred))
+	for i, algorithm := range preferred {
+		names[i] = algorithm.String()
+	}
+	return "/" + strings.Join(names, ",")
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withPreferredAlgorithms returns the DER encoded request with a preferred
+// signature algorithms extension listing the algorithms.
+func withPreferredAlgorithms(t *testing.T, requestDER []byte, algorithms ...x509.SignatureAlgorithm) []byte {
+	t.Helper()
+	var preferences []preferredSignatureAlgorithm
+	for _, algorithm := range algorithms {
+		for _, details := range signatureAlgorithmDetails {
+			if details.algo == algorithm {
+				preferences = append(preferences, preferredSignatureAlgorithm{SigIdentifier: pkix.AlgorithmIdentifier{Algorithm: details.oid}})
+			}
+		}
+	}
+	value, err := asn1.Marshal(preferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request ocspRequestExtensions
+	if _, err := asn1.Unmarshal(requestDER, &request); err != nil {
+		t.Fatal(err)
+	}
+	request.TBSRequest.RequestExtensions = append(request.TBSRequest.RequestExtensions,
+		pkix.Extension{Id: idPKIXOCSPPrefSigAlgs, Value: value})
+	der, err := asn1.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestPreferredSignatureAlgorithms(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	config := newTestConfiguration(t)
+	handler := ocspHandler(config, newTestMounts(t, vault, config, pki, "pki").sources()[0])
+	requestDER := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	tests := []struct {
+		name      string
+		preferred []x509.SignatureAlgorithm
+		want      x509.SignatureAlgorithm
+	}{
+		{"no preference", nil, x509.SHA256WithRSA},
+		{"SHA-512", []x509.SignatureAlgorithm{x509.SHA512WithRSA}, x509.SHA512WithRSA},
+		{"first supported", []x509.SignatureAlgorithm{x509.ECDSAWithSHA384, x509.SHA384WithRSA, x509.SHA512WithRSA}, x509.SHA384WithRSA},
+		{"SHA-1 skipped", []x509.SignatureAlgorithm{x509.SHA1WithRSA, x509.SHA512WithRSA}, x509.SHA512WithRSA},
+		{"only SHA-1", []x509.SignatureAlgorithm{x509.SHA1WithRSA, x509.ECDSAWithSHA1}, x509.SHA256WithRSA},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der := requestDER
+			if test.preferred != nil {
+				der = withPreferredAlgorithms(t, requestDER, test.preferred...)
+			}
+			recorder := postOCSP(handler, der, nil)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", recorder.Code)
+			}
+			if algorithm := pki.parse(t, recorder.Body.Bytes()).SignatureAlgorithm; algorithm != test.want {
+				t.Errorf("response is signed with %v, want %v", algorithm, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/time/rate"
+)
+
+// clientRateLimit is a token bucket rate limit per client IP address.
+type clientRateLimit struct {
+	limit          rate.Limit
+	burst          int
+	trustedProxies []*net.IPNet
+
+	lock      sync.Mutex
+	clients   map[string]*clientBucket
+	lastPrune time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientRateLimit(requestsPerSecond float64, burst int, trustedProxies []*net.IPNet) *clientRateLimit {
+	return &clientRateLimit{
+		limit:          rate.Limit(requestsPerSecond),
+		burst:          burst,
+		trustedProxies: trustedProxies,
+		clients:        make(map[string]*clientBucket),
+	}
+}
+
+// parseTrustedProxies parses IP addresses and CIDR networks of trusted
+// reverse proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %s: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (limit *clientRateLimit) trusted(ip net.IP) bool {
+	for _, network := range limit.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent the request. For
+// requests of trusted proxies it is the last address in X-Forwarded-For
+// that is not a trusted proxy itself.
+func (limit *clientRateLimit) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix domain socket connections have no IP address
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !limit.trusted(ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		if !limit.trusted(hop) {
+			return hop.String()
+		}
+	}
+	return host
+}
+
+// allow takes a token from the bucket of the client.
+func (limit *clientRateLimit) allow(client string, now time.Time) bool {
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+	limit.prune(now)
+	bucket, found := limit.clients[client]
+	if !found {
+		bucket = &clientBucket{limiter: rate.NewLimiter(limit.limit, limit.burst)}
+		limit.clients[client] = bucket
+	}
+	bucket.lastSeen = now
+	return bucket.limiter.AllowN(now, 1)
+}
+
+// prune forgets clients whose bucket has been refilled completely, they
+// are indistinguishable from new clients.
+func (limit *clientRateLimit) prune(now time.Time) {
+	refill := time.Duration(float64(limit.burst) / float64(limit.limit) * float64(time.Second))
+	if now.Sub(limit.lastPrune) < refill {
+		return
+	}
+	limit.lastPrune = now
+	for client, bucket := range limit.clients {
+		if now.Sub(bucket.lastSeen) >= refill {
+			delete(limit.clients, client)
+		}
+	}
+}
+
+// retryAfter returns the Retry-After seconds until a client gets a new
+// token.
+func (limit *clientRateLimit) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(1/float64(limit.limit)))))
+}
+
+// limitClientRate answers requests of clients exceeding the rate limit with
+// 429 Too Many Requests before they reach the wrapped handler.
+func limitClientRate(limit *clientRateLimit, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := limit.clientIP(r)
+		if !limit.allow(client, time.Now()) {
+			log.Infof("Rejected OCSP request from %s exceeding the rate limit", client)
+			w.Header().Set("Retry-After", limit.retryAfter())
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rateLimitedRequest sends a request from the remote address with the
+// X-Forwarded-For header to the handler.
+func rateLimitedRequest(handler http.Handler, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestClientRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := limitClientRate(newClientRateLimit(0.5, 3, nil), ok)
+
+	for i := 0; i < 3; i++ {
+		if recorder := rateLimitedRequest(handler, "192.0.2.1:1234", ""); recorder.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst got status %d, want 200", i, recorder.Code)
+		}
+	}
+	recorder := rateLimitedRequest(handler, "192.0.2.1:4321", "")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d after the burst, want 429", recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("got Retry-After %q, want 2 seconds for 0.5 requests per second", retryAfter)
+	}
+	if recorder := rateLimitedRequest(handler, "192.0.2.2:1234", ""); recorder.Code != http.StatusOK {
+		t.Errorf("another client got status %d, want 200", recorder.Code)
+	}
+}
+
+func TestClientRateLimitBehindProxy(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := limitClientRate(newClientRateLimit(0.5, 1, proxies), ok)
+
+	if recorder := rateLimitedRequest(handler, "10.0.0.1:1234", "192.0.2.1, 10.0.0.2"); recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", recorder.Code)
+	}
+	if recorder := rateLimitedRequest(handler, "10.0.0.1:1234", "192.0.2.1"); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("forwarded client got status %d after its burst, want 429", recorder.Code)
+	}
+	if recorder := rateLimitedRequest(handler, "10.0.0.1:1234", "192.0.2.2"); recorder.Code != http.StatusOK {
+		t.Errorf("another client behind the proxy got status %d, want 200", recorder.Code)
+	}
+	// untrusted senders cannot pick their address with X-Forwarded-For
+	if recorder := rateLimitedRequest(handler, "192.0.2.3:1234", "192.0.2.4"); recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", recorder.Code)
+	}
+	if recorder := rateLimitedRequest(handler, "192.0.2.3:1234", "192.0.2.5"); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("untrusted sender got status %d with another X-Forwarded-For, want 429", recorder.Code)
+	}
+}
@@ -0,0 +1,67 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// readinessProbeInterval is the time between failed readiness probes.
+const readinessProbeInterval = 5 * time.Second
+
+// probeReadiness reads certificate data of each source from vault until
+// all reads succeeded and then reports the server ready. The CA
+// certificates are fetched at startup already, but that does not prove
+// that the token may read certificates. The sources are listed again for
+// each probe, so that mounts found by discovery are probed as well, and
+// the server stays unready as long as there is no mount to serve.
+func probeReadiness(health *healthState, sources func() []*VaultSource, interval time.Duration) {
+	passed := make(map[*VaultSource]bool)
+	for {
+		current := sources()
+		ready := len(current) > 0
+		if !ready {
+			log.Warning("Readiness probe failed: no PKI mount to serve yet")
+		}
+		for _, source := range current {
+			if passed[source] {
+				continue
+			}
+			if err := source.probeVault(); err != nil {
+				log.Warningf("Readiness probe of %s failed: %v", source.pkiMount, err)
+				ready = false
+				continue
+			}
+			passed[source] = true
+		}
+		if ready {
+			log.Info("Readiness probe passed, reporting ready on /healthz")
+			health.setReady()
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// probeVault reads the certificate data of the serial of the first issuer
+// like a lookup would. The serial does not need to be known to vault, only
+// the read has to succeed.
+func (source *VaultSource) probeVault() error {
+	issuers, _ := source.currentIssuers()
+	if len(issuers) == 0 {
+		return errors.New("no issuer")
+	}
+	ctx, cancel := source.vaultContext()
+	defer cancel()
+	vaultSerial := formatSerial(issuers[0].SerialNumber, source.serialStyle)
+	if _, err := source.certs.certificateData(ctx, vaultSerial); err != nil {
+		return fmt.Errorf("could not read certificate data for %s: %v", vaultSerial, err)
+	}
+	return nil
+}
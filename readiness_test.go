@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReadinessProbe(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-readinessProbe")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	health := &healthState{unready: config.ReadinessProbe}
+	path := "pki/cert/" + toVaultSerial(pki.ca.SerialNumber)
+
+	if status := healthStatus(health); status != http.StatusServiceUnavailable {
+		t.Fatalf("got /healthz status %d before the probe, want %d", status, http.StatusServiceUnavailable)
+	}
+	vault.setFailing(true)
+	probed := make(chan struct{})
+	go func() {
+		probeReadiness(health, func() []*VaultSource { return []*VaultSource{source} }, 10*time.Millisecond)
+		close(probed)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); vault.readCount(path) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the failing probe was not retried")
+		}
+	}
+	if status := healthStatus(health); status != http.StatusServiceUnavailable {
+		t.Errorf("got /healthz status %d while the probe fails, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	vault.setFailing(false)
+	select {
+	case <-probed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the probe did not pass once vault answered")
+	}
+	if status := healthStatus(health); status != http.StatusOK {
+		t.Errorf("got /healthz status %d after the probe passed, want %d", status, http.StatusOK)
+	}
+}
+
+func TestReadinessProbeWithoutMounts(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-readinessProbe", "-discoverMounts")
+	mounts := newTestMounts(t, vault, config, pki)
+	health := &healthState{unready: config.ReadinessProbe}
+	logged := captureLog(t)
+
+	probed := make(chan struct{})
+	go func() {
+		probeReadiness(health, mounts.sources, 10*time.Millisecond)
+		close(probed)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); !logged.contains("no PKI mount to serve yet"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the probe did not wait for a mount")
+		}
+	}
+	if status := healthStatus(health); status != http.StatusServiceUnavailable {
+		t.Errorf("got /healthz status %d without mounts, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// a discovered mount makes the server ready once it is probed
+	vault.addPKIMount("pki", pki)
+	if err := mounts.add("pki"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-probed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the probe did not pass once a mount was served")
+	}
+	if status := healthStatus(health); status != http.StatusOK {
+		t.Errorf("got /healthz status %d after the probe passed, want %d", status, http.StatusOK)
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(pki.ca.SerialNumber)); reads != 1 {
+		t.Errorf("probed the discovered mount %d times, want 1", reads)
+	}
+}
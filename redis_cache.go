@@ -0,0 +1,252 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// redisIdleConnections is the number of connections kept open for reuse.
+const redisIdleConnections = 8
+
+// redisClient is a minimal client for the Redis protocol (RESP) that
+// supports the few commands needed by the response cache.
+type redisClient struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(addr string, timeout time.Duration) *redisClient {
+	return &redisClient{addr: addr, timeout: timeout, idle: make(chan *redisConn, redisIdleConnections)}
+}
+
+func (client *redisClient) connection() (*redisConn, error) {
+	select {
+	case conn := <-client.idle:
+		return conn, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", client.addr, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (client *redisClient) release(conn *redisConn) {
+	select {
+	case client.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// do sends a command and returns its reply, which is a string, an int64,
+// nil or a []interface{} of those. Error replies are returned as errors.
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	conn, err := client.connection()
+	if err != nil {
+		return nil, err
+	}
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if client.timeout > 0 {
+		conn.conn.SetDeadline(time.Now().Add(client.timeout))
+	}
+	if _, err := io.WriteString(conn.conn, command.String()); err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	reply, err := readRedisReply(conn.reader)
+	var replyError redisError
+	if err != nil && !errors.As(err, &replyError) {
+		// the connection is in an unknown state after I/O errors
+		conn.conn.Close()
+		return nil, err
+	}
+	client.release(conn)
+	return reply, err
+}
+
+// redisError is an error reply sent by the Redis server.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", value)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", value)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			if elements[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+}
+
+// redisCache is a responseCache in Redis that can be shared by several
+// vault-ocsp instances. Keys are prefixed with the PKI mount, entry expiry
+// is enforced by Redis key expiry. Redis failures are logged and treated as
+// cache misses so that lookups fall back to vault.
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+// redis values are the entry type followed by the response or the metrics
+// name of the error kind of not found entries
+const (
+	redisEntryResponse = "r"
+	redisEntryNotFound = "n"
+)
+
+func newRedisCache(client *redisClient, pkiMount string) *redisCache {
+	return &redisCache{client: client, prefix: "vault-ocsp:" + pkiMount + ":"}
+}
+
+func (cache *redisCache) get(key string, now time.Time) (cacheEntry, bool) {
+	reply, err := cache.client.do("GET", cache.prefix+key)
+	if err != nil {
+		log.Warningf("Could not read %s from redis cache: %v", key, err)
+		return cacheEntry{}, false
+	}
+	value, ok := reply.(string)
+	if !ok || value == "" {
+		return cacheEntry{}, false
+	}
+	switch value[:1] {
+	case redisEntryNotFound:
+		kind := errorKindByName(value[1:])
+		if kind == nil {
+			return cacheEntry{}, false
+		}
+		return cacheEntry{notFound: kind}, true
+	case redisEntryResponse:
+		response := []byte(value[1:])
+		return cacheEntry{response: response, etag: responseETag(response)}, true
+	}
+	return cacheEntry{}, false
+}
+
+func (cache *redisCache) set(key string, entry cacheEntry) {
+	value := redisEntryResponse + string(entry.response)
+	if entry.notFound != nil {
+		value = redisEntryNotFound + errorKindName(entry.notFound)
+	}
+	args := []string{"SET", cache.prefix + key, value}
+	if !entry.expires.IsZero() {
+		ttl := time.Until(entry.expires).Milliseconds()
+		if ttl <= 0 {
+			return
+		}
+		args = append(args, "PX", strconv.FormatInt(ttl, 10))
+	}
+	if _, err := cache.client.do(args...); err != nil {
+		log.Warningf("Could not write %s to redis cache: %v", key, err)
+	}
+}
+
+func (cache *redisCache) clear() {
+	cursor := "0"
+	for {
+		reply, err := cache.client.do("SCAN", cursor, "MATCH", redisGlobEscape(cache.prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			log.Errorf("Could not clear redis cache %s: %v", cache.prefix, err)
+			return
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			log.Errorf("Could not clear redis cache %s: unexpected SCAN reply", cache.prefix)
+			return
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if key, ok := key.(string); ok {
+					args = append(args, key)
+				}
+			}
+			if _, err := cache.client.do(args...); err != nil {
+				log.Errorf("Could not clear redis cache %s: %v", cache.prefix, err)
+				return
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+// redisGlobEscape escapes the glob special characters of SCAN patterns.
+func redisGlobEscape(value string) string {
+	var escaped strings.Builder
+	for _, char := range value {
+		if strings.ContainsRune(`*?[]\`, char) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,192 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server supporting the commands used by redisCache.
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	values   map[string]string
+	expiry   map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis := &fakeRedis{listener: listener, values: make(map[string]string), expiry: make(map[string]time.Time)}
+	t.Cleanup(func() { listener.Close() })
+	go redis.serve()
+	return redis
+}
+
+func (redis *fakeRedis) client() *redisClient {
+	return newRedisClient(redis.listener.Addr().String(), time.Second)
+}
+
+func (redis *fakeRedis) serve() {
+	for {
+		conn, err := redis.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				command, err := readRedisReply(reader)
+				if err != nil {
+					return
+				}
+				args, _ := command.([]interface{})
+				if _, err := conn.Write([]byte(redis.execute(args))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// execute returns the RESP encoded reply to the command.
+func (redis *fakeRedis) execute(args []interface{}) string {
+	redis.lock.Lock()
+	defer redis.lock.Unlock()
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i], _ = arg.(string)
+	}
+	switch {
+	case len(words) == 2 && words[0] == "GET":
+		if deadline, found := redis.expiry[words[1]]; found && !time.Now().Before(deadline) {
+			delete(redis.values, words[1])
+		}
+		value, found := redis.values[words[1]]
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case len(words) >= 3 && words[0] == "SET":
+		redis.values[words[1]] = words[2]
+		delete(redis.expiry, words[1])
+		if len(words) == 5 && words[3] == "PX" {
+			milliseconds, _ := strconv.Atoi(words[4])
+			redis.expiry[words[1]] = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case len(words) >= 4 && words[0] == "SCAN" && words[2] == "MATCH":
+		// patterns are escaped prefixes followed by *
+		prefix := strings.NewReplacer(`\\`, `\`, `\*`, `*`, `\?`, `?`, `\[`, `[`, `\]`, `]`).Replace(strings.TrimSuffix(words[3], "*"))
+		var keys bytes.Buffer
+		count := 0
+		for key := range redis.values {
+			if strings.HasPrefix(key, prefix) {
+				fmt.Fprintf(&keys, "$%d\r\n%s\r\n", len(key), key)
+				count++
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", count, keys.String())
+	case len(words) >= 2 && words[0] == "DEL":
+		deleted := 0
+		for _, key := range words[1:] {
+			if _, found := redis.values[key]; found {
+				delete(redis.values, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return "-ERR unsupported command\r\n"
+}
+
+// cacheBackends returns the response cache implementations for the
+// interface tests.
+func cacheBackends(t *testing.T) map[string]responseCache {
+	return map[string]responseCache{
+		cacheBackendMemory: newMemoryCache(),
+		cacheBackendRedis:  newRedisCache(newFakeRedis(t).client(), "pki"),
+	}
+}
+
+func TestResponseCacheBackends(t *testing.T) {
+	for name, cache := range cacheBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			response := []byte("response")
+			cache.set("good", newCacheEntry(response, nil, now.Add(time.Hour)))
+			cache.set("unknown", cacheEntry{notFound: errUnknownSerial, expires: now.Add(time.Hour)})
+			cache.set("mismatch", cacheEntry{notFound: errIssuerMismatch, expires: now.Add(time.Hour)})
+			cache.set("expired", newCacheEntry(response, nil, now.Add(-time.Second)))
+
+			entry, found := cache.get("good", now)
+			if !found || !bytes.Equal(entry.response, response) || entry.etag != responseETag(response) {
+				t.Errorf("got entry %+v found %v, want the response with its ETag", entry, found)
+			}
+			if entry, found := cache.get("unknown", now); !found || entry.notFound != errUnknownSerial {
+				t.Errorf("got entry %+v found %v, want unknown serial entry", entry, found)
+			}
+			if entry, found := cache.get("mismatch", now); !found || entry.notFound != errIssuerMismatch {
+				t.Errorf("got entry %+v found %v, want issuer mismatch entry", entry, found)
+			}
+			if _, found := cache.get("expired", now); found {
+				t.Error("got an expired entry")
+			}
+			if _, found := cache.get("missing", now); found {
+				t.Error("got an entry that was never set")
+			}
+
+			cache.clear()
+			for _, key := range []string{"good", "unknown", "mismatch"} {
+				if _, found := cache.get(key, now); found {
+					t.Errorf("entry %s remained after clear", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisCacheMountPrefix(t *testing.T) {
+	redis := newFakeRedis(t)
+	first := newRedisCache(redis.client(), "pki")
+	second := newRedisCache(redis.client(), "pki_int")
+	entry := newCacheEntry([]byte("response"), nil, time.Now().Add(time.Hour))
+	first.set("key", entry)
+	second.set("key", entry)
+
+	second.clear()
+	if _, found := first.get("key", time.Now()); !found {
+		t.Error("clearing the cache of another mount removed the entry")
+	}
+	if _, found := second.get("key", time.Now()); found {
+		t.Error("entry remained after clear")
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	cache := newRedisCache(newRedisClient(address, 100*time.Millisecond), "pki")
+
+	cache.set("key", newCacheEntry([]byte("response"), nil, time.Now().Add(time.Hour)))
+	if _, found := cache.get("key", time.Now()); found {
+		t.Error("got an entry from an unreachable redis")
+	}
+}
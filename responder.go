@@ -0,0 +1,251 @@
+// Copyright (c) 2014 CloudFlare Inc.
+// Use of this source code is governed by the BSD 2-clause license that can
+// be found in the LICENSE.cfssl file.
+
+// The OCSP HTTP responder is adapted from github.com/cloudflare/cfssl/ocsp.
+// Unlike the cfssl responder it lets the source signal that it is
+// temporarily unavailable.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	cfocsp "github.com/cloudflare/cfssl/ocsp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	malformedRequestErrorResponse = []byte{0x30, 0x03, 0x0A, 0x01, 0x01}
+	internalErrorErrorResponse    = []byte{0x30, 0x03, 0x0A, 0x01, 0x02}
+	tryLaterErrorResponse         = []byte{0x30, 0x03, 0x0A, 0x01, 0x03}
+	unauthorizedErrorResponse     = []byte{0x30, 0x03, 0x0A, 0x01, 0x06}
+)
+
+// responder serves OCSP requests from a source over HTTP. Errors of the
+// source are answered with the OCSP status returned by responseStatus.
+type responder struct {
+	source cfocsp.Source
+	// retryAfter and retryAfterJitter define the Retry-After time of
+	// tryLater responses, a random duration up to retryAfterJitter is added
+	// to spread retries of clients
+	retryAfter       time.Duration
+	retryAfterJitter time.Duration
+	// banner is the text answered to GET requests without an OCSP request
+	// in the path, an empty banner treats them as malformed requests
+	banner string
+	// stapling serves requests below staplingPrefix as stapling lookups
+	stapling bool
+}
+
+// preferenceSource is a source that can sign responses with the signature
+// algorithms preferred by the client and stops looking up responses once
+// the context of the HTTP request is done.
+type preferenceSource interface {
+	ResponseWithPreferences(context.Context, *ocsp.Request, []x509.SignatureAlgorithm) ([]byte, http.Header, error)
+}
+
+// multiRequestSource is a preferenceSource that answers all single requests
+// of an OCSP request in one response.
+type multiRequestSource interface {
+	MultiResponseWithPreferences(context.Context, []*ocsp.Request, []x509.SignatureAlgorithm) ([]byte, http.Header, error)
+}
+
+func newResponder(source cfocsp.Source) *responder {
+	return &responder{source: source, retryAfter: time.Second}
+}
+
+// retryAfterSeconds returns the Retry-After header value for tryLater
+// responses in whole seconds, at least one.
+func (rs *responder) retryAfterSeconds() string {
+	retryAfter := rs.retryAfter
+	if rs.retryAfterJitter > 0 {
+		retryAfter += time.Duration(rand.Int63n(int64(rs.retryAfterJitter)))
+	}
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+func overrideHeaders(response http.ResponseWriter, headers http.Header) {
+	for k, v := range headers {
+		if len(v) == 1 {
+			response.Header().Set(k, v[0])
+		} else if len(v) > 1 {
+			response.Header().Del(k)
+			for _, e := range v {
+				response.Header().Add(k, e)
+			}
+		}
+	}
+}
+
+// ServeHTTP decodes GET and POST OCSP requests and writes the response of
+// the source. The caller must strip any path prefix of GET requests.
+func (rs *responder) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	// max-age=0, no-cache is only returned to the client if no valid
+	// response is found, successful responses get their cache headers below
+	response.Header().Set("Cache-Control", "max-age=0, no-cache")
+	ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+	ctx, span := tracer.Start(ctx, "ocsp.request", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(request.Method)))
+	defer span.End()
+	path := request.URL.Path
+	if rs.stapling {
+		var stapling bool
+		if path, stapling = trimStaplingPrefix(path); stapling {
+			ctx = withStapling(ctx)
+		}
+	}
+	var requestBody []byte
+	var err error
+	switch request.Method {
+	case http.MethodGet:
+		base64Request, err := url.QueryUnescape(path)
+		if err != nil {
+			log.Debugf("Error decoding URL: %s", path)
+			http.Error(response, "malformed OCSP request: invalid URL escaping", http.StatusBadRequest)
+			return
+		}
+		// url.QueryUnescape not only unescapes %2B escaping, but it
+		// additionally turns the resulting '+' into a space, which makes
+		// base64 decoding fail. So we go back afterwards and turn ' ' back
+		// into '+'.
+		base64RequestBytes := []byte(base64Request)
+		for i := range base64RequestBytes {
+			if base64RequestBytes[i] == ' ' {
+				base64RequestBytes[i] = '+'
+			}
+		}
+		// strip the leading slashes of the path and of naively constructed
+		// URLs with a double slash between host name and request, encoded
+		// requests always start with the M of a DER sequence
+		base64RequestBytes = bytes.TrimLeft(base64RequestBytes, "/")
+		if len(base64RequestBytes) == 0 && rs.banner != "" {
+			// health checkers and browsers visiting the root
+			response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(response, rs.banner+"\n")
+			return
+		}
+		requestBody, err = base64.StdEncoding.DecodeString(string(base64RequestBytes))
+		if err != nil {
+			log.Debugf("Error decoding base64 from URL: %s", string(base64RequestBytes))
+			http.Error(response, "malformed OCSP request: invalid base64 encoding", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		requestBody, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			log.Errorf("Problem reading body of POST: %s", err)
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b64Body := base64.StdEncoding.EncodeToString(requestBody)
+	log.Debugf("Received OCSP request: %s", b64Body)
+
+	// all responses after this point are OCSP responses
+	response.Header().Set("Content-Type", "application/ocsp-response")
+
+	ocspRequest, err := ocsp.ParseRequest(requestBody)
+	if err != nil {
+		log.Debugf("Error decoding request body: %s", b64Body)
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write(malformedRequestErrorResponse)
+		return
+	}
+	span.SetAttributes(serialAttribute.String(toVaultSerial(ocspRequest.SerialNumber)))
+
+	var ocspResponse []byte
+	var headers http.Header
+	ocspRequests, parseErr := parseRequests(requestBody)
+	if source, ok := rs.source.(multiRequestSource); ok && parseErr == nil && len(ocspRequests) > 1 {
+		preferred := parsePreferredSignatureAlgorithms(requestBody)
+		ocspResponse, headers, err = source.MultiResponseWithPreferences(ctx, ocspRequests, preferred)
+	} else if source, ok := rs.source.(preferenceSource); ok {
+		preferred := parsePreferredSignatureAlgorithms(requestBody)
+		ocspResponse, headers, err = source.ResponseWithPreferences(ctx, ocspRequest, preferred)
+	} else {
+		ocspResponse, headers, err = rs.source.Response(ocspRequest)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorKindName(err))
+		switch responseStatus(err) {
+		case ocsp.Unauthorized:
+			log.Infof("No response found for request: serial %x, request body %s: %v",
+				ocspRequest.SerialNumber, b64Body, err)
+			response.Write(unauthorizedErrorResponse)
+		case ocsp.Malformed:
+			log.Infof("Malformed request: serial %x, request body %s: %v",
+				ocspRequest.SerialNumber, b64Body, err)
+			response.WriteHeader(http.StatusBadRequest)
+			response.Write(malformedRequestErrorResponse)
+		case ocsp.TryLater:
+			log.Infof("Asking client to retry request: serial %x: %v", ocspRequest.SerialNumber, err)
+			response.Header().Set("Retry-After", rs.retryAfterSeconds())
+			response.WriteHeader(http.StatusServiceUnavailable)
+			response.Write(tryLaterErrorResponse)
+		default:
+			log.Infof("Error retrieving response for request: serial %x, request body %s, error: %s",
+				ocspRequest.SerialNumber, b64Body, err)
+			response.WriteHeader(http.StatusInternalServerError)
+			response.Write(internalErrorErrorResponse)
+		}
+		return
+	}
+
+	parsedResponses, err := parseResponses(ocspResponse)
+	if err != nil {
+		log.Errorf("Error parsing response for serial %x: %s",
+			ocspRequest.SerialNumber, err)
+		response.Write(internalErrorErrorResponse)
+		return
+	}
+	thisUpdate, nextUpdate := responseUpdates(parsedResponses)
+
+	response.Header().Set("Last-Modified", thisUpdate.UTC().Format(http.TimeFormat))
+	response.Header().Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+	maxAge := 0
+	if now := time.Now(); now.Before(nextUpdate) {
+		maxAge = int(nextUpdate.Sub(now) / time.Second)
+	}
+	response.Header().Set("Cache-Control",
+		fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+	response.Header().Set("ETag", responseETag(ocspResponse))
+
+	if headers != nil {
+		overrideHeaders(response, headers)
+	}
+
+	// RFC 7232 requires 304 responses to contain the headers a 200 response
+	// would have
+	if etag := request.Header.Get("If-None-Match"); etag != "" && etag == response.Header().Get("ETag") {
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response.WriteHeader(http.StatusOK)
+	response.Write(ocspResponse)
+}
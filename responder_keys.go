@@ -0,0 +1,335 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+)
+
+// loadResponder reads the responder certificate and key files and checks
+// that they belong together.
+func loadResponder(responderCertFile string, responderKeyFile string) (*x509.Certificate, crypto.Signer, error) {
+	responderCert, err := parseResponderCertificate(responderCertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	responderKey, err := parseResponderKey(responderKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateResponder(responderCert, responderKey); err != nil {
+		return nil, nil, err
+	}
+	return responderCert, responderKey, nil
+}
+
+// loadResponderPEM reads a responder certificate and key from a single PEM
+// file and checks that they belong together.
+func loadResponderPEM(responderPEMFile string) (*x509.Certificate, crypto.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(responderPEMFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read responder PEM data: %v", err)
+	}
+	return parseResponderPEM(pemBytes)
+}
+
+// loadResponderVault reads a responder certificate and key from the PEM
+// encoded certificate and private_key fields of a vault KV secret. Secrets
+// of KV version 2 mounts are read from their data/ path, their fields are
+// nested below data.
+func loadResponderVault(secretPath string) (*x509.Certificate, crypto.Signer, error) {
+	client, err := newVaultClient(nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error initializing vault client: %v", err)
+	}
+	secret, err := client.Logical().Read(secretPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read responder secret %s from vault: %v", secretPath, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil, fmt.Errorf("no responder secret at %s in vault", secretPath)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	certificatePEM, ok := data["certificate"].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("responder secret %s has no certificate field", secretPath)
+	}
+	keyPEM, ok := data["private_key"].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("responder secret %s has no private_key field", secretPath)
+	}
+	return parseResponderPEM([]byte(certificatePEM + "\n" + keyPEM))
+}
+
+// parseResponderPEM parses PEM data containing exactly one responder
+// certificate and key and checks that they belong together.
+func parseResponderPEM(pemBytes []byte) (*x509.Certificate, crypto.Signer, error) {
+	var certificates []*x509.Certificate
+	var keys []crypto.Signer
+	for {
+		var pemBlock *pem.Block
+		pemBlock, pemBytes = pem.Decode(pemBytes)
+		if pemBlock == nil {
+			break
+		}
+		switch pemBlock.Type {
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(pemBlock.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse responder certificate: %v", err)
+			}
+			certificates = append(certificates, certificate)
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse PKCS1 formatted RSA key: %v", err)
+			}
+			keys = append(keys, key)
+		default:
+			return nil, nil, fmt.Errorf("unsupported PEM block %s in responder PEM data", pemBlock.Type)
+		}
+	}
+	if len(certificates) != 1 || len(keys) != 1 {
+		return nil, nil, fmt.Errorf("responder PEM data must contain exactly one certificate and one key, found %d certificates and %d keys",
+			len(certificates), len(keys))
+	}
+	if err := validateResponder(certificates[0], keys[0]); err != nil {
+		return nil, nil, err
+	}
+	return certificates[0], keys[0], nil
+}
+
+// loadResponders loads the primary and, if configured, the secondary
+// responder certificate and key followed by the responders of individual
+// issuers and PKI mounts.
+func loadResponders(config *configuration) ([]responderPair, error) {
+	var responderCert *x509.Certificate
+	var responderKey crypto.Signer
+	var err error
+	switch {
+	case config.ResponderVaultPath != "":
+		responderCert, responderKey, err = loadResponderVault(config.ResponderVaultPath)
+	case config.ResponderPEM != "":
+		responderCert, responderKey, err = loadResponderPEM(config.ResponderPEM)
+	case config.SignerType != signerTypeFile:
+		responderCert, responderKey, err = loadResponderSigner(config)
+	default:
+		responderCert, responderKey, err = loadResponder(config.ResponderCert, config.ResponderKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	responders := []responderPair{{certificate: responderCert, key: &responderKey}}
+	if config.SecondaryResponderCert != "" {
+		secondaryCert, secondaryKey, err := loadResponder(config.SecondaryResponderCert, config.SecondaryResponderKey)
+		if err != nil {
+			return nil, fmt.Errorf("secondary responder: %v", err)
+		}
+		responders = append(responders, responderPair{certificate: secondaryCert, key: &secondaryKey})
+	}
+	for _, issuerResponderPEM := range config.IssuerResponderPEM {
+		issuerCert, issuerKey, err := loadResponderPEM(issuerResponderPEM)
+		if err != nil {
+			return nil, fmt.Errorf("issuer responder %s: %v", issuerResponderPEM, err)
+		}
+		if len(issuerCert.AuthorityKeyId) == 0 {
+			return nil, fmt.Errorf("issuer responder %s has no authority key identifier naming its issuer", issuerResponderPEM)
+		}
+		responders = append(responders, responderPair{certificate: issuerCert, key: &issuerKey, issuerKeyID: issuerCert.AuthorityKeyId})
+	}
+	if config.MountResponders != "" {
+		mountResponders, err := loadMountResponders(config.MountResponders)
+		if err != nil {
+			return nil, err
+		}
+		responders = append(responders, mountResponders...)
+	}
+	signatureAlgorithm, err := parseSignatureAlgorithm(config.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	for _, responder := range responders {
+		if _, _, err := signingParamsForPublicKey((*responder.key).Public(), signatureAlgorithm); err != nil {
+			return nil, fmt.Errorf("responder %v cannot sign with %s: %v",
+				responder.certificate.Subject.CommonName, config.SignatureAlgorithm, err)
+		}
+	}
+	return responders, nil
+}
+
+// mountResponderFiles are the responder certificate and key files of a PKI
+// mount in the -mountResponders file.
+type mountResponderFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// loadMountResponders loads the responders of the JSON file mapping PKI
+// mounts to their responder certificate and key files, like
+// {"team/pki": {"cert": "team.pem", "key": "team.key"}}.
+func loadMountResponders(mountRespondersFile string) ([]responderPair, error) {
+	data, err := ioutil.ReadFile(mountRespondersFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mount responders: %v", err)
+	}
+	var files map[string]mountResponderFiles
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("invalid mount responders %s: %v", mountRespondersFile, err)
+	}
+	pkiMounts := make([]string, 0, len(files))
+	for pkiMount := range files {
+		pkiMounts = append(pkiMounts, pkiMount)
+	}
+	sort.Strings(pkiMounts)
+	responders := make([]responderPair, 0, len(pkiMounts))
+	for _, pkiMount := range pkiMounts {
+		if strings.Trim(pkiMount, "/") == "" {
+			return nil, fmt.Errorf("invalid PKI mount %q in mount responders %s", pkiMount, mountRespondersFile)
+		}
+		responderCert, responderKey, err := loadResponder(files[pkiMount].Cert, files[pkiMount].Key)
+		if err != nil {
+			return nil, fmt.Errorf("responder of %s: %v", pkiMount, err)
+		}
+		responders = append(responders, responderPair{certificate: responderCert, key: &responderKey, pkiMount: strings.Trim(pkiMount, "/")})
+	}
+	return responders, nil
+}
+
+// parseSignatureAlgorithm returns the signature algorithm with the given
+// name like SHA384-RSA or ECDSA-SHA384. An empty name selects the default
+// algorithm for the responder key.
+func parseSignatureAlgorithm(name string) (x509.SignatureAlgorithm, error) {
+	if name == "" {
+		return x509.UnknownSignatureAlgorithm, nil
+	}
+	for _, details := range signatureAlgorithmDetails {
+		if strings.EqualFold(details.algo.String(), name) {
+			return details.algo, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s", name)
+}
+
+// reloadResponderOnSignal re-reads the responder certificate and key files
+// whenever the process receives SIGHUP. The current responder is kept if
+// the new files are unusable.
+func reloadResponderOnSignal(config *configuration, mounts *mountSet) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info("Received SIGHUP, reloading responder certificate and key")
+		responders, err := loadResponders(config)
+		if err != nil {
+			log.Errorf("Keeping current responder certificate and key, reload failed: %v", err)
+			continue
+		}
+		mounts.setResponders(responders)
+		for _, responder := range responders {
+			log.Infof("Reloaded responder certificate %v valid until %s",
+				responder.certificate.Subject.CommonName, responder.certificate.NotAfter)
+		}
+	}
+}
+
+func parseResponderKey(responderKeyFile string) (responderKey crypto.Signer, err error) {
+	pemBytes, err := ioutil.ReadFile(responderKeyFile)
+	if err != nil {
+		err = fmt.Errorf("could not read responder key data: %v", err)
+		return
+	}
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil {
+		err = errors.New("could not decode PEM data for responder key")
+		return
+	}
+	responderKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		err = fmt.Errorf("could not parse PKCS1 formatted RSA key: %v", err)
+		return
+	}
+	return
+}
+
+func parseResponderCertificate(responderCertFile string) (responderCert *x509.Certificate, err error) {
+	pemBytes, err := ioutil.ReadFile(responderCertFile)
+	if err != nil {
+		err = fmt.Errorf("could not read responder certificate data: %v", err)
+		return
+	}
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil {
+		err = errors.New("could not decode PEM data for responder certificate")
+		return
+	}
+	responderCert, err = x509.ParseCertificate(pemBlock.Bytes)
+	if err != nil {
+		err = fmt.Errorf("could not parse responder certificate: %v", err)
+		return
+	}
+	return
+}
+
+// validateResponder checks that the responder key belongs to the responder
+// certificate. A missing OCSP signing extended key usage is logged but not
+// treated as an error.
+func validateResponder(responderCert *x509.Certificate, responderKey crypto.Signer) error {
+	publicKey, ok := responderKey.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !publicKey.Equal(responderCert.PublicKey) {
+		return errors.New("responder key does not match the public key of the responder certificate")
+	}
+	for _, usage := range responderCert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return nil
+		}
+	}
+	log.Warningf(
+		"Responder certificate %v has no OCSP signing extended key usage, clients will most likely reject responses",
+		responderCert.Subject.CommonName)
+	return nil
+}
+
+// checkResponderExpiry returns an error if the responder certificate is
+// expired and logs a warning if it expires within the warning window.
+func checkResponderExpiry(responderCert *x509.Certificate, warningWindow time.Duration, now time.Time) error {
+	if now.After(responderCert.NotAfter) {
+		return fmt.Errorf("responder certificate %v expired at %s", responderCert.Subject.CommonName, responderCert.NotAfter)
+	}
+	if now.Add(warningWindow).After(responderCert.NotAfter) {
+		log.Warningf("Responder certificate %v expires at %s, renew it soon",
+			responderCert.Subject.CommonName, responderCert.NotAfter)
+	}
+	return nil
+}
+
+func watchResponderExpiry(responderCertificates func() []*x509.Certificate, warningWindow time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, responderCert := range responderCertificates() {
+			if err := checkResponderExpiry(responderCert, warningWindow, now); err != nil {
+				log.Errorf("Responder certificate problem: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestValidateResponder(t *testing.T) {
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+
+	t.Run("matching pair", func(t *testing.T) {
+		logger := captureLog(t)
+		if err := validateResponder(pki.responder, pki.responderKey); err != nil {
+			t.Fatal(err)
+		}
+		if logger.contains("no OCSP signing extended key usage") {
+			t.Error("warned about the extended key usage of an OCSP signing certificate")
+		}
+	})
+
+	t.Run("mismatched pair", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateResponder(pki.responder, otherKey); err == nil {
+			t.Fatal("accepted a key of another certificate")
+		}
+	})
+
+	t.Run("no OCSP signing usage", func(t *testing.T) {
+		logger := captureLog(t)
+		certificate := createTestCertificate(t, &x509.Certificate{
+			SerialNumber: nextTestSerial(),
+			Subject:      pkix.Name{CommonName: "Server"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, pki.ca, pki.responderKey.Public(), pki.caKey)
+		if err := validateResponder(certificate, pki.responderKey); err != nil {
+			t.Fatal(err)
+		}
+		if !logger.contains("no OCSP signing extended key usage") {
+			t.Error("missing warning about the extended key usage")
+		}
+	})
+}
+
+func TestCheckResponderExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		expired  bool
+		warning  bool
+	}{
+		{"expired", now.Add(-time.Hour), true, false},
+		{"near expiry", now.Add(24 * time.Hour), false, true},
+		{"healthy", now.Add(60 * 24 * time.Hour), false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := captureLog(t)
+			certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "Responder"}, NotAfter: test.notAfter}
+			err := checkResponderExpiry(certificate, 7*24*time.Hour, now)
+			if (err != nil) != test.expired {
+				t.Errorf("got error %v, want expired %v", err, test.expired)
+			}
+			if warned := logger.contains("renew it soon"); warned != test.warning {
+				t.Errorf("got warning %v, want %v", warned, test.warning)
+			}
+		})
+	}
+}
+
+func TestReloadResponderOnSignal(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	source := mounts.sources()[0]
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+	if _, _, err := source.Response(request); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newResponder := pki.issueResponder(t, time.Now().Add(24*time.Hour), newKey)
+	certificateFile, keyFile := writeResponderFiles(t, newResponder, newKey)
+	config := newTestConfiguration(t, "-responderCert", certificateFile, "-responderKey", keyFile)
+
+	// SIGHUP must not end the test before the reload listens for it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	go reloadResponderOnSignal(config, mounts)
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !mounts.responderCertificates()[0].Equal(newResponder) {
+		if time.Now().After(deadline) {
+			t.Fatal("responder was not reloaded")
+		}
+		if err := process.Signal(syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	der, _, err := source.Response(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ocsp.ParseResponse(der, pki.ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Certificate.Equal(newResponder) {
+		t.Errorf("response carries responder %v, want the reloaded one", response.Certificate.Subject)
+	}
+	if err := response.CheckSignatureFrom(newResponder); err != nil {
+		t.Errorf("response is not signed with the reloaded key: %v", err)
+	}
+}
+
+func TestMountResponders(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	teamKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamResponder := pki.issueResponder(t, time.Now().Add(24*time.Hour), teamKey)
+	teamCertificateFile, teamKeyFile := writeResponderFiles(t, teamResponder, teamKey)
+	mountRespondersFile := filepath.Join(t.TempDir(), "mount-responders.json")
+	mapping := `{"team/pki": {"cert": "` + teamCertificateFile + `", "key": "` + teamKeyFile + `"}}`
+	if err := ioutil.WriteFile(mountRespondersFile, []byte(mapping), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificateFile, keyFile := writeResponderFiles(t, pki.responder, pki.responderKey)
+	config := newTestConfiguration(t, "-responderCert", certificateFile, "-responderKey", keyFile, "-mountResponders", mountRespondersFile)
+	responders, err := loadResponders(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := newMountSet(mountSettings{config: config, serialStyle: vaultSerialStyle}, responders, nil)
+	t.Cleanup(func() {
+		for _, source := range mounts.sources() {
+			source.stop()
+		}
+	})
+	for _, pkiMount := range []string{"pki", "team/pki"} {
+		vault.addPKIMount(pkiMount, pki)
+		if err := mounts.add(pkiMount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for _, test := range []struct {
+			pkiMount  string
+			responder *x509.Certificate
+		}{
+			{"pki", pki.responder},
+			{"team/pki", teamResponder},
+		} {
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate(test.pkiMount, certificate, time.Time{})
+			source := mounts.mounts[test.pkiMount].source
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := ocsp.ParseResponse(der, pki.ca)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !response.Certificate.Equal(test.responder) {
+				t.Errorf("response of %s carries responder %v, want %v", test.pkiMount, response.Certificate.SerialNumber, test.responder.SerialNumber)
+			}
+		}
+	}
+	check(t)
+	// reloaded responders keep the mapping
+	mounts.setResponders(responders)
+	check(t)
+
+	if err := ioutil.WriteFile(mountRespondersFile, []byte(`{"team/pki": {"cert": "`+teamCertificateFile+`"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadResponders(config); err == nil {
+		t.Error("loaded a mount responder without key")
+	}
+}
+
+func TestSignatureAlgorithm(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+	for _, name := range []string{"SHA384-RSA", "SHA512-RSA"} {
+		t.Run(name, func(t *testing.T) {
+			algorithm, err := parseSignatureAlgorithm(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source.signatureAlgorithm = algorithm
+			der, _, err := source.buildOkResponse(context.Background(), pki.ca, request, time.Now().Add(time.Hour), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.SignatureAlgorithm != algorithm {
+				t.Errorf("response is signed with %v, want %v", response.SignatureAlgorithm, algorithm)
+			}
+		})
+	}
+}
+
+func TestSignatureAlgorithmOfOtherKeyType(t *testing.T) {
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificateFile, keyFile := writeResponderFiles(t, pki.responder, pki.responderKey)
+	config := newTestConfiguration(t, "-responderCert", certificateFile, "-responderKey", keyFile, "-signatureAlgorithm", "ECDSA-SHA384")
+	if _, err := loadResponders(config); err == nil {
+		t.Error("accepted an ECDSA algorithm for an RSA responder key")
+	}
+	if _, err := parseSignatureAlgorithm("MD5-RSA-PLUS"); err == nil {
+		t.Error("accepted an unknown algorithm")
+	}
+}
+
+func TestLoadResponderPEM(t *testing.T) {
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificatePEM := pemCertificate(pki.responder)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pki.responderKey.(*rsa.PrivateKey))}))
+	tests := []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{"certificate and key", certificatePEM + keyPEM, true},
+		{"key and certificate", keyPEM + certificatePEM, true},
+		{"missing key", certificatePEM, false},
+		{"missing certificate", keyPEM, false},
+		{"two certificates", certificatePEM + pemCertificate(pki.ca) + keyPEM, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "responder.pem")
+			if err := ioutil.WriteFile(file, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			certificate, _, err := loadResponderPEM(file)
+			if !test.valid {
+				if err == nil {
+					t.Error("accepted incomplete responder PEM data")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !certificate.Equal(pki.responder) {
+				t.Errorf("loaded certificate %v, want the responder", certificate.Subject)
+			}
+		})
+	}
+}
+
+func TestLoadResponderVault(t *testing.T) {
+	vault := newFakeVault(t)
+	useFakeVault(t, vault)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	material := map[string]interface{}{
+		"certificate": pemCertificate(pki.responder),
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pki.responderKey.(*rsa.PrivateKey))})),
+	}
+	vault.set("secret/data/ocsp", map[string]interface{}{"data": material, "metadata": map[string]interface{}{"version": 1}})
+	vault.set("kv/ocsp", material)
+	vault.set("secret/data/nokey", map[string]interface{}{"data": map[string]interface{}{"certificate": material["certificate"]}})
+	tests := []struct {
+		name  string
+		path  string
+		valid bool
+	}{
+		{"KV version 2", "secret/data/ocsp", true},
+		{"KV version 1", "kv/ocsp", true},
+		{"missing key", "secret/data/nokey", false},
+		{"missing secret", "secret/data/missing", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responders, err := loadResponders(newTestConfiguration(t, "-responderVaultPath", test.path))
+			if !test.valid {
+				if err == nil {
+					t.Error("accepted an incomplete responder secret")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !responders[0].certificate.Equal(pki.responder) {
+				t.Errorf("loaded certificate %v, want the responder", responders[0].certificate.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// marshalRequest returns the DER encoding of the OCSP request.
+func marshalRequest(t *testing.T, request *ocsp.Request) []byte {
+	t.Helper()
+	der, err := request.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// postOCSP posts the DER encoded OCSP request with the extra headers to the
+// handler.
+func postOCSP(handler http.Handler, der []byte, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(der))
+	request.Header.Set("Content-Type", "application/ocsp-request")
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestETag(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	config := newTestConfiguration(t)
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	handler := ocspHandler(config, source)
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+
+	first := postOCSP(handler, der, nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if want := responseETag(first.Body.Bytes()); etag != want {
+		t.Fatalf("got ETag %s, want %s", etag, want)
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		recorder := postOCSP(handler, der, http.Header{"If-None-Match": {etag}})
+		if recorder.Code != http.StatusNotModified {
+			t.Fatalf("got status %d, want 304", recorder.Code)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Errorf("304 response has a body of %d bytes", recorder.Body.Len())
+		}
+		if recorder.Header().Get("ETag") != etag {
+			t.Errorf("got ETag %s, want %s", recorder.Header().Get("ETag"), etag)
+		}
+	})
+
+	t.Run("not matching", func(t *testing.T) {
+		recorder := postOCSP(handler, der, http.Header{"If-None-Match": {`"00"`}})
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", recorder.Code)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), first.Body.Bytes()) {
+			t.Error("cached response differs from the first response")
+		}
+	})
+}
+
+func TestErrorResponses(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t)
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	handler := ocspHandler(config, source)
+	tests := []struct {
+		name    string
+		der     []byte
+		failing bool
+		status  ocsp.ResponseStatus
+	}{
+		{"unparseable request", []byte("no OCSP request"), false, ocsp.Malformed},
+		{"issuer mismatch", marshalRequest(t, other.request(t, nextTestSerial(), crypto.SHA1)), false, ocsp.Unauthorized},
+		{"unknown serial", marshalRequest(t, pki.request(t, nextTestSerial(), crypto.SHA1)), false, ocsp.Unauthorized},
+		{"vault unavailable", marshalRequest(t, pki.request(t, nextTestSerial(), crypto.SHA1)), true, ocsp.TryLater},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault.setFailing(test.failing)
+			recorder := postOCSP(handler, test.der, nil)
+			_, err := ocsp.ParseResponse(recorder.Body.Bytes(), nil)
+			responseErr, ok := err.(ocsp.ResponseError)
+			if !ok {
+				t.Fatalf("got %v, want an OCSP error response", err)
+			}
+			if responseErr.Status != test.status {
+				t.Errorf("got response status %v, want %v", responseErr.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestRetryAfterDuringVaultOutage(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-retryAfter", "30s", "-retryAfterJitter", "10s")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	handler := ocspHandler(config, source)
+	vault.setFailing(true)
+
+	for i := 0; i < 10; i++ {
+		recorder := postOCSP(handler, marshalRequest(t, pki.request(t, nextTestSerial(), crypto.SHA1)), nil)
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Fatalf("got status %d, want 503", recorder.Code)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), tryLaterErrorResponse) {
+			t.Fatalf("got %x, want a tryLater response", recorder.Body.Bytes())
+		}
+		retryAfter, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatalf("invalid Retry-After %q: %v", recorder.Header().Get("Retry-After"), err)
+		}
+		if retryAfter < 30 || retryAfter > 40 {
+			t.Errorf("got Retry-After %d, want 30 to 40 seconds", retryAfter)
+		}
+	}
+}
+
+func TestMalformedGETRequests(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	valid := base64.StdEncoding.EncodeToString(marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1)))
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{"valid request", "/pki/" + valid, http.StatusOK, ""},
+		{"garbage segment", "/pki/not*base64!", http.StatusBadRequest, "malformed OCSP request: invalid base64 encoding\n"},
+		{"invalid escaping", "/pki/%zz", http.StatusBadRequest, "malformed OCSP request: invalid URL escaping\n"},
+		{"base64 of no request", "/pki/" + base64.StdEncoding.EncodeToString([]byte("garbage")), http.StatusBadRequest, string(malformedRequestErrorResponse)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the path is set unescaped like a request for an escaped path
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.URL.Path = test.path
+			recorder := httptest.NewRecorder()
+			mounts.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if test.status == http.StatusOK {
+				pki.parse(t, recorder.Body.Bytes())
+				return
+			}
+			if recorder.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", recorder.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestSingleMountAtRoot(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t)
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	routes := newRoutes(ocspHandler(config, source))
+	routes.Handle("/healthz", healthHandler(&healthState{}))
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	encoded := base64.StdEncoding.EncodeToString(der)
+
+	get := httptest.NewRequest(http.MethodGet, "/"+url.PathEscape(encoded), nil)
+	post := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(der))
+	post.Header.Set("Content-Type", "application/ocsp-request")
+	for name, request := range map[string]*http.Request{"GET": get, "POST": post} {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			routes.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", recorder.Code)
+			}
+			if response := pki.parse(t, recorder.Body.Bytes()); response.Status != ocsp.Good {
+				t.Errorf("got status %d, want good", response.Status)
+			}
+		})
+	}
+}
+
+func TestBanner(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t), pki, "pki")
+	vault.addCertificate("pki", certificate, time.Time{})
+	source := mounts.sources()[0]
+	root := ocspHandler(newTestConfiguration(t), source)
+	noBanner := ocspHandler(newTestConfiguration(t, "-banner", ""), source)
+	encoded := url.PathEscape(base64.StdEncoding.EncodeToString(marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))))
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		status  int
+		banner  bool
+	}{
+		{"root", root, "/", http.StatusOK, true},
+		{"root OCSP request", root, "/" + encoded, http.StatusOK, false},
+		{"mount", mounts, "/pki/", http.StatusOK, true},
+		{"mount OCSP request", mounts, "/pki/" + encoded, http.StatusOK, false},
+		{"no banner", noBanner, "/", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+			if !test.banner {
+				if test.status == http.StatusOK {
+					pki.parse(t, recorder.Body.Bytes())
+				}
+				return
+			}
+			if recorder.Body.String() != "vault-ocsp responder\n" {
+				t.Errorf("got body %q, want the banner", recorder.Body.String())
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+				t.Errorf("got Content-Type %q, want text/plain", contentType)
+			}
+		})
+	}
+}
+
+func TestStaplingNextUpdate(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(72*time.Hour))
+	config := newTestConfiguration(t, "-nextUpdate", "1h", "-staplingNextUpdate", "12h")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(48*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	handler := ocspHandler(config, source)
+	encoded := url.PathEscape(base64.StdEncoding.EncodeToString(marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))))
+	tests := []struct {
+		name     string
+		path     string
+		validity time.Duration
+	}{
+		{"live", "/" + encoded, time.Hour},
+		{"stapling", staplingPrefix + "/" + encoded, 12 * time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200", recorder.Code)
+			}
+			response := pki.parse(t, recorder.Body.Bytes())
+			if validity := time.Until(response.NextUpdate); validity < test.validity-time.Minute || validity > test.validity+time.Minute {
+				t.Errorf("got a response valid for %v, want %v", validity, test.validity)
+			}
+		})
+	}
+}
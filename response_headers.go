@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseResponseHeaders parses headers given like "Name: Value" into the
+// headers added to OCSP responses.
+func parseResponseHeaders(headers []string) (http.Header, error) {
+	parsed := http.Header{}
+	for _, header := range headers {
+		separator := strings.Index(header, ":")
+		if separator < 0 {
+			return nil, fmt.Errorf("invalid response header %q, it must look like Name: Value", header)
+		}
+		name, value := header[:separator], strings.TrimSpace(header[separator+1:])
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid response header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value of response header %s", name)
+		}
+		parsed.Add(name, value)
+	}
+	return parsed, nil
+}
+
+// validHeaderName reports whether the name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, char := range name {
+		if char >= 0x7f || char <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, char) {
+			return false
+		}
+	}
+	return true
+}
+
+// addResponseHeaders sets the headers on the responses of the wrapped
+// handler. Headers set by the handler itself replace them, handlers that
+// are wrapped twice do not repeat them.
+func addResponseHeaders(headers http.Header, handler http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range headers {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t,
+		"-responseHeader", "Access-Control-Allow-Origin: *",
+		"-responseHeader", "X-Cache-Tag: ocsp",
+		"-responseHeader", "X-Cache-Tag: pki",
+		"-responseHeader", "Cache-Control: no-store",
+		"-maxRequestBytes", "1024")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	responseHeaders, err := parseResponseHeaders(config.ResponseHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wrapped like main does with a client rate limit
+	handler := addResponseHeaders(responseHeaders, limitClientRate(newClientRateLimit(0.001, 3, nil), ocspHandler(config, source)))
+
+	// checkHeaders checks the configured headers and that the headers of
+	// vault-ocsp are set once
+	checkHeaders := func(name string, recorder *httptest.ResponseRecorder, status int, contentType string) {
+		t.Helper()
+		if recorder.Code != status {
+			t.Errorf("%s: got status %d, want %d", name, recorder.Code, status)
+		}
+		header := recorder.Header()
+		if values := header["Access-Control-Allow-Origin"]; !reflect.DeepEqual(values, []string{"*"}) {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want *", name, values)
+		}
+		if values := header["X-Cache-Tag"]; !reflect.DeepEqual(values, []string{"ocsp", "pki"}) {
+			t.Errorf("%s: got X-Cache-Tag %q, want ocsp and pki", name, values)
+		}
+		if values := header["Content-Type"]; len(values) != 1 || !strings.HasPrefix(values[0], contentType) {
+			t.Errorf("%s: got Content-Type %q, want %s once", name, values, contentType)
+		}
+	}
+
+	der := marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	recorder := postOCSP(handler, der, nil)
+	checkHeaders("good", recorder, http.StatusOK, "application/ocsp-response")
+	if values := recorder.Header()["Cache-Control"]; len(values) != 1 || !strings.HasPrefix(values[0], "max-age=") {
+		t.Errorf("got Cache-Control %q, want the max-age of the response replacing the configured header", values)
+	}
+
+	recorder = postOCSP(handler, marshalRequest(t, pki.request(t, nextTestSerial(), crypto.SHA1)), nil)
+	checkHeaders("unknown serial", recorder, http.StatusOK, "application/ocsp-response")
+	if values := recorder.Header()["Cache-Control"]; !reflect.DeepEqual(values, []string{"max-age=0, no-cache"}) {
+		t.Errorf("got Cache-Control %q for the unauthorized response, want max-age=0, no-cache once", values)
+	}
+
+	recorder = postOCSP(handler, bytes.Repeat([]byte{0x30}, 2048), nil)
+	checkHeaders("oversized request", recorder, http.StatusRequestEntityTooLarge, "text/plain")
+
+	recorder = postOCSP(handler, der, nil)
+	checkHeaders("rate limited", recorder, http.StatusTooManyRequests, "text/plain")
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	for _, header := range []string{"no separator", ": value", "Bad Name: value", "X-Test: a\nb"} {
+		if _, err := parseResponseHeaders([]string{header}); err == nil {
+			t.Errorf("accepted invalid response header %q", header)
+		}
+	}
+	headers, err := parseResponseHeaders([]string{"x-test:  value "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := headers.Get("X-Test"); value != "value" {
+		t.Errorf("got value %q, want value", value)
+	}
+}
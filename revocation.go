@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseRevocationTime extracts the revocation time from vault certificate
+// data. The timezone explicit revocation_time_rfc3339 is preferred, the
+// epoch revocation_time that may be a JSON number, a float or a string is
+// used if the RFC 3339 field is missing. A zero time means that the
+// certificate is not revoked, found is false if the data contains no
+// revocation time at all.
+func parseRevocationTime(data map[string]interface{}) (revocationTime time.Time, found bool, err error) {
+	value, rfc3339Found := data["revocation_time_rfc3339"]
+	if rfc3339Found {
+		rfc3339, ok := value.(string)
+		if !ok {
+			return time.Time{}, true, fmt.Errorf("unsupported revocation_time_rfc3339 type %T", value)
+		}
+		if rfc3339 != "" {
+			revocationTime, err := time.Parse(time.RFC3339, rfc3339)
+			if err != nil {
+				return time.Time{}, true, err
+			}
+			return revocationTime, true, nil
+		}
+		// vault returns an empty string for certificates that are not
+		// revoked, the epoch value is checked anyway to be on the safe side
+	}
+	if value, found := data["revocation_time"]; found {
+		epoch, err := epochSeconds(value)
+		if err != nil {
+			return time.Time{}, true, err
+		}
+		if epoch == 0 {
+			return time.Time{}, true, nil
+		}
+		return time.Unix(epoch, 0), true, nil
+	}
+	return time.Time{}, rfc3339Found, nil
+}
+
+func epochSeconds(value interface{}) (int64, error) {
+	switch epoch := value.(type) {
+	case json.Number:
+		if seconds, err := epoch.Int64(); err == nil {
+			return seconds, nil
+		}
+		seconds, err := epoch.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("could not convert revocation time %s to int64 value", epoch)
+		}
+		return int64(seconds), nil
+	case float64:
+		return int64(epoch), nil
+	case int64:
+		return epoch, nil
+	case int:
+		return int64(epoch), nil
+	case string:
+		if epoch == "" {
+			return 0, nil
+		}
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not convert revocation time %q to int64 value", epoch)
+		}
+		return seconds, nil
+	case nil:
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("unsupported revocation time type %T", value)
+	}
+}
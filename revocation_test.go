@@ -0,0 +1,194 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestParseRevocationTime(t *testing.T) {
+	revoked := time.Unix(1622548800, 0)
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		revoked time.Time
+		found   bool
+		invalid bool
+	}{
+		{"json number", map[string]interface{}{"revocation_time": json.Number("1622548800")}, revoked, true, false},
+		{"json float", map[string]interface{}{"revocation_time": json.Number("1622548800.5")}, revoked, true, false},
+		{"float", map[string]interface{}{"revocation_time": float64(1622548800)}, revoked, true, false},
+		{"int", map[string]interface{}{"revocation_time": 1622548800}, revoked, true, false},
+		{"string", map[string]interface{}{"revocation_time": "1622548800"}, revoked, true, false},
+		{"rfc3339", map[string]interface{}{"revocation_time_rfc3339": "2021-06-01T12:00:00Z"}, revoked, true, false},
+		{"not revoked", map[string]interface{}{"revocation_time": json.Number("0")}, time.Time{}, true, false},
+		{"empty string", map[string]interface{}{"revocation_time": ""}, time.Time{}, true, false},
+		{"null", map[string]interface{}{"revocation_time": nil}, time.Time{}, true, false},
+		{"empty rfc3339", map[string]interface{}{"revocation_time_rfc3339": "", "revocation_time": json.Number("0")}, time.Time{}, true, false},
+		{"missing", map[string]interface{}{"certificate": "..."}, time.Time{}, false, false},
+		{"invalid string", map[string]interface{}{"revocation_time": "yesterday"}, time.Time{}, true, true},
+		{"invalid type", map[string]interface{}{"revocation_time": true}, time.Time{}, true, true},
+		{"invalid rfc3339", map[string]interface{}{"revocation_time_rfc3339": "2021-06-01"}, time.Time{}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			revocationTime, found, err := parseRevocationTime(test.data)
+			if (err != nil) != test.invalid {
+				t.Fatalf("got error %v, want invalid %v", err, test.invalid)
+			}
+			if found != test.found {
+				t.Errorf("got found %v, want %v", found, test.found)
+			}
+			if !revocationTime.Equal(test.revoked) {
+				t.Errorf("got revocation time %s, want %s", revocationTime, test.revoked)
+			}
+		})
+	}
+}
+
+func TestRevokedAtFromVault(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	epoch := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	rfc3339 := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		revoked time.Time
+	}{
+		{"epoch", map[string]interface{}{"revocation_time": epoch.Unix()}, epoch},
+		{"rfc3339", map[string]interface{}{"revocation_time_rfc3339": rfc3339.Format(time.RFC3339)}, rfc3339},
+		{"both", map[string]interface{}{
+			"revocation_time":         epoch.Unix(),
+			"revocation_time_rfc3339": rfc3339.Format(time.RFC3339),
+		}, rfc3339},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			test.data["certificate"] = pemCertificate(certificate)
+			vault.set("pki/cert/"+toVaultSerial(certificate.SerialNumber), test.data)
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			if response.Status != ocsp.Revoked || !response.RevokedAt.Equal(test.revoked) {
+				t.Errorf("got status %d revoked at %s, want revoked at %s", response.Status, response.RevokedAt, test.revoked)
+			}
+		})
+	}
+}
+
+func TestMissingRevocationTime(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	valid := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	expired := pki.issue(t, nextTestSerial(), time.Now().Add(-time.Minute))
+	for _, certificate := range []*x509.Certificate{valid, expired} {
+		vault.set("pki/cert/"+toVaultSerial(certificate.SerialNumber), map[string]interface{}{
+			"certificate": pemCertificate(certificate),
+		})
+	}
+
+	der, _, err := source.Response(pki.request(t, valid.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(der) == 0 {
+		t.Fatal("got an empty response")
+	}
+	if response := pki.parse(t, der); response.Status != ocsp.Good {
+		t.Errorf("got status %d without revocation_time, want good", response.Status)
+	}
+
+	// the expiry is still checked
+	if _, _, err := source.Response(pki.request(t, expired.SerialNumber, crypto.SHA1)); !errors.Is(err, errCertificateExpired) {
+		t.Errorf("got error %v for an expired certificate without revocation_time, want certificate expired", err)
+	}
+}
+
+func TestRevocationTimeZeroWithoutCertificate(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	tests := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"no certificate field", map[string]interface{}{"revocation_time": 0}},
+		{"null certificate", map[string]interface{}{"revocation_time": 0, "certificate": nil}},
+		{"empty certificate", map[string]interface{}{"revocation_time": 0, "certificate": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serial := nextTestSerial()
+			vault.set("pki/cert/"+toVaultSerial(serial), test.data)
+			der, _, err := source.Response(pki.request(t, serial, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(der) == 0 {
+				t.Fatal("got an empty response")
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Good {
+				t.Errorf("got status %d for a known serial without certificate, want good", response.Status)
+			}
+		})
+	}
+}
+
+func TestRevokedNextUpdate(t *testing.T) {
+	for _, validity := range []time.Duration{0, 7 * 24 * time.Hour} {
+		t.Run(validity.String(), func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(30*24*time.Hour))
+			good := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+			revoked := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+			vault.addCertificate("pki", good, time.Time{})
+			vault.addCertificate("pki", revoked, time.Now().Add(-time.Hour))
+			config := newTestConfiguration(t, "-nextUpdate", "1h", "-revokedNextUpdate", validity.String())
+			source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+			fakeClock := useFakeClock(source)
+			now := time.Now().UTC().Truncate(time.Second)
+			fakeClock.Set(now)
+
+			der, _, err := source.Response(pki.request(t, revoked.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			if response.Status != ocsp.Revoked {
+				t.Fatalf("got status %d, want revoked", response.Status)
+			}
+			var want time.Time
+			if validity > 0 {
+				want = now.Add(validity)
+			}
+			if !response.NextUpdate.Equal(want) {
+				t.Errorf("got NextUpdate %v for the revoked certificate, want %v", response.NextUpdate, want)
+			}
+
+			// good responses keep their own window
+			der, _, err = source.Response(pki.request(t, good.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); !response.NextUpdate.Equal(now.Add(time.Hour)) {
+				t.Errorf("got NextUpdate %v for the good certificate, want %v", response.NextUpdate, now.Add(time.Hour))
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net/http"
+)
+
+// routes serves handlers registered for exact paths and hands all other
+// requests to the OCSP handler. Unlike http.ServeMux it does not clean
+// paths, the redirects of http.ServeMux would corrupt base64 encoded GET
+// requests containing "//" and turn POST requests into GET requests.
+type routes struct {
+	exact map[string]http.Handler
+	ocsp  http.Handler
+}
+
+func newRoutes(ocsp http.Handler) *routes {
+	return &routes{exact: make(map[string]http.Handler), ocsp: ocsp}
+}
+
+// Handle registers the handler for requests to exactly the path.
+func (routes *routes) Handle(path string, handler http.Handler) {
+	routes.exact[path] = handler
+}
+
+func (routes *routes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, found := routes.exact[r.URL.Path]; found {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	routes.ocsp.ServeHTTP(w, r)
+}
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// selfTestSerial is the serial number of the sample responses built by the
+// self-test, it is never looked up in vault.
+var selfTestSerial = big.NewInt(1)
+
+// selfTest signs a good response for a sample serial number with each
+// responder and verifies it against each issuer of the source like a client
+// would.
+func (source *VaultSource) selfTest() error {
+	source.responderLock.RLock()
+	responders, issuerResponders := source.responders, source.issuerResponders
+	source.responderLock.RUnlock()
+	issuers, _ := source.currentIssuers()
+	for _, issuer := range issuers {
+		candidates := responders
+		if responder, found := issuerResponders[string(issuer.SubjectKeyId)]; found && len(issuer.SubjectKeyId) > 0 {
+			// responders of other issuers cannot be used for this issuer
+			candidates = []responderPair{responder}
+		}
+		for _, responder := range candidates {
+			now := source.clk.Now()
+			template := ocsp.Response{
+				SerialNumber:       selfTestSerial,
+				Status:             ocsp.Good,
+				ThisUpdate:         now,
+				NextUpdate:         now.Add(source.currentLifetimes().nextUpdate),
+				Certificate:        responder.certificate,
+				SignatureAlgorithm: source.signatureAlgorithm,
+			}
+			response, err := createResponse(issuer, responder.certificate, template, now, *responder.key)
+			if err != nil {
+				return fmt.Errorf("responder %v could not sign a response for issuer %v: %v",
+					responder.certificate.Subject.CommonName, issuer.Subject.CommonName, err)
+			}
+			parsed, err := ocsp.ParseResponseForCert(response, nil, issuer)
+			if err != nil {
+				return fmt.Errorf("response of responder %v does not verify for issuer %v: %v",
+					responder.certificate.Subject.CommonName, issuer.Subject.CommonName, err)
+			}
+			if parsed.Status != ocsp.Good || parsed.SerialNumber.Cmp(selfTestSerial) != 0 {
+				return fmt.Errorf("response of responder %v for issuer %v has unexpected content",
+					responder.certificate.Subject.CommonName, issuer.Subject.CommonName)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	if err := source.selfTest(); err != nil {
+		t.Fatalf("self-test of a working responder failed: %v", err)
+	}
+
+	// the responder of the other CA is not authorized to sign for the CA
+	source.setResponders([]responderPair{{certificate: other.responder, key: &other.responderKey}})
+	if err := source.selfTest(); err == nil {
+		t.Error("self-test passed with the responder of another CA")
+	}
+}
+
+func TestSelfTestAtStartup(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	vault.addPKIMount("pki", pki)
+	useFakeVault(t, vault)
+	responders := []responderPair{{certificate: other.responder, key: &other.responderKey}}
+	tests := []struct {
+		name string
+		args []string
+		fail bool
+	}{
+		{"enabled", nil, true},
+		{"disabled", []string{"-selfTest=false"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounts := newMountSet(mountSettings{config: newTestConfiguration(t, test.args...), serialStyle: vaultSerialStyle}, responders, nil)
+			err := mounts.add("pki")
+			for _, source := range mounts.sources() {
+				source.stop()
+			}
+			if test.fail && (err == nil || !strings.Contains(err.Error(), "self-test failed")) {
+				t.Errorf("got error %v, want a failed self-test", err)
+			}
+			if !test.fail && err != nil {
+				t.Errorf("mount without self-test failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+)
+
+const (
+	signerTypeFile   = "file"
+	signerTypePKCS11 = "pkcs11"
+)
+
+// signerLoaders return the responder signing key for each supported
+// -signerType. Keys that do not live in a file only need to implement
+// crypto.Signer.
+var signerLoaders = map[string]func(config *configuration) (crypto.Signer, error){
+	signerTypeFile: func(config *configuration) (crypto.Signer, error) {
+		return parseResponderKey(config.ResponderKey)
+	},
+	signerTypePKCS11: loadPKCS11Signer,
+}
+
+// loadResponderSigner reads the responder certificate file and obtains the
+// matching signing key from the configured signer type.
+func loadResponderSigner(config *configuration) (*x509.Certificate, crypto.Signer, error) {
+	responderCert, err := parseResponderCertificate(config.ResponderCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	responderKey, err := signerLoaders[config.SignerType](config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load %s responder key: %v", config.SignerType, err)
+	}
+	if err := validateResponder(responderCert, responderKey); err != nil {
+		return nil, nil, err
+	}
+	return responderCert, responderKey, nil
+}
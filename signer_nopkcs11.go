@@ -0,0 +1,19 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// loadPKCS11Signer fails in builds without PKCS#11 support, which needs cgo
+// and is enabled with the pkcs11 build tag.
+func loadPKCS11Signer(config *configuration) (crypto.Signer, error) {
+	return nil, errors.New("vault-ocsp was built without PKCS#11 support, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,53 @@
+//go:build pkcs11
+// +build pkcs11
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+var (
+	pkcs11Lock    sync.Mutex
+	pkcs11Context *crypto11.Context
+)
+
+// loadPKCS11Signer finds the responder key pair by its label on the
+// configured PKCS#11 token. The token session is opened once and shared by
+// later reloads.
+func loadPKCS11Signer(config *configuration) (crypto.Signer, error) {
+	if config.PKCS11Module == "" || config.PKCS11KeyLabel == "" {
+		return nil, errors.New("you have to specify a PKCS#11 module and key label")
+	}
+	pkcs11Lock.Lock()
+	defer pkcs11Lock.Unlock()
+	if pkcs11Context == nil {
+		slot := config.PKCS11Slot
+		context, err := crypto11.Configure(&crypto11.Config{
+			Path:       config.PKCS11Module,
+			SlotNumber: &slot,
+			Pin:        config.PKCS11PIN,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open PKCS#11 token: %v", err)
+		}
+		pkcs11Context = context
+	}
+	signer, err := pkcs11Context.FindKeyPair(nil, []byte(config.PKCS11KeyLabel))
+	if err != nil {
+		return nil, fmt.Errorf("could not find PKCS#11 key %s: %v", config.PKCS11KeyLabel, err)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("no PKCS#11 key labelled %s", config.PKCS11KeyLabel)
+	}
+	return signer, nil
+}
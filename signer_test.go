@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockSigner counts the signatures made with the wrapped key, like a key
+// in an HSM it is only available as crypto.Signer.
+type mockSigner struct {
+	key        crypto.Signer
+	signatures int64
+}
+
+func (signer *mockSigner) Public() crypto.PublicKey {
+	return signer.key.Public()
+}
+
+func (signer *mockSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	atomic.AddInt64(&signer.signatures, 1)
+	return signer.key.Sign(rand, digest, opts)
+}
+
+func TestResponderSigner(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	signer := &mockSigner{key: pki.responderKey}
+	signerLoaders["mock"] = func(config *configuration) (crypto.Signer, error) { return signer, nil }
+	defer delete(signerLoaders, "mock")
+	certificateFile, _ := writeResponderFiles(t, pki.responder, pki.responderKey)
+
+	responders, err := loadResponders(newTestConfiguration(t, "-signerType", "mock", "-responderCert", certificateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responders[0].certificate == nil || *responders[0].key != crypto.Signer(signer) {
+		t.Fatal("responder does not use the key of the signer type")
+	}
+	source.setResponders(responders)
+	der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.parse(t, der)
+	if signatures := atomic.LoadInt64(&signer.signatures); signatures != 1 {
+		t.Errorf("signer made %d signatures, want 1 for the response", signatures)
+	}
+}
@@ -0,0 +1,36 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// staplingPrefix is the path prefix of OCSP requests of servers that staple
+// responses, their good responses are valid for -staplingNextUpdate.
+const staplingPrefix = "/staple"
+
+type staplingKey struct{}
+
+// withStapling marks the lookups of the context as stapling lookups.
+func withStapling(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staplingKey{}, true)
+}
+
+// isStapling returns whether the context is of a stapling lookup.
+func isStapling(ctx context.Context) bool {
+	stapling, _ := ctx.Value(staplingKey{}).(bool)
+	return stapling
+}
+
+// trimStaplingPrefix removes the stapling prefix from a request path, found
+// is false for paths outside of it.
+func trimStaplingPrefix(path string) (trimmed string, found bool) {
+	if path != staplingPrefix && !strings.HasPrefix(path, staplingPrefix+"/") {
+		return path, false
+	}
+	return strings.TrimPrefix(path, staplingPrefix), true
+}
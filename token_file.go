@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hashicorp/vault/api"
+)
+
+// tokenFileCheckInterval is the interval for re-reading the token file.
+const tokenFileCheckInterval = 10 * time.Second
+
+// tokenClients keeps the token of all registered vault clients in sync.
+type tokenClients struct {
+	lock    sync.Mutex
+	token   string
+	clients map[*api.Client]bool
+}
+
+// vaultTokens holds the token all vault clients use, nil if the token is
+// taken from the environment.
+var vaultTokens *tokenClients
+
+func newTokenClients(token string) *tokenClients {
+	return &tokenClients{token: token, clients: make(map[*api.Client]bool)}
+}
+
+// register sets the current token on the client and keeps it updated.
+func (tokens *tokenClients) register(client *api.Client) {
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+	client.SetToken(tokens.token)
+	tokens.clients[client] = true
+}
+
+// unregister stops updating the token of a client that is no longer used.
+func (tokens *tokenClients) unregister(client *api.Client) {
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+	delete(tokens.clients, client)
+}
+
+// set sets a changed token on all clients and returns the number of
+// clients updated.
+func (tokens *tokenClients) set(token string) int {
+	tokens.lock.Lock()
+	defer tokens.lock.Unlock()
+	if token == tokens.token {
+		return 0
+	}
+	tokens.token = token
+	for client := range tokens.clients {
+		client.SetToken(token)
+	}
+	return len(tokens.clients)
+}
+
+// tokenFile is a file with the vault token that is rewritten when the token
+// changes, like the token sink of Vault Agent.
+type tokenFile struct {
+	path   string
+	tokens *tokenClients
+	// stopped is closed when the file is no longer watched
+	stopped chan struct{}
+}
+
+func openTokenFile(path string) (*tokenFile, error) {
+	token, err := readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenFile{path: path, tokens: newTokenClients(token), stopped: make(chan struct{})}, nil
+}
+
+// stop ends watching the token file.
+func (file *tokenFile) stop() {
+	close(file.stopped)
+}
+
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read vault token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("vault token file is empty")
+	}
+	return token, nil
+}
+
+// watch re-reads the token file in the given interval and sets a changed
+// token on all clients. The previous token is kept if the file cannot be
+// read, for example while it is being replaced.
+func (file *tokenFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			token, err := readTokenFile(file.path)
+			if err != nil {
+				log.Errorf("Keeping current vault token: %v", err)
+				continue
+			}
+			if updated := file.tokens.set(token); updated > 0 {
+				log.Infof("Vault token changed in %s, updated %d clients", file.path, updated)
+			}
+		case <-file.stopped:
+			return
+		}
+	}
+}
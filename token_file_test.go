@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeToken replaces the token file like the sink of Vault Agent.
+func writeToken(t *testing.T, path string, token string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path+".tmp", []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	vault := newFakeVault(t)
+	path := filepath.Join(t.TempDir(), "token")
+	writeToken(t, path, "first-token")
+	file, err := openTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultTokens = file.tokens
+	defer func() { vaultTokens = nil }()
+	client, err := newVaultClient(vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := client.Token(); token != "first-token" {
+		t.Fatalf("got token %q, want the token of the file", token)
+	}
+
+	go file.watch(10 * time.Millisecond)
+	defer file.stop()
+	writeToken(t, path, "second-token")
+	for deadline := time.Now().Add(5 * time.Second); client.Token() != "second-token"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got token %q, want the changed token of the file", client.Token())
+		}
+	}
+
+	if _, err := openTokenFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("opened a missing token file")
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	writeToken(t, empty, "  ")
+	if _, err := openTokenFile(empty); err == nil {
+		t.Error("opened an empty token file")
+	}
+}
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// tracer creates the spans of vault-ocsp. Until tracing is set up the
+// global tracer provider does not record anything.
+var tracer = otel.Tracer("github.com/T-Systems-MMS/vault-ocsp")
+
+// serialAttribute is the span attribute of the requested serial number.
+const serialAttribute = attribute.Key("ocsp.serial")
+
+// setupTracing exports spans to the OTLP/HTTP collector at the endpoint URL
+// like http://localhost:4318 and propagates W3C trace context. The returned
+// function flushes and stops the export.
+func setupTracing(endpoint string) (func(context.Context) error, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenTelemetry endpoint: %v", err)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpointURL.Host)}
+	switch endpointURL.Scheme {
+	case "http":
+		options = append(options, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid OpenTelemetry endpoint %s, it must be an http or https URL", endpoint)
+	}
+	if endpointURL.Path != "" && endpointURL.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(endpointURL.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OpenTelemetry exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("vault-ocsp"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans records the spans of the tracer in memory. The tracer keeps
+// the first tracer provider set, so all tests share one recorder.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spanRecorder
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans()
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t)
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	serial := toVaultSerial(certificate.SerialNumber)
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	header := http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}}
+	if recorder := postOCSP(ocspHandler(config, source), marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1)), header); recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	for _, name := range []string{"ocsp.request", "vault_ocsp.fetch", "vault.read", "ocsp.sign"} {
+		if _, found := spans[name]; !found {
+			t.Errorf("no %s span in the trace of the request", name)
+		}
+	}
+	for _, name := range []string{"ocsp.request", "vault_ocsp.fetch", "vault.read"} {
+		span, found := spans[name]
+		if !found {
+			continue
+		}
+		var spanSerial string
+		for _, attribute := range span.Attributes() {
+			if attribute.Key == serialAttribute {
+				spanSerial = attribute.Value.AsString()
+			}
+		}
+		if spanSerial != serial {
+			t.Errorf("got serial attribute %q on the %s span, want %s", spanSerial, name, serial)
+		}
+	}
+	if request, found := spans["ocsp.request"]; found && request.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("got parent span %s, want the span of the traceparent header", request.Parent().SpanID())
+	}
+}
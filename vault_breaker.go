@@ -0,0 +1,143 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/jmhodges/clock"
+)
+
+// errVaultCircuitOpen is returned for lookups that do not read from vault
+// because vault is failing, clients are asked to retry.
+var errVaultCircuitOpen = errors.New("vault reads suspended after repeated failures")
+
+type circuitState int
+
+const (
+	// circuitClosed lets all vault reads through
+	circuitClosed circuitState = iota
+	// circuitOpen fails vault reads without trying until the cooldown is
+	// over
+	circuitOpen
+	// circuitHalfOpen lets a single probe read through, its result closes
+	// or opens the circuit again
+	circuitHalfOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// vaultBreaker is a circuit breaker for the vault reads of a mount. After
+// threshold consecutive failed reads it opens for the cooldown, then a
+// probe read decides whether it closes again. A nil breaker lets all reads
+// through.
+type vaultBreaker struct {
+	pkiMount  string
+	threshold int
+	cooldown  time.Duration
+	clk       clock.Clock
+
+	lock     sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newVaultBreaker(pkiMount string, threshold int, cooldown time.Duration, clk clock.Clock) *vaultBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &vaultBreaker{pkiMount: pkiMount, threshold: threshold, cooldown: cooldown, clk: clk}
+}
+
+// allow returns errVaultCircuitOpen if the read must not be tried. Allowed
+// reads must be followed by a call to done or, if they are not tried after
+// all, cancel.
+func (breaker *vaultBreaker) allow() error {
+	if breaker == nil {
+		return nil
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	switch breaker.state {
+	case circuitOpen:
+		if breaker.clk.Now().Sub(breaker.openedAt) < breaker.cooldown {
+			vaultReadsRejected.Add(1)
+			return errVaultCircuitOpen
+		}
+		breaker.setState(circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if breaker.probing {
+			vaultReadsRejected.Add(1)
+			return errVaultCircuitOpen
+		}
+		breaker.probing = true
+	}
+	return nil
+}
+
+// done records the result of an allowed read.
+func (breaker *vaultBreaker) done(err error) {
+	if breaker == nil {
+		return
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if breaker.state == circuitHalfOpen {
+		breaker.probing = false
+		if err != nil {
+			breaker.open()
+			return
+		}
+		breaker.setState(circuitClosed)
+		breaker.failures = 0
+		return
+	}
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.state == circuitClosed && breaker.failures >= breaker.threshold {
+		breaker.open()
+	}
+}
+
+// cancel gives up an allowed read without result, another probe may be
+// tried in its place.
+func (breaker *vaultBreaker) cancel() {
+	if breaker == nil {
+		return
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.probing = false
+}
+
+func (breaker *vaultBreaker) open() {
+	breaker.openedAt = breaker.clk.Now()
+	breaker.setState(circuitOpen)
+}
+
+func (breaker *vaultBreaker) setState(state circuitState) {
+	if state == breaker.state {
+		return
+	}
+	log.Warningf("Vault circuit breaker of %s changed from %s to %s", breaker.pkiMount, breaker.state, state)
+	breaker.state = state
+}
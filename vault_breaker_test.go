@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVaultBreaker(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	fakeClock := useFakeClock(source)
+	breaker := newVaultBreaker("pki", 2, time.Minute, fakeClock)
+	source.vaultBreaker = breaker
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+	path := "pki/cert/" + toVaultSerial(certificate.SerialNumber)
+
+	// lookup asks for the certificate and checks the vault reads and the
+	// state of the breaker afterwards
+	lookup := func(step string, wantErr error, reads int, state circuitState) {
+		t.Helper()
+		if _, _, err := source.Response(request); !errors.Is(err, wantErr) {
+			t.Fatalf("%s: got error %v, want %v", step, err, wantErr)
+		}
+		if got := vault.readCount(path); got != reads {
+			t.Errorf("%s: got %d vault reads, want %d", step, got, reads)
+		}
+		if breaker.state != state {
+			t.Errorf("%s: breaker is %s, want %s", step, breaker.state, state)
+		}
+	}
+
+	vault.setFailing(true)
+	lookup("first failure", errVaultUnavailable, 1, circuitClosed)
+	lookup("threshold reached", errVaultUnavailable, 2, circuitOpen)
+	lookup("open", errVaultCircuitOpen, 2, circuitOpen)
+
+	fakeClock.Add(time.Minute)
+	lookup("failed probe", errVaultUnavailable, 3, circuitOpen)
+	lookup("reopened", errVaultCircuitOpen, 3, circuitOpen)
+
+	fakeClock.Add(time.Minute)
+	vault.setFailing(false)
+	lookup("successful probe", nil, 4, circuitClosed)
+	// the good response is cached, a failing vault is not read again
+	vault.setFailing(true)
+	lookup("closed", nil, 4, circuitClosed)
+
+	t.Run("half-open", func(t *testing.T) {
+		breaker := newVaultBreaker("pki", 1, time.Minute, fakeClock)
+		breaker.done(errors.New("vault is down"))
+		fakeClock.Add(time.Minute)
+		if err := breaker.allow(); err != nil {
+			t.Fatalf("probe rejected after the cooldown: %v", err)
+		}
+		if breaker.state != circuitHalfOpen {
+			t.Errorf("breaker is %s while probing, want half-open", breaker.state)
+		}
+		if err := breaker.allow(); !errors.Is(err, errVaultCircuitOpen) {
+			t.Errorf("got error %v for a second probe, want %v", err, errVaultCircuitOpen)
+		}
+		// a cancelled probe lets another one through
+		breaker.cancel()
+		if err := breaker.allow(); err != nil {
+			t.Errorf("probe rejected after a cancelled probe: %v", err)
+		}
+	})
+
+	if newVaultBreaker("pki", 0, time.Minute, fakeClock) != nil {
+		t.Error("created a breaker without threshold")
+	}
+}
@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	rootcerts "github.com/hashicorp/go-rootcerts"
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultRootCAs verify the TLS certificate of vault instead of the CAs from
+// the environment or the system if set.
+var vaultRootCAs *x509.CertPool
+
+// loadVaultRootCAs reads the CA certificates for verifying vault's TLS
+// certificate from a PEM file and a directory of PEM files.
+func loadVaultRootCAs(caCert string, caPath string) (*x509.CertPool, error) {
+	pool, err := rootcerts.LoadCACerts(&rootcerts.Config{CAFile: caCert, CAPath: caPath})
+	if err != nil {
+		return nil, fmt.Errorf("could not load vault CA certificates: %v", err)
+	}
+	if pool == nil {
+		return nil, errors.New("no vault CA certificates configured")
+	}
+	return pool, nil
+}
+
+// newVaultClient creates a vault client from the configuration, or from
+// the environment if it is nil. The client verifies vault with the vault
+// root CAs and uses the token of the token file or login if they are
+// configured.
+func newVaultClient(config *api.Config) (*api.Client, error) {
+	if config == nil {
+		config = api.DefaultConfig()
+		if config.Error != nil {
+			return nil, config.Error
+		}
+	}
+	if vaultRootCAs != nil {
+		transport, ok := config.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("cannot set vault CA certificates on a %T", config.HttpClient.Transport)
+		}
+		transport.TLSClientConfig.RootCAs = vaultRootCAs
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if vaultTokens != nil {
+		vaultTokens.register(client)
+	}
+	return client, nil
+}
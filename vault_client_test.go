@@ -0,0 +1,67 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultRootCAs(t *testing.T) {
+	vault := newFakeVault(t)
+	vault.set("secret/test", map[string]interface{}{"value": "read over TLS"})
+	server := httptest.NewTLSServer(vault)
+	defer server.Close()
+	caDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(caDir, "vault-ca.pem"), []byte(pemCertificate(server.Certificate())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vaultRootCAs = nil })
+	tests := []struct {
+		name   string
+		caCert string
+		caPath string
+	}{
+		{"CA file", filepath.Join(caDir, "vault-ca.pem"), ""},
+		{"CA directory", "", caDir},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if vaultRootCAs, err = loadVaultRootCAs(test.caCert, test.caPath); err != nil {
+				t.Fatal(err)
+			}
+			config := vault.config()
+			config.Address = server.URL
+			client, err := newVaultClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secret, err := client.Logical().Read("secret/test")
+			if err != nil {
+				t.Fatalf("read with the vault CA failed: %v", err)
+			}
+			if secret == nil || secret.Data["value"] != "read over TLS" {
+				t.Errorf("got secret %v, want the test secret", secret)
+			}
+		})
+	}
+
+	vaultRootCAs = nil
+	config := vault.config()
+	config.Address = server.URL
+	client, err := newVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Read("secret/test"); err == nil {
+		t.Error("vault certificate verified without the vault CA")
+	}
+	if _, err := loadVaultRootCAs("", ""); err == nil {
+		t.Error("loaded vault CA certificates without file or directory")
+	}
+}
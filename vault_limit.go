@@ -0,0 +1,62 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errVaultBusy is returned for lookups that could not read from vault
+// because of the concurrent vault read limit, clients are asked to retry.
+var errVaultBusy = errors.New("too many concurrent vault reads")
+
+// vaultReadLimit bounds the number of concurrent vault reads. Reads that
+// cannot start wait up to queueTimeout for a slot. The zero value does not
+// limit reads.
+type vaultReadLimit struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newVaultReadLimit(maxReads int, queueTimeout time.Duration) vaultReadLimit {
+	if maxReads <= 0 {
+		return vaultReadLimit{}
+	}
+	return vaultReadLimit{slots: make(chan struct{}, maxReads), queueTimeout: queueTimeout}
+}
+
+// acquire reserves a slot for a vault read, it returns errVaultBusy if no
+// slot became available in time. Successful calls must be followed by a
+// call to release.
+func (limit vaultReadLimit) acquire() error {
+	if limit.slots == nil {
+		return nil
+	}
+	select {
+	case limit.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if limit.queueTimeout <= 0 {
+		vaultReadsRejected.Add(1)
+		return errVaultBusy
+	}
+	timer := time.NewTimer(limit.queueTimeout)
+	defer timer.Stop()
+	select {
+	case limit.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		vaultReadsRejected.Add(1)
+		return errVaultBusy
+	}
+}
+
+func (limit vaultReadLimit) release() {
+	if limit.slots != nil {
+		<-limit.slots
+	}
+}
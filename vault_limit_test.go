@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// responseStatuses sends the requests concurrently and returns the OCSP
+// response status of each lookup.
+func responseStatuses(source *VaultSource, requests []*ocsp.Request) []ocsp.ResponseStatus {
+	statuses := make([]ocsp.ResponseStatus, len(requests))
+	var wait sync.WaitGroup
+	for i, request := range requests {
+		wait.Add(1)
+		go func(i int, request *ocsp.Request) {
+			defer wait.Done()
+			if _, _, err := source.Response(request); err != nil {
+				statuses[i] = responseStatus(err)
+			}
+		}(i, request)
+	}
+	wait.Wait()
+	return statuses
+}
+
+func TestMaxConcurrentVaultReads(t *testing.T) {
+	tests := []struct {
+		name         string
+		queueTimeout string
+		rejected     bool
+	}{
+		{"queued", "10s", false},
+		{"rejected", "0s", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+			config := newTestConfiguration(t, "-maxConcurrentVaultReads", "2", "-vaultReadQueueTimeout", test.queueTimeout)
+			source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+			var requests []*ocsp.Request
+			for i := 0; i < 10; i++ {
+				certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+				vault.addCertificate("pki", certificate, time.Time{})
+				requests = append(requests, pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			}
+			vault.setDelay(50 * time.Millisecond)
+
+			rejected := 0
+			for _, status := range responseStatuses(source, requests) {
+				switch status {
+				case ocsp.Success:
+				case ocsp.TryLater:
+					rejected++
+				default:
+					t.Errorf("got response status %d", status)
+				}
+			}
+			if reads := vault.maxConcurrentCertReads(); reads > 2 {
+				t.Errorf("got %d concurrent vault reads, want at most 2", reads)
+			}
+			if (rejected > 0) != test.rejected {
+				t.Errorf("got %d requests answered with tryLater, want rejections %v", rejected, test.rejected)
+			}
+		})
+	}
+}
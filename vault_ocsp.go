@@ -5,270 +5,1232 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/asn1"
-	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudflare/cfssl/log"
-	cfocsp "github.com/cloudflare/cfssl/ocsp"
 	"github.com/hashicorp/vault/api"
+	"github.com/jmhodges/clock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ocsp"
+	"golang.org/x/sync/singleflight"
 )
 
 func main() {
-	var pkiMount = flag.String("pkimount", "pki", "vault PKI mount to use")
-	var serverAddr = flag.String("serverAddr", ":8080", "Server IP and Port to use")
-	var responderCertFile = flag.String("responderCert", "", "OCSP responder signing certificate file")
-	var responderKeyFile = flag.String("responderKey", "", "OCSP responder signing private key file")
+	var config configuration
+	if err := config.parse(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Criticalf("%v", err)
+		os.Exit(1)
+	}
 
-	flag.Parse()
+	if config.ShowVersion {
+		fmt.Println(versionString())
+		return
+	}
+	level, found := logLevels[config.LogLevel]
+	if !found {
+		log.Criticalf("Unsupported log level %s", config.LogLevel)
+		flag.Usage()
+		os.Exit(1)
+	}
+	setLogLevel(level)
+	filterLogLevel()
+	log.Info(versionString())
 
-	if *responderKeyFile == "" || *responderCertFile == "" {
+	if config.VaultCACert != "" || config.VaultCAPath != "" {
+		var err error
+		if vaultRootCAs, err = loadVaultRootCAs(config.VaultCACert, config.VaultCAPath); err != nil {
+			log.Criticalf("Error, unusable vault CA certificates: %v", err)
+			os.Exit(1)
+		}
+	}
+	if config.TokenFile != "" {
+		file, err := openTokenFile(config.TokenFile)
+		if err != nil {
+			log.Criticalf("Error, unusable token file: %v", err)
+			os.Exit(1)
+		}
+		vaultTokens = file.tokens
+		go file.watch(tokenFileCheckInterval)
+	}
+	shutdownTracing := func(context.Context) error { return nil }
+	if config.OtelEndpoint != "" {
+		var err error
+		if shutdownTracing, err = setupTracing(config.OtelEndpoint); err != nil {
+			log.Criticalf("Error, %v", err)
+			os.Exit(1)
+		}
+		log.Infof("Exporting traces to %s", config.OtelEndpoint)
+	}
+	if config.AuthMount != "" && (config.AuthMethod == "" || config.authMount() == "") {
+		log.Critical("Error, -authMount requires -authMethod and a mount path")
+		os.Exit(1)
+	}
+	switch config.AuthMethod {
+	case "":
+	case authMethodKubernetes:
+		if config.K8sRole == "" {
+			log.Critical("Error, -authMethod kubernetes requires -k8sRole")
+			os.Exit(1)
+		}
+		if config.TokenFile != "" {
+			log.Critical("Error, -authMethod and -tokenFile are mutually exclusive")
+			os.Exit(1)
+		}
+		login, err := newKubernetesLogin(config.authMount(), config.K8sRole, config.K8sJWTPath)
+		if err != nil {
+			log.Criticalf("Error, could not create vault client for login: %v", err)
+			os.Exit(1)
+		}
+		secret, err := login.login()
+		if err != nil {
+			log.Criticalf("Error, %v", err)
+			os.Exit(1)
+		}
+		vaultTokens = newTokenClients(secret.Auth.ClientToken)
+		go login.keepLoggedIn(vaultTokens, secret)
+	default:
+		log.Criticalf("Unsupported auth method %s", config.AuthMethod)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if _, ok := signerLoaders[config.SignerType]; !ok {
+		log.Criticalf("Unsupported signer type %s", config.SignerType)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.SignerType != signerTypeFile {
+		if config.ResponderCert == "" || config.ResponderKey != "" || config.ResponderPEM != "" || config.ResponderVaultPath != "" {
+			log.Criticalf("A %s signer needs a responder certificate file and no responder key", config.SignerType)
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if config.ResponderPEM != "" || config.ResponderVaultPath != "" {
+		if config.ResponderKey != "" || config.ResponderCert != "" || (config.ResponderPEM != "" && config.ResponderVaultPath != "") {
+			log.Critical("You can only specify one of a responder PEM file, a responder vault path or a responder key and certificate")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if config.ResponderKey == "" || config.ResponderCert == "" {
 		log.Critical("You have to specify a responder key and certificate")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	responderCert, err := parseResponderCertificate(*responderCertFile)
-	if err != nil {
-		log.Criticalf("Error, no responder certificate: %v", err)
+	if (config.SecondaryResponderCert == "") != (config.SecondaryResponderKey == "") {
+		log.Critical("You have to specify both a secondary responder key and certificate")
+		flag.Usage()
 		os.Exit(1)
 	}
-	responderKey, err := parseResponderKey(*responderKeyFile)
-	if err != nil {
-		log.Criticalf("Error, no responder key: %v", err)
+	config.applyDefaults()
+	if config.BasePath != "" && !strings.HasPrefix(config.BasePath, "/") {
+		log.Criticalf("Base path %s must start with /", config.BasePath)
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, pkiMount := range config.PKIMounts {
+		if pkiMount == "" || strings.HasPrefix(pkiMount, "/") || strings.HasSuffix(pkiMount, "/") {
+			log.Criticalf("Invalid PKI mount %q", pkiMount)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+	if config.IssuerRef != "" && (len(config.PKIMounts) > 1 || config.DiscoverMounts) {
+		log.Critical("You can only specify an issuer reference for a single PKI mount")
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch config.ResponderSelection {
+	case responderSelectionPrimary, responderSelectionRoundRobin, responderSelectionFirstValid:
+	default:
+		log.Criticalf("Unsupported responder selection %s", config.ResponderSelection)
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch config.ExpiredCertBehavior {
+	case expiredCertUnauthorized, expiredCertStatus, expiredCertUnknown:
+	default:
+		log.Criticalf("Unsupported expired certificate behavior %s", config.ExpiredCertBehavior)
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	vaultSource, err := NewVaultSource(*pkiMount, responderCert, &responderKey, nil)
-	if err != nil {
-		log.Criticalf("vault source initialization failed: %v", err)
+	if config.UnifiedCRL && config.CRLRefresh <= 0 {
+		log.Critical("The unified CRL is only used for CRL based lookups enabled with -crlRefresh")
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	http.Handle("/", cfocsp.NewResponder(vaultSource, nil))
+	if config.NextUpdate <= 0 {
+		log.Criticalf("Invalid nextUpdate %s, it has to be positive", time.Duration(config.NextUpdate))
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.CircuitBreakerCooldown < 0 {
+		log.Criticalf("Invalid circuitBreakerCooldown %s, it must not be negative", time.Duration(config.CircuitBreakerCooldown))
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.StaplingNextUpdate < 0 {
+		log.Criticalf("Invalid staplingNextUpdate %s, it must not be negative", time.Duration(config.StaplingNextUpdate))
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.RevokedNextUpdate < 0 {
+		log.Criticalf("Invalid revokedNextUpdate %s, it must not be negative", time.Duration(config.RevokedNextUpdate))
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	server := &http.Server{
-		Addr: *serverAddr,
+	serialSeparator, found := serialSeparators[config.SerialFormat]
+	if !found {
+		log.Criticalf("Unsupported serial format %s", config.SerialFormat)
+		flag.Usage()
+		os.Exit(1)
 	}
-	if err := server.ListenAndServe(); err != nil {
-		log.Criticalf("ListenAndServe failed: %v", err)
+	if config.SerialCase != serialCaseLower && config.SerialCase != serialCaseUpper {
+		log.Criticalf("Unsupported serial case %s", config.SerialCase)
+		flag.Usage()
+		os.Exit(1)
 	}
-}
-func parseResponderKey(responderKeyFile string) (responderKey crypto.Signer, err error) {
-	pemBytes, err := ioutil.ReadFile(responderKeyFile)
-	if err != nil {
-		err = fmt.Errorf("could not read responder key data: %v", err)
-		return
+	if err := validateCertPathTemplate(config.CertPathTemplate); err != nil {
+		log.Criticalf("Invalid certPathTemplate: %v", err)
+		flag.Usage()
+		os.Exit(1)
 	}
-	pemBlock, _ := pem.Decode(pemBytes)
-	if pemBlock == nil {
-		err = errors.New("could not decode PEM data for responder key")
-		return
+	if config.KVCertPath != "" && config.CertPathTemplate != defaultCertPathTemplate {
+		log.Critical("-certPathTemplate cannot be combined with -kvCertPath")
+		flag.Usage()
+		os.Exit(1)
+	}
+	var rateLimit *clientRateLimit
+	if config.RateLimit < 0 || (config.RateLimit > 0 && config.RateBurst < 1) {
+		log.Criticalf("Invalid rate limit %g with burst %d, the limit must not be negative and the burst positive", config.RateLimit, config.RateBurst)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.RateLimit > 0 {
+		trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+		if err != nil {
+			log.Criticalf("%v", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		rateLimit = newClientRateLimit(config.RateLimit, config.RateBurst, trustedProxies)
+	}
+	if _, err := parseResponseHeaders(config.ResponseHeaders); err != nil {
+		log.Criticalf("%v", err)
+		flag.Usage()
+		os.Exit(1)
 	}
-	responderKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	socketMode, err := strconv.ParseUint(config.SocketMode, 8, 32)
 	if err != nil {
-		err = fmt.Errorf("could not parse PKCS1 formatted RSA key: %v", err)
-		return
+		log.Criticalf("Invalid socket mode %s: %v", config.SocketMode, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch config.CacheBackend {
+	case cacheBackendMemory:
+	case cacheBackendRedis:
+		if config.RedisAddr == "" {
+			log.Critical("You have to specify a redis address for the redis cache backend")
+			flag.Usage()
+			os.Exit(1)
+		}
+	default:
+		log.Criticalf("Unsupported cache backend %s", config.CacheBackend)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.NoCache && (config.CacheBackend != cacheBackendMemory || config.WarmCache) {
+		log.Critical("You cannot combine -noCache with a cache backend or cache warmup")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.CacheSnapshot != "" && (config.NoCache || config.CacheBackend != cacheBackendMemory) {
+		log.Critical("-cacheSnapshot requires the memory cache backend")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if config.CacheSnapshot != "" && config.CacheSnapshotInterval <= 0 {
+		log.Criticalf("Invalid cacheSnapshotInterval %s, it must be positive", time.Duration(config.CacheSnapshotInterval))
+		flag.Usage()
+		os.Exit(1)
+	}
+	var issuers []*x509.Certificate
+	if config.Issuers != "" {
+		if config.IssuerRef != "" {
+			log.Critical("You cannot combine an issuer bundle with an issuer reference")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if config.CAChain {
+			log.Critical("You cannot combine an issuer bundle with -caChain")
+			flag.Usage()
+			os.Exit(1)
+		}
+		issuers, err = loadIssuerBundle(config.Issuers)
+		if err != nil {
+			log.Criticalf("Error, unusable issuer bundle: %v", err)
+			os.Exit(1)
+		}
+	}
+	var producedAt time.Time
+	if config.ProducedAt != "" {
+		producedAt, err = time.Parse(time.RFC3339, config.ProducedAt)
+		if err != nil {
+			log.Criticalf("Invalid producedAt time %s: %v", config.ProducedAt, err)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
-	return
-}
 
-func parseResponderCertificate(responderCertFile string) (responderCert *x509.Certificate, err error) {
-	pemBytes, err := ioutil.ReadFile(responderCertFile)
+	responders, err := loadResponders(&config)
 	if err != nil {
-		err = fmt.Errorf("could not read responder certificate data: %v", err)
-		return
+		log.Criticalf("Error, unusable responder certificate and key: %v", err)
+		os.Exit(1)
 	}
-	pemBlock, _ := pem.Decode(pemBytes)
-	if pemBlock == nil {
-		err = errors.New("could not decode PEM data for responder certificate")
-		return
+	certExpiryWarning := time.Duration(config.CertExpiryWarning)
+	for _, responder := range responders {
+		log.Infof("Responder certificate %v is valid until %s",
+			responder.certificate.Subject.CommonName, responder.certificate.NotAfter)
+		if err := checkResponderExpiry(responder.certificate, certExpiryWarning, time.Now()); err != nil {
+			if config.RefuseExpiredCert {
+				log.Criticalf("Error, unusable responder certificate: %v", err)
+				os.Exit(1)
+			}
+			log.Errorf("Responder certificate problem: %v", err)
+		}
 	}
-	responderCert, err = x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		err = fmt.Errorf("could not parse responder certificate: %v", err)
+
+	var allowlist serialAllowlist
+	if config.SerialAllowlist != "" {
+		allowlist, err = loadSerialAllowlist(config.SerialAllowlist)
+		if err != nil {
+			log.Criticalf("Error, unusable serial allowlist: %v", err)
+			os.Exit(1)
+		}
+		log.Infof("Loaded serial allowlist with %d serials", len(allowlist))
+	}
+
+	var audit *auditLog
+	if config.AuditLog != "" {
+		audit, err = openAuditLog(config.AuditLog)
+		if err != nil {
+			log.Criticalf("Error, unusable audit log: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	settings := mountSettings{
+		config:      &config,
+		serialStyle: serialStyle{separator: serialSeparator, uppercase: config.SerialCase == serialCaseUpper},
+		producedAt:  producedAt,
+		audit:       audit,
+		issuers:     issuers,
+	}
+	if config.CacheBackend == cacheBackendRedis {
+		settings.redis = newRedisClient(config.RedisAddr, time.Duration(config.RedisTimeout))
+	}
+	mounts := newMountSet(settings, responders, allowlist)
+	for _, pkiMount := range config.PKIMounts {
+		if err := mounts.add(pkiMount); err != nil {
+			log.Criticalf("vault source initialization for %s failed: %v", pkiMount, err)
+			os.Exit(1)
+		}
+	}
+	var discoveryClient *api.Client
+	if config.DiscoverMounts {
+		discoveryClient, err = newVaultClient(nil)
+		if err != nil {
+			log.Criticalf("Error initializing vault client for mount discovery: %v", err)
+			os.Exit(1)
+		}
+		if err := mounts.discoverMounts(discoveryClient); err != nil {
+			log.Errorf("Mount discovery failed, serving the configured mounts: %v", err)
+		}
+	}
+	if config.CacheSnapshot != "" && config.Check == "" {
+		restored, err := loadCacheSnapshot(config.CacheSnapshot, mounts.sources())
+		if err != nil {
+			log.Errorf("Starting with an empty cache: %v", err)
+		}
+		log.Infof("Restored %d cached responses from %s", restored, config.CacheSnapshot)
+	}
+	if config.Check != "" {
+		sources := mounts.sources()
+		if len(sources) == 0 {
+			log.Critical("Check failed: no PKI mount available")
+			os.Exit(1)
+		}
+		if err := runCheck(sources, config.Check, os.Stdout); err != nil {
+			log.Criticalf("Check failed: %v", err)
+			os.Exit(1)
+		}
 		return
 	}
-	return
+	if config.CertExpiryCheck > 0 {
+		go watchResponderExpiry(mounts.responderCertificates, certExpiryWarning, time.Duration(config.CertExpiryCheck))
+	}
+	go reloadResponderOnSignal(&config, mounts)
+	if config.ConfigFile != "" {
+		go reloadConfigOnSignal(&config, os.Args[1:], mounts)
+	}
+	if audit != nil {
+		go reopenAuditLogOnSignal(audit)
+	}
+	if config.SerialAllowlist != "" {
+		go reloadAllowlistOnSignal(config.SerialAllowlist, mounts)
+	}
+	if config.CacheSnapshot != "" {
+		go snapshotCachePeriodically(config.CacheSnapshot, time.Duration(config.CacheSnapshotInterval), mounts)
+	}
+	if config.DiscoverMounts && config.DiscoveryInterval > 0 {
+		go mounts.refreshMounts(discoveryClient, time.Duration(config.DiscoveryInterval))
+	}
+
+	var ocspRoutes http.Handler = mounts
+	mountOf := mounts.mountOf
+	singleMount := len(mounts.sources()) == 1 && !config.DiscoverMounts
+	if singleMount {
+		pkiMount := mounts.sources()[0].pkiMount
+		ocspRoutes = ocspHandler(&config, mounts.sources()[0])
+		mountOf = func(*http.Request) string { return pkiMount }
+	}
+	if rateLimit != nil {
+		responseHeaders, _ := parseResponseHeaders(config.ResponseHeaders)
+		ocspRoutes = addResponseHeaders(responseHeaders, limitClientRate(rateLimit, ocspRoutes))
+	}
+	health := &healthState{unready: config.ReadinessProbe}
+	if config.ReadinessProbe {
+		go probeReadiness(health, mounts.sources, readinessProbeInterval)
+	}
+	ocspRoutes = health.track(ocspRoutes)
+	if config.AccessLog {
+		// rejected and rate limited requests are logged as well
+		ocspRoutes = accessLog(mountOf, ocspRoutes)
+	}
+	// without a single mount each mount is served below its own path prefix
+	mux := newRoutes(ocspRoutes)
+	mux.Handle("/healthz", healthHandler(health))
+	if singleMount && config.CAPath != "" {
+		mux.Handle(config.CAPath, caHandler(mounts.sources()[0]))
+	} else if config.CAPath != "" {
+		log.Infof("Serving CA certificates at /<mount>%s of each mount", config.CAPath)
+	}
+	if config.AdminToken != "" {
+		mux.Handle("/admin/config", requireAdminToken(config.AdminToken, configHandler(&config)))
+		mux.Handle("/admin/metrics", requireAdminToken(config.AdminToken, expvar.Handler()))
+		mux.Handle("/admin/drain", requireAdminToken(config.AdminToken, drainHandler(health)))
+	}
+	if config.DebugCache {
+		var debugCache http.Handler = cacheDebugHandler(mounts)
+		if config.AdminToken != "" {
+			debugCache = requireAdminToken(config.AdminToken, debugCache)
+		}
+		mux.Handle("/debug/cache", debugCache)
+	}
+
+	var handler http.Handler = mux
+	if config.BasePath != "" {
+		handler = stripBasePath(config.BasePath, mux)
+	}
+
+	server := newServer(&config, handler)
+	listeners := make([]net.Listener, 0, len(config.ServerAddrs))
+	for _, serverAddr := range config.ServerAddrs {
+		listener, err := listen(serverAddr, os.FileMode(socketMode))
+		if err != nil {
+			log.Criticalf("Listen on %s failed: %v", serverAddr, err)
+			os.Exit(1)
+		}
+		log.Infof("Listening on %s", serverAddr)
+		listeners = append(listeners, listener)
+	}
+	if config.PprofAddr != "" {
+		pprofListener, err := listen(config.PprofAddr, os.FileMode(socketMode))
+		if err != nil {
+			log.Criticalf("Listen on %s failed: %v", config.PprofAddr, err)
+			os.Exit(1)
+		}
+		log.Infof("Serving profiles on %s", config.PprofAddr)
+		go servePprof(pprofListener)
+	}
+	shutdownDone := make(chan struct{})
+	go shutdownOnSignal(server, shutdownDone)
+	if err := serve(server, listeners); err != nil {
+		log.Criticalf("Serve failed: %v", err)
+	} else {
+		// serving ends when the listeners are closed, the shutdown still
+		// waits for the responses of in-flight requests
+		<-shutdownDone
+	}
+	if config.CacheSnapshot != "" {
+		saveCacheSnapshot(config.CacheSnapshot, mounts)
+	}
+	// flush the spans of the last requests
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Errorf("Could not export traces: %v", err)
+	}
+}
+
+// ocspHandler returns the HTTP handler answering OCSP requests from the
+// source.
+func ocspHandler(config *configuration, source *VaultSource) http.Handler {
+	ocspResponder := newResponder(source)
+	ocspResponder.retryAfter = time.Duration(config.RetryAfter)
+	ocspResponder.retryAfterJitter = time.Duration(config.RetryAfterJitter)
+	ocspResponder.banner = config.Banner
+	ocspResponder.stapling = config.StaplingNextUpdate > 0
+	// rejected requests get the configured headers as well
+	responseHeaders, _ := parseResponseHeaders(config.ResponseHeaders)
+	return addResponseHeaders(responseHeaders, limitRequests(config.MaxRequestBytes, config.StrictContentType, ocspResponder))
 }
 
 type VaultSource struct {
-	pkiMount             string
-	cached               map[string][]byte
-	vaultClient          *api.Client
-	caCertificate        *x509.Certificate
-	responderCertificate *x509.Certificate
-	responderKey         *crypto.Signer
+	pkiMount    string
+	cache       responseCache
+	cacheHits   uint64
+	cacheMisses uint64
+	crlLock     sync.RWMutex
+	crl         crlRevocations
+	// unifiedCRL reads the unified CRL of all clusters instead of the
+	// local CRL of the mount
+	unifiedCRL          bool
+	serialStyle         serialStyle
+	thisUpdateSkew      time.Duration
+	producedAt          time.Time
+	signatureAlgorithm  x509.SignatureAlgorithm
+	vaultClient         *api.Client
+	certs               certStore
+	vaultReads          vaultReadLimit
+	vaultBreaker        *vaultBreaker
+	vaultTimeout        time.Duration
+	lookups             singleflight.Group
+	allowlistLock       sync.RWMutex
+	allowlist           serialAllowlist
+	audit               *auditLog
+	issuerLock          sync.RWMutex
+	issuers             []*x509.Certificate
+	issuerKeyHashes     issuerKeyHashes
+	responderLock       sync.RWMutex
+	responders          []responderPair
+	issuerResponders    map[string]responderPair
+	responderSelection  string
+	responderCounter    uint64
+	lifetimeLock        sync.RWMutex
+	lifetimes           responseLifetimes
+	responseSizeWarning int
+	// omitResponderCert leaves the responder certificate out of responses
+	// for clients that trust the responder directly
+	omitResponderCert bool
+	// archiveCutoff is the retention period of revocation information
+	// announced with the archive cutoff extension, 0 omits the extension
+	archiveCutoff time.Duration
+	// verifyChain requires certificates to be signed by the requested
+	// issuer before their status is answered
+	verifyChain bool
+	// expiredCertBehavior is how certificates that are not revoked are
+	// answered after they expired, one of the expiredCert constants
+	expiredCertBehavior string
+	// clk is the time source of all time-dependent decisions
+	clk clock.Clock
+	// stopped is closed when the source is no longer served
+	stopped chan struct{}
 }
 
-func NewVaultSource(pkiMount string, responderCertificate *x509.Certificate, responderKey *crypto.Signer, config *api.Config) (*VaultSource, error) {
-	client, err := api.NewClient(config)
+// responderPair is a delegated OCSP responder certificate and its key.
+type responderPair struct {
+	certificate *x509.Certificate
+	key         *crypto.Signer
+	// issuerKeyID is the subject key identifier of the only issuer the
+	// responder signs for, it is nil for responders of all issuers
+	issuerKeyID []byte
+	// pkiMount is the only PKI mount the responder signs for, it is empty
+	// for responders of all mounts
+	pkiMount string
+}
+
+const (
+	// responderSelectionPrimary signs all responses with the first responder
+	responderSelectionPrimary = "primary"
+	// responderSelectionRoundRobin alternates between all responders
+	responderSelectionRoundRobin = "round-robin"
+	// responderSelectionFirstValid signs with the first responder whose
+	// certificate is currently valid
+	responderSelectionFirstValid = "first-valid"
+)
+
+const (
+	// expiredCertUnauthorized answers for expired certificates with the
+	// unauthorized error
+	expiredCertUnauthorized = "unauthorized"
+	// expiredCertStatus answers good for expired certificates like for valid
+	// ones
+	expiredCertStatus = "status"
+	// expiredCertUnknown answers with the unknown certificate status
+	expiredCertUnknown = "unknown"
+)
+
+func NewVaultSource(pkiMount string, selection issuerSelection, responderCertificate *x509.Certificate, responderKey *crypto.Signer, config *api.Config) (*VaultSource, error) {
+	client, err := newVaultClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing vault client: %v", err)
 	}
-	vaultRequest := client.NewRequest(http.MethodGet, fmt.Sprintf("/v1/%s/ca", pkiMount))
-	vaultResponse, err := client.RawRequest(vaultRequest)
+	issuers, err := fetchIssuers(client, pkiMount, selection)
 	if err != nil {
-		return nil, fmt.Errorf("error getting CA certificate from vault: %v", err)
+		return nil, err
 	}
-	caCertificateBytes, err := ioutil.ReadAll(vaultResponse.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read CA certificate data from vault: %v", err)
+	return newVaultSource(client, pkiMount, issuers, responderCertificate, responderKey)
+}
+
+// newVaultSource creates a source for the PKI mount that answers for the
+// given issuers.
+func newVaultSource(client *api.Client, pkiMount string, issuers []*x509.Certificate, responderCertificate *x509.Certificate, responderKey *crypto.Signer) (*VaultSource, error) {
+	for _, issuer := range issuers {
+		log.Infof("Found CA certificate %v", issuer.Subject.CommonName)
 	}
-	caCertificate, err := x509.ParseCertificate(caCertificateBytes)
+	keyHashes, err := computeIssuerKeyHashes(issuers)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse CA certificate data from vault: %v", err)
+		return nil, err
 	}
-	log.Infof("Found CA certificate %v", caCertificate.Subject.CommonName)
 	vaultSource := &VaultSource{
-		pkiMount:             pkiMount,
-		vaultClient:          client,
-		caCertificate:        caCertificate,
-		responderCertificate: responderCertificate,
-		responderKey:         responderKey,
-		cached:               make(map[string][]byte),
+		pkiMount:           pkiMount,
+		vaultClient:        client,
+		certs:              pkiCertStore{client: client, pathTemplate: pkiMount + "/cert/" + certPathSerial},
+		issuers:            issuers,
+		issuerKeyHashes:    keyHashes,
+		responders:         []responderPair{{certificate: responderCertificate, key: responderKey}},
+		responderSelection: responderSelectionPrimary,
+		cache:              newMemoryCache(),
+		serialStyle:        vaultSerialStyle,
+		lifetimes:          responseLifetimes{nextUpdate: time.Hour},
+		clk:                clock.New(),
+		stopped:            make(chan struct{}),
 	}
 	return vaultSource, nil
 }
 
-func (source VaultSource) buildCAHash(algorithm crypto.Hash) (issuerHash []byte, err error) {
-	h := algorithm.New()
-	var publicKeyInfo struct {
-		Algorithm pkix.AlgorithmIdentifier
-		PublicKey asn1.BitString
+func (source *VaultSource) Response(request *ocsp.Request) ([]byte, http.Header, error) {
+	return source.ResponseWithPreferences(context.Background(), request, nil)
+}
+
+// ResponseWithPreferences is like Response but signs with the first of the
+// preferred signature algorithms the responder supports. It gives up with
+// tryLater once the context is done.
+func (source *VaultSource) ResponseWithPreferences(ctx context.Context, request *ocsp.Request, preferred []x509.SignatureAlgorithm) ([]byte, http.Header, error) {
+	entry, err := source.lookupResponse(ctx, request, preferred, isStapling(ctx))
+	if err != nil {
+		lookupErrors.Add(errorKindName(err), 1)
+		return nil, nil, err
 	}
-	if _, err := asn1.Unmarshal(source.caCertificate.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
-		log.Errorf("Error parsing CA certificate public key info: %v", err)
-		return nil, err
+	response := entry.response
+	source.recordServed(response, entry.responder, toVaultSerial(request.SerialNumber))
+	headers := source.currentLifetimes().cacheControl.headers(response, source.clk.Now())
+	if headers != nil {
+		headers.Set("ETag", entry.etag)
 	}
-	h.Write(publicKeyInfo.PublicKey.RightAlign())
-	issuerHash = h.Sum(nil)
-	return issuerHash, nil
+	return response, headers, nil
 }
 
-func (source VaultSource) Response(request *ocsp.Request) ([]byte, http.Header, error) {
-	caHash, err := source.buildCAHash(request.HashAlgorithm)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error building CA certificate hash with algorithm %d: %v", request.HashAlgorithm, err)
+// recordServed updates the metrics and audit log for a response signed by
+// the responder certificate that is served for the given serials.
+func (source *VaultSource) recordServed(response []byte, responderCertificate *x509.Certificate, serials string) {
+	recordResponseSize(len(response))
+	if source.audit != nil {
+		source.audit.record(source.pkiMount, response, responderCertificate, source.clk.Now())
 	}
-	if bytes.Compare(request.IssuerKeyHash, caHash) != 0 {
-		return nil, nil, errors.New("request issuer key has does not match CA subject key hash")
+	if source.responseSizeWarning > 0 && len(response) > source.responseSizeWarning {
+		responsesOversized.Add(1)
+		log.Warningf("Response for serial %s has %d bytes, exceeding the warning threshold of %d bytes",
+			serials, len(response), source.responseSizeWarning)
 	}
+}
 
-	cacheKey := request.SerialNumber.String()
-	response, present := source.cached[cacheKey]
-	if present {
-		return response, nil, nil
+// maxSerialBits bounds the serial numbers that are looked up. RFC 5280
+// limits serials to 20 octets, larger ones only make long vault paths.
+const maxSerialBits = 160
+
+func (source *VaultSource) lookupResponse(ctx context.Context, request *ocsp.Request, preferred []x509.SignatureAlgorithm, stapling bool) (cacheEntry, error) {
+	if bits := request.SerialNumber.BitLen(); bits > maxSerialBits {
+		return cacheEntry{}, lookupError(errMalformedRequest, fmt.Errorf("serial number has %d bits, more than the %d bits allowed", bits, maxSerialBits))
 	}
-	vaultSerial := toVaultSerial(request.SerialNumber)
-	log.Infof("OCSP request for serial %s\n", vaultSerial)
-	vaultResponse, err := source.vaultClient.Logical().Read(
-		fmt.Sprintf("%s/cert/%s", source.pkiMount, vaultSerial))
+	issuers, keyHashes := source.currentIssuers()
+	issuer, err := matchIssuer(issuers, keyHashes, request.HashAlgorithm, request.IssuerKeyHash)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error reading certificate information for %s from vault", vaultSerial)
+		return cacheEntry{}, lookupError(errMalformedRequest, err)
 	}
-	revocationTime, found := vaultResponse.Data["revocation_time"]
-	if !found {
-		// no revocation time in data
-		return response, nil, nil
+	if issuer == nil {
+		return cacheEntry{}, lookupError(errIssuerMismatch, errors.New("request issuer key hash does not match a CA subject key hash"))
 	}
-	switch revocationTime.(type) {
-	case json.Number:
-		revTime, err := revocationTime.(json.Number).Int64()
-		if err != nil {
-			return nil, nil, errors.New("could not convert revocation time to int64 value")
-		}
 
-		if revTime != 0 {
-			log.Infof("Certificate with serial number %s is revoked", vaultSerial)
-			response, err = source.buildRevokedResponse(request.SerialNumber, time.Unix(revTime, 0))
-			if err != nil {
-				return nil, nil, fmt.Errorf("could not build response %v", err)
-			}
-			source.cached[cacheKey] = response
-			return response, nil, nil
+	if !source.allowed(request.SerialNumber) && source.ownResponder(issuer, request.SerialNumber) == nil {
+		vaultSerial := formatSerial(request.SerialNumber, source.serialStyle)
+		log.Infof("Serial %s is not on the serial allowlist", vaultSerial)
+		return cacheEntry{}, lookupError(errUnknownSerial, fmt.Errorf("serial %s is not on the allowlist", vaultSerial))
+	}
+
+	cacheKey := responseCacheKey(request, preferred, stapling)
+	cached, present := source.cache.get(cacheKey, source.clk.Now())
+	if present {
+		atomic.AddUint64(&source.cacheHits, 1)
+		if cached.notFound != nil {
+			return cacheEntry{}, lookupError(cached.notFound, errors.New("cached as not answerable"))
+		}
+		return cached, nil
+	}
+	atomic.AddUint64(&source.cacheMisses, 1)
+	// concurrent lookups of the same serial share a single vault read, which
+	// is bounded by the vault timeout instead of the context of the request
+	// that happened to start it
+	results := source.lookups.DoChan(cacheKey, func() (interface{}, error) {
+		fetchCtx, cancel := source.vaultContext()
+		defer cancel()
+		// the shared read is traced within the request that started it
+		fetchCtx = trace.ContextWithSpan(fetchCtx, trace.SpanFromContext(ctx))
+		return source.fetchResponse(fetchCtx, issuer, request, cacheKey, preferred, stapling)
+	})
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return cacheEntry{}, result.Err
 		}
+		return result.Val.(cacheEntry), nil
+	case <-ctx.Done():
+		return cacheEntry{}, lookupError(errVaultUnavailable, fmt.Errorf("gave up waiting for vault: %v", ctx.Err()))
+	}
+}
 
-		certificateString, found := vaultResponse.Data["certificate"]
-		if !found {
-			// no certificate in data
-			return response, nil, nil
+// responseCacheKey returns the cache key of the response to the request.
+// The issuer key hash keeps responses of different issuers and request hash
+// algorithms apart.
+func responseCacheKey(request *ocsp.Request, preferred []x509.SignatureAlgorithm, stapling bool) string {
+	cacheKey := fmt.Sprintf("%x/%s%s", request.IssuerKeyHash, request.SerialNumber, preferenceCacheKey(preferred))
+	if stapling {
+		// stapling responses have a different validity
+		cacheKey += staplingPrefix
+	}
+	return cacheKey
+}
+
+// vaultContext returns the context for vault reads, it is cancelled after
+// the vault timeout.
+func (source *VaultSource) vaultContext() (context.Context, context.CancelFunc) {
+	if source.vaultTimeout > 0 {
+		return context.WithTimeout(context.Background(), source.vaultTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// fetchResponse builds the response for the request from the CRL or vault
+// and caches it with the given key.
+func (source *VaultSource) fetchResponse(ctx context.Context, issuer *x509.Certificate, request *ocsp.Request, cacheKey string, preferred []x509.SignatureAlgorithm, stapling bool) (cacheEntry, error) {
+	var response []byte
+	var responderCertificate *x509.Certificate
+	var entry cacheEntry
+	var err error
+	vaultSerial := formatSerial(request.SerialNumber, source.serialStyle)
+	ctx, span := tracer.Start(ctx, "vault_ocsp.fetch", trace.WithAttributes(
+		serialAttribute.String(vaultSerial), attribute.String("vault.mount", source.pkiMount)))
+	defer span.End()
+	log.Infof("OCSP request for serial %s\n", vaultSerial)
+	if revoked, found := source.crlRevocation(issuer, request.SerialNumber); found {
+		log.Infof("Certificate with serial number %s is revoked according to the CRL", vaultSerial)
+		nextUpdate := source.revokedNextUpdate()
+		response, responderCertificate, err = source.buildRevokedResponse(ctx, issuer, request, revoked.RevocationTime, crlReason(revoked), nextUpdate, preferred)
+		if err != nil {
+			return cacheEntry{}, fmt.Errorf("could not build response %v", err)
+		}
+		entry = newCacheEntry(response, responderCertificate, nextUpdate)
+		source.cache.set(cacheKey, entry)
+		return entry, nil
+	}
+	if responder := source.ownResponder(issuer, request.SerialNumber); responder != nil {
+		// the responder certificate may come from outside the mount, its
+		// status is known without asking vault
+		log.Infof("Serial %s is the responder certificate, answering good", vaultSerial)
+		nextUpdate := source.clk.Now().Add(source.currentLifetimes().goodValidity(stapling))
+		if responder.NotAfter.Before(nextUpdate) {
+			nextUpdate = responder.NotAfter
 		}
-		certificateBytes, err := ioutil.ReadAll(strings.NewReader(certificateString.(string)))
+		response, responderCertificate, err = source.buildOkResponse(ctx, issuer, request, nextUpdate, preferred)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not read certificate %v", err)
+			return cacheEntry{}, fmt.Errorf("could not build response %v", err)
+		}
+		entry = newCacheEntry(response, responderCertificate, nextUpdate)
+		source.cache.set(cacheKey, entry)
+		return entry, nil
+	}
+	if err := source.vaultBreaker.allow(); err != nil {
+		return cacheEntry{}, lookupError(errVaultUnavailable, err)
+	}
+	if err := source.vaultReads.acquire(); err != nil {
+		source.vaultBreaker.cancel()
+		return cacheEntry{}, lookupError(errVaultUnavailable, err)
+	}
+	readCtx, readSpan := tracer.Start(ctx, "vault.read", trace.WithAttributes(serialAttribute.String(vaultSerial)))
+	certificateData, err := source.certs.certificateData(readCtx, vaultSerial)
+	if err != nil {
+		readSpan.RecordError(err)
+		readSpan.SetStatus(codes.Error, "vault read failed")
+	}
+	readSpan.End()
+	source.vaultReads.release()
+	source.vaultBreaker.done(err)
+	if err != nil {
+		return cacheEntry{}, lookupError(errVaultUnavailable, fmt.Errorf("error reading certificate information for %s from vault: %v", vaultSerial, err))
+	}
+	if certificateData == nil {
+		// vault has no certificate information for this serial
+		log.Infof("No certificate data for serial %s in vault", vaultSerial)
+		if negativeCacheTTL := source.currentLifetimes().negativeCacheTTL; negativeCacheTTL > 0 {
+			source.cache.set(cacheKey, cacheEntry{notFound: errUnknownSerial, expires: source.clk.Now().Add(negativeCacheTTL)})
 		}
-		block, _ := pem.Decode(certificateBytes)
-		if block == nil {
-			return nil, nil, errors.New("could not decode PEM data")
+		return cacheEntry{}, lookupError(errUnknownSerial, fmt.Errorf("no certificate data for %s in vault", vaultSerial))
+	}
+	if err := checkCertificateData(certificateData); err != nil {
+		log.Errorf("Vault data for serial %s of %s is no certificate data, the mount does not look like a PKI mount, check -pkimount, -certPathTemplate and -kvCertPath: %v",
+			vaultSerial, source.pkiMount, err)
+		return cacheEntry{}, fmt.Errorf("unexpected vault data for %s: %v", vaultSerial, err)
+	}
+	if source.verifyChain {
+		if err := source.verifyIssuedBy(issuer, certificateData); err != nil {
+			log.Infof("Certificate with serial %s does not chain to the requested issuer, returning unauthorized: %v", vaultSerial, err)
+			if negativeCacheTTL := source.currentLifetimes().negativeCacheTTL; negativeCacheTTL > 0 {
+				source.cache.set(cacheKey, cacheEntry{notFound: errIssuerMismatch, expires: source.clk.Now().Add(negativeCacheTTL)})
+			}
+			return cacheEntry{}, lookupError(errIssuerMismatch, fmt.Errorf("certificate %s not issued by %s: %v", vaultSerial, issuer.Subject, err))
 		}
-		certificate, err := x509.ParseCertificate(block.Bytes)
+	}
+	revocationTime, found, err := parseRevocationTime(certificateData)
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("invalid revocation time for %s: %v", vaultSerial, err)
+	}
+	// certificate data without revocation time is not revoked, it is
+	// answered like a revocation time of zero after the expiry check
+	if found && !revocationTime.IsZero() {
+		log.Infof("Certificate with serial number %s is revoked", vaultSerial)
+		nextUpdate := source.revokedNextUpdate()
+		response, responderCertificate, err = source.buildRevokedResponse(ctx, issuer, request, revocationTime, ocsp.Unspecified, nextUpdate, preferred)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not parse certificate: %v", err)
+			return cacheEntry{}, fmt.Errorf("could not build response %v", err)
 		}
-		if certificate.NotAfter.Before(time.Now()) {
-			// certificate is expired, store unauthorized response in cache
+		entry = newCacheEntry(response, responderCertificate, nextUpdate)
+		source.cache.set(cacheKey, entry)
+		return entry, nil
+	}
+
+	certificate, found, err := parseCertificateField(certificateData)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	nextUpdate := source.clk.Now().Add(source.currentLifetimes().goodValidity(stapling))
+	status := ocsp.Good
+	if !found {
+		// the serial is known and not revoked, only its expiry is unknown
+		log.Infof("Certificate with serial %s is not revoked, its expiry cannot be verified without certificate, returning good", vaultSerial)
+	} else if certificate.NotAfter.Before(source.clk.Now()) {
+		switch source.expiredCertBehavior {
+		case expiredCertStatus:
+			log.Infof("Certificate with serial %s expired at %s, returning good", vaultSerial, certificate.NotAfter)
+		case expiredCertUnknown:
+			log.Infof("Certificate with serial %s expired at %s, returning unknown", vaultSerial, certificate.NotAfter)
+			status = ocsp.Unknown
+		default:
+			// remember to answer with unauthorized
 			log.Infof("Certificate with serial %s expired at %s, returning unauthorized", vaultSerial, certificate.NotAfter)
-			response = ocsp.UnauthorizedErrorResponse
-			source.cached[cacheKey] = response
-		} else {
-			log.Infof("Certificate with serial %s is valid", vaultSerial)
-			response, err = source.buildOkResponse(request.SerialNumber)
-			if err != nil {
-				return nil, nil, fmt.Errorf("could not build response %v", err)
+			if negativeCacheTTL := source.currentLifetimes().negativeCacheTTL; negativeCacheTTL > 0 {
+				source.cache.set(cacheKey, cacheEntry{notFound: errCertificateExpired, expires: source.clk.Now().Add(negativeCacheTTL)})
 			}
+			return cacheEntry{}, lookupError(errCertificateExpired, fmt.Errorf("certificate %s expired at %s", vaultSerial, certificate.NotAfter))
 		}
-		present = true
+	} else {
+		log.Infof("Certificate with serial %s is valid", vaultSerial)
+		// a good response must not vouch for the certificate beyond its expiry
+		if certificate.NotAfter.Before(nextUpdate) {
+			nextUpdate = certificate.NotAfter
+		}
+	}
+	response, responderCertificate, err = source.buildStatusResponse(ctx, issuer, request, status, nextUpdate, preferred)
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("could not build response %v", err)
 	}
+	// good responses must not outlive their NextUpdate
+	entry = newCacheEntry(response, responderCertificate, nextUpdate)
+	source.cache.set(cacheKey, entry)
+
+	return entry, nil
+}
 
-	return response, nil, nil
+// parseCertificateField parses the PEM encoded certificate field of vault
+// certificate data, found is false if the data has no certificate or it is
+// null or empty.
+func parseCertificateField(certificateData map[string]interface{}) (certificate *x509.Certificate, found bool, err error) {
+	certificateString, found := certificateData["certificate"]
+	if !found || certificateString == nil || certificateString == "" {
+		return nil, false, nil
+	}
+	certificatePEM, ok := certificateString.(string)
+	if !ok {
+		return nil, true, fmt.Errorf("certificate is a %T, not a string", certificateString)
+	}
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return nil, true, errors.New("could not decode PEM data")
+	}
+	certificate, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, true, fmt.Errorf("could not parse certificate: %v", err)
+	}
+	return certificate, true, nil
 }
 
-func (source VaultSource) buildRevokedResponse(serialNumber *big.Int, revocationTime time.Time) ([]byte, error) {
+// verifyIssuedBy checks that the certificate in vault certificate data is
+// signed by the requested issuer and that the issuer has not expired, so
+// that serials colliding across PKIs are not answered for the wrong CA.
+func (source *VaultSource) verifyIssuedBy(issuer *x509.Certificate, certificateData map[string]interface{}) error {
+	if now := source.clk.Now(); now.After(issuer.NotAfter) {
+		return fmt.Errorf("issuer expired at %s", issuer.NotAfter)
+	}
+	certificate, found, err := parseCertificateField(certificateData)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("no certificate to verify")
+	}
+	if err := certificate.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// buildRevokedResponse builds a revoked response for the request with the
+// given revocation reason, one of the reason codes defined in
+// golang.org/x/crypto/ocsp. A zero nextUpdate is left out of the response.
+func (source *VaultSource) buildRevokedResponse(ctx context.Context, issuer *x509.Certificate, request *ocsp.Request, revocationTime time.Time, reason int, nextUpdate time.Time, preferred []x509.SignatureAlgorithm) ([]byte, *x509.Certificate, error) {
 	template := ocsp.Response{
-		SerialNumber: serialNumber,
+		SerialNumber: request.SerialNumber,
 		Status:       ocsp.Revoked,
-		ThisUpdate:   time.Now(),
-		Certificate:  source.responderCertificate,
+		IssuerHash:   request.HashAlgorithm,
+		ThisUpdate:   source.clk.Now().Add(-source.thisUpdateSkew),
+		NextUpdate:   nextUpdate,
 	}
 	template.RevokedAt = revocationTime
-	template.RevocationReason = ocsp.Unspecified
-	return source.buildResponse(template)
+	template.RevocationReason = reason
+	return source.buildResponse(ctx, issuer, template, preferred)
+}
+
+// buildOkResponse builds a good response for the request. The CertID of the
+// response uses the hash algorithm of the request, clients look up the
+// status by their own CertID.
+func (source *VaultSource) buildOkResponse(ctx context.Context, issuer *x509.Certificate, request *ocsp.Request, nextUpdate time.Time, preferred []x509.SignatureAlgorithm) (ocspResponse []byte, responderCertificate *x509.Certificate, err error) {
+	return source.buildStatusResponse(ctx, issuer, request, ocsp.Good, nextUpdate, preferred)
 }
 
-func (source VaultSource) buildOkResponse(serialNumber *big.Int) (ocspResponse []byte, err error) {
+// buildStatusResponse builds a good or unknown response for the request.
+func (source *VaultSource) buildStatusResponse(ctx context.Context, issuer *x509.Certificate, request *ocsp.Request, status int, nextUpdate time.Time, preferred []x509.SignatureAlgorithm) (ocspResponse []byte, responderCertificate *x509.Certificate, err error) {
 	template := ocsp.Response{
-		SerialNumber: serialNumber,
-		Status:       ocsp.Good,
-		ThisUpdate:   time.Now(),
-		NextUpdate:   time.Now().Add(time.Hour),
-		Certificate:  source.responderCertificate,
+		SerialNumber: request.SerialNumber,
+		Status:       status,
+		IssuerHash:   request.HashAlgorithm,
+		ThisUpdate:   source.clk.Now().Add(-source.thisUpdateSkew),
+		NextUpdate:   nextUpdate,
 	}
-	return source.buildResponse(template)
+	return source.buildResponse(ctx, issuer, template, preferred)
 }
 
-func (source VaultSource) buildResponse(template ocsp.Response) (ocspResponse []byte, err error) {
-	ocspResponse, err = ocsp.CreateResponse(
-		source.caCertificate, source.responderCertificate, template, *source.responderKey)
+func (source *VaultSource) buildResponse(ctx context.Context, issuer *x509.Certificate, template ocsp.Response, preferred []x509.SignatureAlgorithm) (ocspResponse []byte, responderCertificate *x509.Certificate, err error) {
+	return source.buildResponses(ctx, issuer, []ocsp.Response{template}, preferred)
+}
+
+// buildResponses builds a response with a single response for each of the
+// templates and returns it with the responder certificate it is signed
+// with, which the response may omit.
+func (source *VaultSource) buildResponses(ctx context.Context, issuer *x509.Certificate, templates []ocsp.Response, preferred []x509.SignatureAlgorithm) (ocspResponse []byte, responderCertificate *x509.Certificate, err error) {
+	_, span := tracer.Start(ctx, "ocsp.sign", trace.WithAttributes(attribute.Int("ocsp.responses", len(templates))))
+	defer span.End()
+	responderCertificate, responderKey := source.responder(issuer)
+	if !source.omitResponderCert {
+		templates[0].Certificate = responderCertificate
+	}
+	templates[0].SignatureAlgorithm = signatureAlgorithmFor(*responderKey, preferred, source.signatureAlgorithm)
+	producedAt := source.producedAt
+	if producedAt.IsZero() {
+		producedAt = source.clk.Now()
+	}
+	producedAt = producedAt.Truncate(time.Second)
+	if source.archiveCutoff > 0 {
+		extension, err := archiveCutoffExtension(producedAt.Add(-source.archiveCutoff))
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range templates {
+			templates[i].ExtraExtensions = append(templates[i].ExtraExtensions, extension)
+		}
+	}
+	ocspResponse, err = createResponses(
+		issuer, responderCertificate, templates, producedAt, *responderKey)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "could not sign response")
+	}
 	return
 }
 
+// responder returns the responder certificate and key to sign the next
+// response for the issuer with. A responder for the issuer's key identifier
+// takes precedence over the responders of all issuers.
+func (source *VaultSource) responder(issuer *x509.Certificate) (*x509.Certificate, *crypto.Signer) {
+	source.responderLock.RLock()
+	defer source.responderLock.RUnlock()
+	if responder, found := source.issuerResponders[string(issuer.SubjectKeyId)]; found && len(issuer.SubjectKeyId) > 0 {
+		return responder.certificate, responder.key
+	}
+	responder := source.responders[0]
+	switch source.responderSelection {
+	case responderSelectionRoundRobin:
+		next := atomic.AddUint64(&source.responderCounter, 1)
+		responder = source.responders[next%uint64(len(source.responders))]
+	case responderSelectionFirstValid:
+		// the primary responder is used if no certificate is valid
+		now := source.clk.Now()
+		for _, candidate := range source.responders {
+			if !now.Before(candidate.certificate.NotBefore) && !now.After(candidate.certificate.NotAfter) {
+				responder = candidate
+				break
+			}
+		}
+	}
+	return responder.certificate, responder.key
+}
+
+// responderCertificates returns the certificates of all responders of all
+// issuers.
+func (source *VaultSource) responderCertificates() []*x509.Certificate {
+	source.responderLock.RLock()
+	defer source.responderLock.RUnlock()
+	certificates := make([]*x509.Certificate, 0, len(source.responders)+len(source.issuerResponders))
+	for _, responder := range source.responders {
+		certificates = append(certificates, responder.certificate)
+	}
+	for _, responder := range source.issuerResponders {
+		certificates = append(certificates, responder.certificate)
+	}
+	return certificates
+}
+
+// ownResponder returns the responder certificate with the serial number if
+// it is currently valid and issued by the issuer, nil otherwise.
+func (source *VaultSource) ownResponder(issuer *x509.Certificate, serialNumber *big.Int) *x509.Certificate {
+	now := source.clk.Now()
+	for _, certificate := range source.responderCertificates() {
+		if certificate.SerialNumber.Cmp(serialNumber) != 0 {
+			continue
+		}
+		if now.Before(certificate.NotBefore) || now.After(certificate.NotAfter) {
+			continue
+		}
+		if certificate.CheckSignatureFrom(issuer) == nil {
+			return certificate
+		}
+	}
+	return nil
+}
+
+// stop ends the background work of a source that is no longer served.
+func (source *VaultSource) stop() {
+	close(source.stopped)
+	if vaultTokens != nil {
+		vaultTokens.unregister(source.vaultClient)
+	}
+}
+
+// setResponders replaces the responder certificates and keys used to sign
+// responses. Cached responses signed with previous responders are discarded.
+func (source *VaultSource) setResponders(responders []responderPair) {
+	var global []responderPair
+	byIssuer := make(map[string]responderPair)
+	for _, responder := range responders {
+		if responder.issuerKeyID == nil {
+			global = append(global, responder)
+		} else {
+			byIssuer[string(responder.issuerKeyID)] = responder
+		}
+	}
+	source.responderLock.Lock()
+	source.responders = global
+	source.issuerResponders = byIssuer
+	source.responderLock.Unlock()
+	source.cache.clear()
+}
+
+// responseLifetimes define how long responses are valid and cached, they
+// may change when the configuration is reloaded.
+type responseLifetimes struct {
+	nextUpdate time.Duration
+	// staplingNextUpdate replaces nextUpdate for stapling lookups if set
+	staplingNextUpdate time.Duration
+	// revokedNextUpdate is the validity of revoked responses, they have
+	// no NextUpdate if it is 0
+	revokedNextUpdate time.Duration
+	negativeCacheTTL  time.Duration
+	cacheControl      cacheControlPolicy
+}
+
+// goodValidity returns how long good responses are valid.
+func (lifetimes responseLifetimes) goodValidity(stapling bool) time.Duration {
+	if stapling && lifetimes.staplingNextUpdate > 0 {
+		return lifetimes.staplingNextUpdate
+	}
+	return lifetimes.nextUpdate
+}
+
+// revokedNextUpdate returns the NextUpdate of revoked responses built now,
+// it is zero if they have none.
+func (source *VaultSource) revokedNextUpdate() time.Time {
+	validity := source.currentLifetimes().revokedNextUpdate
+	if validity <= 0 {
+		return time.Time{}
+	}
+	return source.clk.Now().Add(validity)
+}
+
+func (source *VaultSource) currentLifetimes() responseLifetimes {
+	source.lifetimeLock.RLock()
+	defer source.lifetimeLock.RUnlock()
+	return source.lifetimes
+}
+
+func (source *VaultSource) setLifetimes(lifetimes responseLifetimes) {
+	source.lifetimeLock.Lock()
+	defer source.lifetimeLock.Unlock()
+	source.lifetimes = lifetimes
+}
+
+// cacheControlPolicy defines how HTTP cache lifetimes are derived from the
+// NextUpdate field of OCSP responses. The safety margin is subtracted from
+// the remaining validity so that CDNs refresh responses before they become
+// stale, the result is clamped to the minimum and maximum age.
+type cacheControlPolicy struct {
+	margin time.Duration
+	minAge time.Duration
+	maxAge time.Duration
+}
+
+func (policy cacheControlPolicy) maxAgeFor(nextUpdate time.Time, now time.Time) time.Duration {
+	var maxAge time.Duration
+	if nextUpdate.IsZero() {
+		// responses without NextUpdate do not change, revoked is final
+		maxAge = policy.maxAge
+	} else {
+		maxAge = nextUpdate.Sub(now) - policy.margin
+	}
+	if maxAge > policy.maxAge {
+		maxAge = policy.maxAge
+	}
+	if maxAge < policy.minAge {
+		maxAge = policy.minAge
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return maxAge
+}
+
+// headers returns the RFC 5019 caching headers Cache-Control, Expires and
+// Last-Modified for the given OCSP response or nil if the response is not a
+// successful OCSP response. Expires matches the max-age, which also covers
+// responses without NextUpdate. Responses with several single responses are
+// cached for the shortest of their lifetimes.
+func (policy cacheControlPolicy) headers(response []byte, now time.Time) http.Header {
+	parsedResponses, err := parseResponses(response)
+	if err != nil {
+		return nil
+	}
+	thisUpdate, nextUpdate := responseUpdates(parsedResponses)
+	maxAge := policy.maxAgeFor(nextUpdate, now)
+	maxAgeSeconds := int(maxAge / time.Second)
+	headers := http.Header{}
+	headers.Set("Cache-Control", fmt.Sprintf(
+		"max-age=%d, s-maxage=%d, public, no-transform, must-revalidate", maxAgeSeconds, maxAgeSeconds))
+	headers.Set("Expires", now.Add(maxAge).UTC().Format(http.TimeFormat))
+	headers.Set("Last-Modified", thisUpdate.UTC().Format(http.TimeFormat))
+	return headers
+}
+
+// responseUpdates returns the latest ThisUpdate and the earliest NextUpdate
+// of the responses, NextUpdate is zero if no response has one.
+func responseUpdates(responses []*ocsp.Response) (thisUpdate, nextUpdate time.Time) {
+	for _, response := range responses {
+		if response.ThisUpdate.After(thisUpdate) {
+			thisUpdate = response.ThisUpdate
+		}
+		if !response.NextUpdate.IsZero() && (nextUpdate.IsZero() || response.NextUpdate.Before(nextUpdate)) {
+			nextUpdate = response.NextUpdate
+		}
+	}
+	return thisUpdate, nextUpdate
+}
+
+// Serial number formats accepted by -serialFormat and the separators they
+// use between hex encoded bytes.
+const (
+	serialFormatDash  = "dash"
+	serialFormatColon = "colon"
+)
+
+var serialSeparators = map[string]string{
+	serialFormatDash:  "-",
+	serialFormatColon: ":",
+}
+
+// Hex digit cases accepted by -serialCase.
+const (
+	serialCaseLower = "lower"
+	serialCaseUpper = "upper"
+)
+
+// serialStyle is how serial numbers are formatted in vault paths.
+type serialStyle struct {
+	separator string
+	uppercase bool
+}
+
+// vaultSerialStyle is the style of the serials in vault PKI paths.
+var vaultSerialStyle = serialStyle{separator: serialSeparators[serialFormatDash]}
+
 func toVaultSerial(serial *big.Int) string {
+	return formatSerial(serial, vaultSerialStyle)
+}
+
+// formatSerial formats the serial number as hex bytes joined by the
+// separator of the style.
+func formatSerial(serial *big.Int, style serialStyle) string {
 	vaultSerial := serial.Text(16)
+	if style.uppercase {
+		vaultSerial = strings.ToUpper(vaultSerial)
+	}
 	if len(vaultSerial)%2 != 0 {
 		vaultSerial = "0" + vaultSerial
 	}
@@ -276,6 +1238,5 @@ func toVaultSerial(serial *big.Int) string {
 	for i := 0; i < len(vaultSerial)/2; i++ {
 		serialParts[i] = vaultSerial[i*2 : i*2+2]
 	}
-	vaultSerial = strings.Join(serialParts, "-")
-	return vaultSerial
+	return strings.Join(serialParts, style.separator)
 }
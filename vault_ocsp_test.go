@@ -0,0 +1,1269 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"github.com/hashicorp/vault/api"
+	"github.com/jmhodges/clock"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMain(m *testing.M) {
+	// tests that check log messages capture them with captureLog
+	log.Level = log.LevelCritical
+	os.Exit(m.Run())
+}
+
+// testResponderKey is the key of all test responders, generating RSA keys
+// takes too long to do it for every test.
+var testResponderKey = func() crypto.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+var testSerialCounter int64 = 1000
+
+// nextTestSerial returns a serial number that no other test certificate
+// has.
+func nextTestSerial() *big.Int {
+	testSerialCounter++
+	return big.NewInt(testSerialCounter)
+}
+
+// testPKI is a CA with a delegated OCSP responder.
+type testPKI struct {
+	ca           *x509.Certificate
+	caKey        crypto.Signer
+	responder    *x509.Certificate
+	responderKey crypto.Signer
+}
+
+// newTestPKI creates a CA valid until notAfter and a responder for it
+// valid for a day.
+func newTestPKI(t *testing.T, name string, notAfter time.Time) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          nextTestSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	ca := createTestCertificate(t, caTemplate, caTemplate, caKey.Public(), caKey)
+	pki := &testPKI{ca: ca, caKey: caKey, responderKey: testResponderKey}
+	pki.responder = pki.issueResponder(t, time.Now().Add(24*time.Hour), testResponderKey)
+	return pki
+}
+
+// renew returns the PKI with a new CA certificate for the key of the CA,
+// the responder stays valid for the renewed CA.
+func (pki *testPKI) renew(t *testing.T, notAfter time.Time) *testPKI {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          nextTestSerial(),
+		Subject:               pki.ca.Subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	renewed := *pki
+	renewed.ca = createTestCertificate(t, template, template, pki.caKey.Public(), pki.caKey)
+	return &renewed
+}
+
+// intermediate returns a PKI whose CA certificate is issued by the CA.
+func (pki *testPKI) intermediate(t *testing.T, name string, notAfter time.Time) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          nextTestSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, pki.ca, caKey.Public(), pki.caKey)
+	intermediate := &testPKI{ca: ca, caKey: caKey, responderKey: testResponderKey}
+	intermediate.responder = intermediate.issueResponder(t, time.Now().Add(24*time.Hour), testResponderKey)
+	return intermediate
+}
+
+func createTestCertificate(t *testing.T, template, parent *x509.Certificate, publicKey crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// issueResponder issues an OCSP signing certificate for the key.
+func (pki *testPKI) issueResponder(t *testing.T, notAfter time.Time, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	return createTestCertificate(t, &x509.Certificate{
+		SerialNumber: nextTestSerial(),
+		Subject:      pkix.Name{CommonName: pki.ca.Subject.CommonName + " Responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, pki.ca, key.Public(), pki.caKey)
+}
+
+// issue issues a leaf certificate with the serial number.
+func (pki *testPKI) issue(t *testing.T, serial *big.Int, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return createTestCertificate(t, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serial.String()},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}, pki.ca, key.Public(), pki.caKey)
+}
+
+// request returns an OCSP request for the serial of a certificate of the
+// CA.
+func (pki *testPKI) request(t *testing.T, serial *big.Int, hash crypto.Hash) *ocsp.Request {
+	t.Helper()
+	keyHash, err := issuerKeyHash(pki.ca, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameHash := hash.New()
+	nameHash.Write(pki.ca.RawSubject)
+	return &ocsp.Request{
+		HashAlgorithm:  hash,
+		IssuerNameHash: nameHash.Sum(nil),
+		IssuerKeyHash:  keyHash,
+		SerialNumber:   serial,
+	}
+}
+
+// parse parses a response and verifies that it is signed for the CA.
+func (pki *testPKI) parse(t *testing.T, der []byte) *ocsp.Response {
+	t.Helper()
+	response, err := ocsp.ParseResponseForCert(der, nil, pki.ca)
+	if err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return response
+}
+
+func pemCertificate(certificate *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+}
+
+// fakeVault mimics the vault endpoints used by vault-ocsp. Paths are
+// relative to /v1/.
+type fakeVault struct {
+	*httptest.Server
+	lock sync.Mutex
+	// data is the secret data of reads
+	data map[string]map[string]interface{}
+	// raw are bodies served as they are like the DER encoded CA
+	raw map[string][]byte
+	// lists are the keys of list requests
+	lists map[string][]string
+	// writes handles write requests like logins
+	writes map[string]func(body map[string]interface{}) (int, interface{})
+	reads  map[string]int
+	// statuses are error statuses to answer requests for a path with
+	statuses map[string]int
+	// failing answers all requests with an internal server error
+	failing bool
+	// delay is waited before answering certificate reads
+	delay time.Duration
+	// certReads is the number of certificate reads in progress and
+	// maxCertReads its maximum
+	certReads    int
+	maxCertReads int
+	// cancelled is the number of delayed reads cancelled by the client
+	cancelled int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	vault := &fakeVault{
+		data:     make(map[string]map[string]interface{}),
+		raw:      make(map[string][]byte),
+		lists:    make(map[string][]string),
+		writes:   make(map[string]func(body map[string]interface{}) (int, interface{})),
+		reads:    make(map[string]int),
+		statuses: make(map[string]int),
+	}
+	vault.Server = httptest.NewServer(vault)
+	t.Cleanup(vault.Close)
+	return vault
+}
+
+func (vault *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	vault.lock.Lock()
+	vault.reads[path]++
+	failing, delay := vault.failing, vault.delay
+	raw, rawFound := vault.raw[path]
+	data, dataFound := vault.data[path]
+	keys, listFound := vault.lists[path]
+	write := vault.writes[path]
+	status := vault.statuses[path]
+	vault.lock.Unlock()
+	if strings.Contains(path, "/cert/") {
+		vault.lock.Lock()
+		vault.certReads++
+		if vault.certReads > vault.maxCertReads {
+			vault.maxCertReads = vault.certReads
+		}
+		vault.lock.Unlock()
+		defer func() {
+			vault.lock.Lock()
+			vault.certReads--
+			vault.lock.Unlock()
+		}()
+	}
+	if delay > 0 && strings.Contains(path, "/cert/") {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			vault.lock.Lock()
+			vault.cancelled++
+			vault.lock.Unlock()
+			return
+		}
+	}
+	if failing {
+		writeVaultJSON(w, http.StatusInternalServerError, map[string]interface{}{"errors": []string{"vault is down"}})
+		return
+	}
+	if status != 0 {
+		writeVaultJSON(w, status, map[string]interface{}{"errors": []string{http.StatusText(status)}})
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut || r.Method == http.MethodPost:
+		if write == nil {
+			break
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeVaultJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		status, response := write(body)
+		writeVaultJSON(w, status, response)
+		return
+	case r.URL.Query().Get("list") == "true":
+		if listFound {
+			writeVaultJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+			return
+		}
+	case rawFound:
+		_, _ = w.Write(raw)
+		return
+	case dataFound:
+		writeVaultJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+		return
+	}
+	writeVaultJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+}
+
+func writeVaultJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (vault *fakeVault) set(path string, data map[string]interface{}) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.data[path] = data
+}
+
+func (vault *fakeVault) setRaw(path string, body []byte) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.raw[path] = body
+}
+
+func (vault *fakeVault) setList(path string, keys []string) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.lists[path] = keys
+}
+
+func (vault *fakeVault) setWrite(path string, write func(body map[string]interface{}) (int, interface{})) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.writes[path] = write
+}
+
+func (vault *fakeVault) setStatus(path string, status int) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.statuses[path] = status
+}
+
+func (vault *fakeVault) setFailing(failing bool) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.failing = failing
+}
+
+func (vault *fakeVault) setDelay(delay time.Duration) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	vault.delay = delay
+}
+
+// cancelledReads returns the number of delayed reads cancelled by the
+// client.
+func (vault *fakeVault) cancelledReads() int {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	return vault.cancelled
+}
+
+// readCount returns the number of requests for the path.
+func (vault *fakeVault) readCount(path string) int {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	return vault.reads[path]
+}
+
+// totalReads returns the number of requests for all paths.
+func (vault *fakeVault) totalReads() int {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	total := 0
+	for _, reads := range vault.reads {
+		total += reads
+	}
+	return total
+}
+
+// maxConcurrentCertReads returns the maximum number of certificate reads
+// that were in progress at the same time.
+func (vault *fakeVault) maxConcurrentCertReads() int {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	return vault.maxCertReads
+}
+
+// addPKIMount serves the CA certificate of the PKI at the PKI mount.
+func (vault *fakeVault) addPKIMount(pkiMount string, pki *testPKI) {
+	vault.setRaw(pkiMount+"/ca", pki.ca.Raw)
+}
+
+// addCertificate stores the certificate at the cert/<serial> endpoint of
+// the mount, revoked at the given time unless it is zero.
+func (vault *fakeVault) addCertificate(pkiMount string, certificate *x509.Certificate, revoked time.Time) {
+	var revocationTime int64
+	if !revoked.IsZero() {
+		revocationTime = revoked.Unix()
+	}
+	vault.set(pkiMount+"/cert/"+toVaultSerial(certificate.SerialNumber), map[string]interface{}{
+		"certificate":     pemCertificate(certificate),
+		"revocation_time": revocationTime,
+	})
+}
+
+// config returns a vault client configuration for the fake vault that does
+// not retry failed requests.
+func (vault *fakeVault) config() *api.Config {
+	config := api.DefaultConfig()
+	config.Address = vault.URL
+	config.MaxRetries = 0
+	return config
+}
+
+func (vault *fakeVault) client(t *testing.T) *api.Client {
+	t.Helper()
+	client, err := api.NewClient(vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newTestSource creates a source for the PKI mount of the fake vault that
+// signs with the responder of the PKI.
+func newTestSource(t *testing.T, vault *fakeVault, pkiMount string, pki *testPKI) *VaultSource {
+	t.Helper()
+	vault.addPKIMount(pkiMount, pki)
+	source, err := NewVaultSource(pkiMount, issuerSelection{}, pki.responder, &pki.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+// setenv sets an environment variable until the test ends.
+func setenv(t *testing.T, name string, value string) {
+	previous, found := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// useFakeVault makes the vault clients created from the environment talk
+// to the fake vault until the test ends.
+func useFakeVault(t *testing.T, vault *fakeVault) {
+	setenv(t, api.EnvVaultAddress, vault.URL)
+	setenv(t, api.EnvVaultMaxRetries, "0")
+	setenv(t, api.EnvVaultToken, "test-token")
+}
+
+// newTestConfiguration returns the default configuration with the command
+// line arguments applied.
+func newTestConfiguration(t *testing.T, args ...string) *configuration {
+	t.Helper()
+	config := &configuration{}
+	flags := flag.NewFlagSet("vault-ocsp", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := config.parse(flags, args); err != nil {
+		t.Fatal(err)
+	}
+	config.applyDefaults()
+	return config
+}
+
+// newTestMounts serves the PKI mounts of the fake vault like main does,
+// signing with the responder of the PKI.
+func newTestMounts(t *testing.T, vault *fakeVault, config *configuration, pki *testPKI, pkiMounts ...string) *mountSet {
+	t.Helper()
+	useFakeVault(t, vault)
+	responders := []responderPair{{certificate: pki.responder, key: &pki.responderKey}}
+	mounts := newMountSet(mountSettings{config: config, serialStyle: vaultSerialStyle}, responders, nil)
+	t.Cleanup(func() {
+		for _, source := range mounts.sources() {
+			source.stop()
+		}
+	})
+	for _, pkiMount := range pkiMounts {
+		vault.addPKIMount(pkiMount, pki)
+		if err := mounts.add(pkiMount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mounts
+}
+
+// writeResponderFiles writes the PEM encoded responder certificate and key
+// to files of a temporary directory.
+func writeResponderFiles(t *testing.T, certificate *x509.Certificate, key crypto.Signer) (certificateFile string, keyFile string) {
+	t.Helper()
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatalf("cannot write %T responder keys", key)
+	}
+	dir := t.TempDir()
+	certificateFile = filepath.Join(dir, "responder.pem")
+	keyFile = filepath.Join(dir, "responder.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(certificateFile, []byte(pemCertificate(certificate)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificateFile, keyFile
+}
+
+// useFakeClock replaces the clock of the source with a fake clock set to
+// the current time.
+func useFakeClock(source *VaultSource) clock.FakeClock {
+	fakeClock := clock.NewFake()
+	fakeClock.Set(time.Now())
+	source.clk = fakeClock
+	return fakeClock
+}
+
+// testLog records the messages logged while it is set as logger.
+type testLog struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+// captureLog records log messages of all levels until the test ends.
+func captureLog(t *testing.T) *testLog {
+	logger := &testLog{}
+	level := log.Level
+	log.Level = log.LevelDebug
+	log.SetLogger(logger)
+	t.Cleanup(func() {
+		log.Level = level
+		log.SetLogger(nil)
+	})
+	return logger
+}
+
+func (logger *testLog) add(message string) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.messages = append(logger.messages, message)
+}
+
+func (logger *testLog) Debug(message string)   { logger.add(message) }
+func (logger *testLog) Info(message string)    { logger.add(message) }
+func (logger *testLog) Warning(message string) { logger.add(message) }
+func (logger *testLog) Err(message string)     { logger.add(message) }
+func (logger *testLog) Crit(message string)    { logger.add(message) }
+func (logger *testLog) Emerg(message string)   { logger.add(message) }
+
+// contains returns whether a logged message contains the text.
+func (logger *testLog) contains(text string) bool {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	for _, message := range logger.messages {
+		if strings.Contains(message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestResponse(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+
+	good := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", good, time.Time{})
+	revokedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", revoked, revokedAt)
+	expired := pki.issue(t, nextTestSerial(), time.Now().Add(-time.Minute))
+	vault.addCertificate("pki", expired, time.Time{})
+	// vault serials have an even number of hex digits, 0xabc is 0a-bc
+	oddLength := pki.issue(t, big.NewInt(0xabc), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", oddLength, time.Time{})
+
+	tests := []struct {
+		name   string
+		serial *big.Int
+		status int
+		err    error
+	}{
+		{"good", good.SerialNumber, ocsp.Good, nil},
+		{"revoked", revoked.SerialNumber, ocsp.Revoked, nil},
+		{"expired", expired.SerialNumber, 0, errCertificateExpired},
+		{"unknown", nextTestSerial(), 0, errUnknownSerial},
+		{"odd length", oddLength.SerialNumber, ocsp.Good, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, headers, err := source.Response(pki.request(t, test.serial, crypto.SHA1))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				if responseStatus(err) != ocsp.Unauthorized {
+					t.Errorf("got response status %v, want unauthorized", responseStatus(err))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			if response.Status != test.status {
+				t.Errorf("got status %d, want %d", response.Status, test.status)
+			}
+			if response.SerialNumber.Cmp(test.serial) != 0 {
+				t.Errorf("got serial %v, want %v", response.SerialNumber, test.serial)
+			}
+			if test.status == ocsp.Revoked && !response.RevokedAt.Equal(revokedAt) {
+				t.Errorf("got revocation time %s, want %s", response.RevokedAt, revokedAt)
+			}
+			if headers.Get("ETag") == "" {
+				t.Error("response has no ETag")
+			}
+		})
+	}
+}
+
+func TestResponseIssuerMismatch(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+
+	_, _, err := source.Response(other.request(t, nextTestSerial(), crypto.SHA1))
+	if !errors.Is(err, errIssuerMismatch) {
+		t.Fatalf("got error %v, want issuer mismatch", err)
+	}
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	policy := cacheControlPolicy{margin: 5 * time.Minute, minAge: time.Minute, maxAge: 30 * time.Minute}
+	tests := []struct {
+		name       string
+		nextUpdate time.Time
+		maxAge     time.Duration
+	}{
+		{"capped at the maximum", now.Add(time.Hour), 30 * time.Minute},
+		{"margin before next update", now.Add(20 * time.Minute), 15 * time.Minute},
+		{"raised to the minimum", now.Add(3 * time.Minute), time.Minute},
+		{"past next update", now.Add(-time.Minute), time.Minute},
+		{"no next update", time.Time{}, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if maxAge := policy.maxAgeFor(test.nextUpdate, now); maxAge != test.maxAge {
+				t.Errorf("got max age %s, want %s", maxAge, test.maxAge)
+			}
+		})
+	}
+	if maxAge := (cacheControlPolicy{}).maxAgeFor(now.Add(-time.Minute), now); maxAge != 0 {
+		t.Errorf("got max age %s for an outdated response without minimum, want 0", maxAge)
+	}
+}
+
+func TestResponseDuringResponderRollover(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.cache = disabledCache{}
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	secondary := pki.issueResponder(t, time.Now().Add(48*time.Hour), pki.responderKey)
+	source.setResponders([]responderPair{
+		{certificate: pki.responder, key: &pki.responderKey},
+		{certificate: secondary, key: &pki.responderKey},
+	})
+	source.responderSelection = responderSelectionRoundRobin
+
+	signed := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := pki.parse(t, der)
+		if response.Status != ocsp.Good {
+			t.Errorf("got status %d, want good", response.Status)
+		}
+		signed[response.Certificate.SerialNumber.String()] = true
+	}
+	if !signed[pki.responder.SerialNumber.String()] || !signed[secondary.SerialNumber.String()] {
+		t.Errorf("responses were signed by responders %v, want both", signed)
+	}
+}
+
+func TestOversizedResponseWarning(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+
+	logger := captureLog(t)
+	source.responseSizeWarning = 1 << 20
+	if _, _, err := source.Response(request); err != nil {
+		t.Fatal(err)
+	}
+	if logger.contains("exceeding the warning threshold") {
+		t.Error("warned about a response below the threshold")
+	}
+
+	oversized := responsesOversized.Value()
+	source.responseSizeWarning = 100
+	if _, _, err := source.Response(request); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains("exceeding the warning threshold of 100 bytes") {
+		t.Error("missing warning about the oversized response")
+	}
+	if responsesOversized.Value() != oversized+1 {
+		t.Errorf("got %d oversized responses, want %d", responsesOversized.Value(), oversized+1)
+	}
+}
+
+func TestFormatSerial(t *testing.T) {
+	large, _ := new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffff", 16)
+	tests := []struct {
+		name   string
+		serial *big.Int
+		dash   string
+		colon  string
+		upper  string
+	}{
+		{"zero", big.NewInt(0), "00", "00", "00"},
+		{"single digit", big.NewInt(0xa), "0a", "0a", "0A"},
+		{"odd length", big.NewInt(0xabc), "0a-bc", "0a:bc", "0A-BC"},
+		{"even length", big.NewInt(0x1a2b), "1a-2b", "1a:2b", "1A-2B"},
+		{"large", large, "7f" + strings.Repeat("-ff", 19), "7f" + strings.Repeat(":ff", 19), "7F" + strings.Repeat("-FF", 19)},
+	}
+	colonStyle := serialStyle{separator: serialSeparators[serialFormatColon]}
+	upperStyle := serialStyle{separator: serialSeparators[serialFormatDash], uppercase: true}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if serial := toVaultSerial(test.serial); serial != test.dash {
+				t.Errorf("got dash serial %s, want %s", serial, test.dash)
+			}
+			if serial := formatSerial(test.serial, colonStyle); serial != test.colon {
+				t.Errorf("got colon serial %s, want %s", serial, test.colon)
+			}
+			if serial := formatSerial(test.serial, upperStyle); serial != test.upper {
+				t.Errorf("got upper case serial %s, want %s", serial, test.upper)
+			}
+			for _, formatted := range []string{test.colon, test.upper} {
+				parsed, err := parseSerial(formatted)
+				if err != nil || parsed.Cmp(test.serial) != 0 {
+					t.Errorf("parsed %s as %v with error %v", formatted, parsed, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSerialCase(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, big.NewInt(0xabcdef01), time.Now().Add(time.Hour))
+	// vault keys the certificate by its upper case serial
+	vault.set("pki/cert/AB-CD-EF-01", map[string]interface{}{
+		"certificate":     pemCertificate(certificate),
+		"revocation_time": 0,
+	})
+	tests := []struct {
+		serialCase string
+		err        error
+	}{
+		{serialCaseLower, errUnknownSerial},
+		{serialCaseUpper, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.serialCase, func(t *testing.T) {
+			config := newTestConfiguration(t, "-serialCase", test.serialCase)
+			source := newTestSource(t, vault, "pki", pki)
+			source.serialStyle = serialStyle{separator: serialSeparators[config.SerialFormat], uppercase: config.SerialCase == serialCaseUpper}
+
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Good {
+				t.Errorf("got status %d, want good", response.Status)
+			}
+		})
+	}
+}
+
+func TestThisUpdateSkew(t *testing.T) {
+	for _, skew := range []time.Duration{0, 10 * time.Minute} {
+		t.Run(skew.String(), func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			config := newTestConfiguration(t, "-thisUpdateSkew", skew.String())
+			source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+			fakeClock := useFakeClock(source)
+			now := time.Now().UTC().Truncate(time.Second)
+			fakeClock.Set(now)
+
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			if want := now.Add(-skew); !response.ThisUpdate.Equal(want) {
+				t.Errorf("got ThisUpdate %v, want %v", response.ThisUpdate, want)
+			}
+			if want := now.Add(time.Duration(config.NextUpdate)); !response.NextUpdate.Equal(want) {
+				t.Errorf("got NextUpdate %v, want %v from the unskewed time", response.NextUpdate, want)
+			}
+		})
+	}
+}
+
+func TestNextUpdateCappedAtCertificateExpiry(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.setLifetimes(responseLifetimes{nextUpdate: 12 * time.Hour})
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(2*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := pki.parse(t, der)
+	if response.Status != ocsp.Good {
+		t.Fatalf("got status %d, want good", response.Status)
+	}
+	if !response.NextUpdate.Equal(certificate.NotAfter) {
+		t.Errorf("got NextUpdate %v, want the certificate expiry %v", response.NextUpdate, certificate.NotAfter)
+	}
+}
+
+func TestProducedAt(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	fakeClock := useFakeClock(source)
+	now := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	fakeClock.Set(now.Add(300 * time.Millisecond))
+	pinned := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		producedAt time.Time
+		want       time.Time
+	}{
+		{"signing time", time.Time{}, now},
+		{"pinned", pinned, pinned},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source.producedAt = test.producedAt
+			der, _, err := source.buildOkResponse(context.Background(), pki.ca, pki.request(t, certificate.SerialNumber, crypto.SHA1), now.Add(time.Hour), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); !response.ProducedAt.Equal(test.want) {
+				t.Errorf("got ProducedAt %v, want %v", response.ProducedAt, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseCachingHeaders(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(24*time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	config := newTestConfiguration(t, "-nextUpdate", "1h", "-cacheMargin", "5m")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	fakeClock := useFakeClock(source)
+	now := time.Now().UTC().Truncate(time.Second)
+	fakeClock.Set(now)
+
+	der, headers, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := pki.parse(t, der)
+	maxAge := response.NextUpdate.Sub(now) - 5*time.Minute
+	if want := fmt.Sprintf("max-age=%d,", int(maxAge/time.Second)); !strings.HasPrefix(headers.Get("Cache-Control"), want) {
+		t.Errorf("got Cache-Control %q, want %s for NextUpdate %v", headers.Get("Cache-Control"), want, response.NextUpdate)
+	}
+	expires, err := http.ParseTime(headers.Get("Expires"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(maxAge); !expires.Equal(want) {
+		t.Errorf("got Expires %v, want %v", expires, want)
+	}
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastModified.Equal(response.ThisUpdate) {
+		t.Errorf("got Last-Modified %v, want ThisUpdate %v", lastModified, response.ThisUpdate)
+	}
+	if expires.After(response.NextUpdate) {
+		t.Errorf("response expires at %v after its NextUpdate %v", expires, response.NextUpdate)
+	}
+}
+
+func TestConcurrentLookupsShareVaultRead(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	// without cache every lookup after the shared one reads vault again
+	source := newTestMounts(t, vault, newTestConfiguration(t, "-noCache"), pki, "pki").sources()[0]
+	vault.setDelay(200 * time.Millisecond)
+	requests := make([]*ocsp.Request, 20)
+	for i := range requests {
+		requests[i] = pki.request(t, certificate.SerialNumber, crypto.SHA1)
+	}
+
+	for _, status := range responseStatuses(source, requests) {
+		if status != ocsp.Success {
+			t.Fatalf("got response status %d", status)
+		}
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(certificate.SerialNumber)); reads != 1 {
+		t.Errorf("got %d vault reads for concurrent lookups of one serial, want 1", reads)
+	}
+}
+
+func TestVaultTimeout(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	config := newTestConfiguration(t, "-vaultTimeout", "100ms")
+	source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	vault.setDelay(10 * time.Second)
+
+	start := time.Now()
+	recorder := postOCSP(ocspHandler(config, source), marshalRequest(t, pki.request(t, certificate.SerialNumber, crypto.SHA1)), nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("answered after %v, want the 100ms vault timeout", elapsed)
+	}
+	if !bytes.Equal(recorder.Body.Bytes(), tryLaterErrorResponse) {
+		t.Errorf("got %x, want a tryLater response", recorder.Body.Bytes())
+	}
+	for deadline := time.Now().Add(2 * time.Second); vault.cancelledReads() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the slow vault read was not cancelled")
+		}
+	}
+}
+
+func TestResponderOwnSerial(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(48*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	fakeClock := useFakeClock(source)
+	request := pki.request(t, pki.responder.SerialNumber, crypto.SHA1)
+	path := "pki/cert/" + toVaultSerial(pki.responder.SerialNumber)
+
+	// the responder is valid for 24 hours, responses must not outlive it
+	source.setLifetimes(responseLifetimes{nextUpdate: 48 * time.Hour})
+	der, _, err := source.Response(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := pki.parse(t, der)
+	if response.Status != ocsp.Good {
+		t.Errorf("got status %d for the responder, want good", response.Status)
+	}
+	if response.NextUpdate.After(pki.responder.NotAfter) {
+		t.Errorf("got NextUpdate %v after the responder expires at %v", response.NextUpdate, pki.responder.NotAfter)
+	}
+	if reads := vault.readCount(path); reads != 0 {
+		t.Errorf("read the responder serial %d times from vault", reads)
+	}
+
+	// an expired responder is looked up in vault like any other serial
+	source.cache.clear()
+	fakeClock.Add(25 * time.Hour)
+	if _, _, err := source.Response(request); !errors.Is(err, errUnknownSerial) {
+		t.Errorf("got error %v for the expired responder, want unknown serial", err)
+	}
+	if reads := vault.readCount(path); reads != 1 {
+		t.Errorf("got %d vault reads for the expired responder, want 1", reads)
+	}
+}
+
+func TestFirstValidResponder(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	source.responderSelection = responderSelectionFirstValid
+	certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+	expired := pki.issueResponder(t, time.Now().Add(-time.Minute), pki.responderKey)
+	tests := []struct {
+		name       string
+		responders []*x509.Certificate
+		want       *x509.Certificate
+	}{
+		{"first expired", []*x509.Certificate{expired, pki.responder}, pki.responder},
+		{"first valid", []*x509.Certificate{pki.responder, expired}, pki.responder},
+		{"all expired", []*x509.Certificate{expired}, expired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var responders []responderPair
+			for _, responder := range test.responders {
+				responders = append(responders, responderPair{certificate: responder, key: &pki.responderKey})
+			}
+			source.setResponders(responders)
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := ocsp.ParseResponse(der, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !response.Certificate.Equal(test.want) {
+				t.Errorf("response is signed by responder %v, want %v", response.Certificate.SerialNumber, test.want.SerialNumber)
+			}
+		})
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	tests := []struct {
+		behavior string
+		status   int
+		err      error
+	}{
+		{expiredCertUnauthorized, 0, errCertificateExpired},
+		{expiredCertStatus, ocsp.Good, nil},
+		{expiredCertUnknown, ocsp.Unknown, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.behavior, func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(48*time.Hour))
+			source := newTestSource(t, vault, "pki", pki)
+			source.expiredCertBehavior = test.behavior
+			source.setLifetimes(responseLifetimes{nextUpdate: time.Hour, revokedNextUpdate: time.Hour, negativeCacheTTL: time.Minute})
+			fakeClock := useFakeClock(source)
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+			revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+			request := pki.request(t, certificate.SerialNumber, crypto.SHA1)
+			path := "pki/cert/" + toVaultSerial(certificate.SerialNumber)
+
+			der, _, err := source.Response(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Good {
+				t.Fatalf("got status %d before the expiry, want good", response.Status)
+			}
+
+			// the cached responses end at the expiry of the certificates
+			fakeClock.Add(2 * time.Hour)
+			der, _, err = source.Response(pki.request(t, revoked.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != ocsp.Revoked {
+				t.Errorf("got status %d for the expired revoked certificate, want revoked", response.Status)
+			}
+			der, _, err = source.Response(request)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v after the expiry, want %v", err, test.err)
+				}
+				// the unauthorized answer is cached for the negative cache TTL
+				_, _, err = source.Response(request)
+				if !errors.Is(err, test.err) || errorKindName(err) != "certificate_expired" {
+					t.Errorf("got error %v from the cache, want %v", err, test.err)
+				}
+				if reads := vault.readCount(path); reads != 2 {
+					t.Errorf("got %d vault reads, want 2 with the cached answer", reads)
+				}
+				fakeClock.Add(2 * time.Minute)
+				if _, _, err = source.Response(request); !errors.Is(err, test.err) {
+					t.Errorf("got error %v after the negative cache TTL, want %v", err, test.err)
+				}
+				if reads := vault.readCount(path); reads != 3 {
+					t.Errorf("got %d vault reads, want 3 after the negative cache TTL", reads)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response := pki.parse(t, der); response.Status != test.status {
+				t.Errorf("got status %d after the expiry, want %d", response.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	other := newTestPKI(t, "Other CA", time.Now().Add(24*time.Hour))
+	source := newTestMounts(t, vault, newTestConfiguration(t, "-verifyChain"), pki, "pki").sources()[0]
+	fakeClock := useFakeClock(source)
+	chained := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", chained, time.Time{})
+	// a certificate of another PKI whose serial collides with one of the mount
+	colliding := other.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", colliding, time.Time{})
+
+	der, _, err := source.Response(pki.request(t, chained.SerialNumber, crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := pki.parse(t, der); response.Status != ocsp.Good {
+		t.Errorf("got status %d for the chained certificate, want good", response.Status)
+	}
+
+	request := pki.request(t, colliding.SerialNumber, crypto.SHA1)
+	path := "pki/cert/" + toVaultSerial(colliding.SerialNumber)
+	for i := 0; i < 2; i++ {
+		if _, _, err := source.Response(request); !errors.Is(err, errIssuerMismatch) {
+			t.Errorf("got error %v for the certificate of another issuer, want issuer mismatch", err)
+		}
+	}
+	if reads := vault.readCount(path); reads != 1 {
+		t.Errorf("got %d vault reads, want the mismatch to be cached", reads)
+	}
+	fakeClock.Add(2 * time.Minute)
+	if _, _, err := source.Response(request); !errors.Is(err, errIssuerMismatch) {
+		t.Errorf("got error %v after the negative cache TTL, want issuer mismatch", err)
+	}
+	if reads := vault.readCount(path); reads != 2 {
+		t.Errorf("got %d vault reads, want the cached mismatch to expire", reads)
+	}
+}
+
+func TestSerialNumberLength(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	largest := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), maxSerialBits), big.NewInt(1))
+	certificate := pki.issue(t, largest, time.Now().Add(time.Hour))
+	vault.addCertificate("pki", certificate, time.Time{})
+
+	der, _, err := source.Response(pki.request(t, largest, crypto.SHA1))
+	if err != nil {
+		t.Fatalf("request for a %d bit serial failed: %v", maxSerialBits, err)
+	}
+	if response := pki.parse(t, der); response.Status != ocsp.Good {
+		t.Errorf("got status %d for a %d bit serial, want good", response.Status, maxSerialBits)
+	}
+
+	oversized := new(big.Int).Lsh(big.NewInt(1), 4096)
+	if _, _, err := source.Response(pki.request(t, oversized, crypto.SHA1)); !errors.Is(err, errMalformedRequest) {
+		t.Errorf("got error %v for a %d bit serial, want malformed request", err, oversized.BitLen())
+	}
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(oversized)); reads != 0 {
+		t.Errorf("read the oversized serial %d times from vault", reads)
+	}
+}
+
+func TestOmitResponderCert(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("omit %v", omit), func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+			config := newTestConfiguration(t, fmt.Sprintf("-omitResponderCert=%v", omit))
+			source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Time{})
+
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !omit {
+				if response := pki.parse(t, der); !response.Certificate.Equal(pki.responder) {
+					t.Error("response does not include the responder certificate")
+				}
+				return
+			}
+			// clients that trust the responder directly verify with it
+			response, err := ocsp.ParseResponse(der, pki.responder)
+			if err != nil {
+				t.Fatalf("response does not verify with the responder certificate: %v", err)
+			}
+			if response.Certificate != nil {
+				t.Error("response includes the responder certificate")
+			}
+		})
+	}
+}
+
+func TestArchiveCutoff(t *testing.T) {
+	for _, cutoff := range []time.Duration{0, 30 * 24 * time.Hour} {
+		t.Run(cutoff.String(), func(t *testing.T) {
+			vault := newFakeVault(t)
+			pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+			certificate := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+			vault.addCertificate("pki", certificate, time.Now().Add(-time.Hour))
+			config := newTestConfiguration(t, "-archiveCutoff", cutoff.String())
+			source := newTestMounts(t, vault, config, pki, "pki").sources()[0]
+
+			der, _, err := source.Response(pki.request(t, certificate.SerialNumber, crypto.SHA1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := pki.parse(t, der)
+			var extensions []pkix.Extension
+			for _, extension := range response.Extensions {
+				if extension.Id.Equal(idPKIXOCSPArchiveCutoff) {
+					extensions = append(extensions, extension)
+				}
+			}
+			if cutoff == 0 {
+				if len(extensions) != 0 {
+					t.Errorf("got %d archive cutoff extensions without -archiveCutoff, want none", len(extensions))
+				}
+				return
+			}
+			if len(extensions) != 1 {
+				t.Fatalf("got %d archive cutoff extensions, want 1", len(extensions))
+			}
+			var archiveCutoff time.Time
+			if _, err := asn1.UnmarshalWithParams(extensions[0].Value, &archiveCutoff, "generalized"); err != nil {
+				t.Fatalf("could not decode the archive cutoff: %v", err)
+			}
+			if want := response.ProducedAt.Add(-cutoff); !archiveCutoff.Equal(want) {
+				t.Errorf("got archive cutoff %v, want %v", archiveCutoff, want)
+			}
+		})
+	}
+}
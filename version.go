@@ -0,0 +1,50 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version, commit and buildDate are set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = ""
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the running build. Builds without version
+// information fall back to the module version and VCS settings recorded by
+// the go tool.
+func versionString() string {
+	info, _ := debug.ReadBuildInfo()
+	return buildVersionString(info)
+}
+
+// buildVersionString describes the build with the build info, which is nil
+// for binaries built without module support.
+func buildVersionString(info *debug.BuildInfo) string {
+	buildVersion, buildCommit, buildTime := version, commit, buildDate
+	if buildVersion == "" {
+		buildVersion = "devel"
+		if info != nil && info.Main.Version != "" {
+			buildVersion = info.Main.Version
+		}
+	}
+	if info != nil {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && buildCommit == "unknown":
+				buildCommit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "unknown":
+				buildTime = setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("vault-ocsp %s (commit %s, built %s, %s)", buildVersion, buildCommit, buildTime, runtime.Version())
+}
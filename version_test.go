@@ -0,0 +1,46 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	savedVersion, savedCommit, savedBuildDate := version, commit, buildDate
+	t.Cleanup(func() { version, commit, buildDate = savedVersion, savedCommit, savedBuildDate })
+
+	version, commit, buildDate = "v1.2.3", "0123abc", "2020-01-02T03:04:05Z"
+	if got, want := versionString(), "vault-ocsp v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, "+runtime.Version()+")"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// without -ldflags the version comes from the build info
+	version, commit, buildDate = "", "unknown", "unknown"
+	format := regexp.MustCompile(`^vault-ocsp \S+ \(commit unknown, built unknown, go\S+\)$`)
+	if got := buildVersionString(nil); !format.MatchString(got) {
+		t.Errorf("got %q, want a version line matching %s", got, format)
+	}
+	info := &debug.BuildInfo{
+		Main: debug.Module{Version: "v1.2.4"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "4567def"},
+			{Key: "vcs.time", Value: "2020-02-03T04:05:06Z"},
+		},
+	}
+	if got, want := buildVersionString(info), "vault-ocsp v1.2.4 (commit 4567def, built 2020-02-03T04:05:06Z, "+runtime.Version()+")"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// -ldflags take precedence over the build info
+	version, commit, buildDate = "v1.2.3", "0123abc", "2020-01-02T03:04:05Z"
+	if got, want := buildVersionString(info), "vault-ocsp v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, "+runtime.Version()+")"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
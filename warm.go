@@ -0,0 +1,172 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cloudflare/cfssl/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// warmCache pre-builds responses for all revoked certificates of the PKI
+// mount and returns the number of revoked certificates cached. Responses
+// carry the CertID hash algorithm of the request, so a response is cached
+// for each request hash algorithm, all built from one lookup of the
+// certificate.
+func (source *VaultSource) warmCache() (int, error) {
+	revokedList, err := source.vaultClient.Logical().List(fmt.Sprintf("%s/certs/revoked", source.pkiMount))
+	if err != nil {
+		return 0, fmt.Errorf("could not list revoked certificates: %v", err)
+	}
+	if revokedList == nil || revokedList.Data == nil {
+		return 0, nil
+	}
+	serials, _ := revokedList.Data["keys"].([]interface{})
+	warmed := 0
+	for _, serial := range serials {
+		serialNumber, err := parseSerial(fmt.Sprint(serial))
+		if err != nil {
+			log.Warningf("Skipping revoked certificate: %v", err)
+			continue
+		}
+		if err := source.warmSerial(serialNumber); err != nil {
+			log.Warningf("Skipping revoked certificate %s: %v", serial, err)
+			continue
+		}
+		warmed++
+	}
+	return warmed, nil
+}
+
+// warmSerial caches the revoked responses of the certificate with the
+// serial number for all request hash algorithms.
+func (source *VaultSource) warmSerial(serialNumber *big.Int) error {
+	if !source.allowed(serialNumber) {
+		return errors.New("serial is not on the allowlist")
+	}
+	issuer, revocationTime, reason, err := source.revocation(serialNumber)
+	if err != nil {
+		return err
+	}
+	nextUpdate := source.revokedNextUpdate()
+	for _, algorithm := range requestHashes {
+		if !algorithm.Available() {
+			continue
+		}
+		keyHash, err := issuerKeyHash(issuer, algorithm)
+		if err != nil {
+			return err
+		}
+		request := &ocsp.Request{
+			HashAlgorithm: algorithm,
+			IssuerKeyHash: keyHash,
+			SerialNumber:  serialNumber,
+		}
+		response, responderCertificate, err := source.buildRevokedResponse(context.Background(), issuer, request, revocationTime, reason, nextUpdate, nil)
+		if err != nil {
+			return fmt.Errorf("could not build response %v", err)
+		}
+		source.cache.set(responseCacheKey(request, nil, false), newCacheEntry(response, responderCertificate, nextUpdate))
+	}
+	return nil
+}
+
+// revocation returns the issuer, revocation time and reason of a revoked
+// certificate. Revocations on the CRL are answered without vault, all
+// others with a single vault read.
+func (source *VaultSource) revocation(serialNumber *big.Int) (*x509.Certificate, time.Time, int, error) {
+	issuers, _ := source.currentIssuers()
+	for _, issuer := range issuers {
+		if revoked, found := source.crlRevocation(issuer, serialNumber); found {
+			return issuer, revoked.RevocationTime, crlReason(revoked), nil
+		}
+	}
+	vaultSerial := formatSerial(serialNumber, source.serialStyle)
+	if err := source.vaultBreaker.allow(); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if err := source.vaultReads.acquire(); err != nil {
+		source.vaultBreaker.cancel()
+		return nil, time.Time{}, 0, err
+	}
+	ctx, cancel := source.vaultContext()
+	certificateData, err := source.certs.certificateData(ctx, vaultSerial)
+	cancel()
+	source.vaultReads.release()
+	source.vaultBreaker.done(err)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("error reading certificate information from vault: %v", err)
+	}
+	if certificateData == nil {
+		return nil, time.Time{}, 0, fmt.Errorf("certificate %s not found", vaultSerial)
+	}
+	if err := checkCertificateData(certificateData); err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("unexpected vault data: %v", err)
+	}
+	revocationTime, found, err := parseRevocationTime(certificateData)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid revocation time: %v", err)
+	}
+	if !found || revocationTime.IsZero() {
+		return nil, time.Time{}, 0, errors.New("certificate is not revoked")
+	}
+	issuer, err := source.signingIssuer(issuers, certificateData)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	return issuer, revocationTime, ocsp.Unspecified, nil
+}
+
+// issuerOf returns the issuer of the certificate with the given serial
+// number. The certificate is only read from vault if the mount has more
+// than one issuer.
+func (source *VaultSource) issuerOf(serialNumber *big.Int) (*x509.Certificate, error) {
+	issuers, _ := source.currentIssuers()
+	if len(issuers) == 1 {
+		return issuers[0], nil
+	}
+	vaultSerial := formatSerial(serialNumber, source.serialStyle)
+	certificateData, err := source.certs.certificateData(context.Background(), vaultSerial)
+	if err != nil {
+		return nil, err
+	}
+	if certificateData == nil {
+		return nil, lookupError(errUnknownSerial, fmt.Errorf("certificate %s not found", vaultSerial))
+	}
+	return source.signingIssuer(issuers, certificateData)
+}
+
+// signingIssuer returns the issuer that signed the certificate of the vault
+// certificate data. With a single issuer the certificate is only verified
+// with -verifyChain, like for live requests.
+func (source *VaultSource) signingIssuer(issuers []*x509.Certificate, certificateData map[string]interface{}) (*x509.Certificate, error) {
+	if len(issuers) == 1 {
+		if source.verifyChain {
+			if err := source.verifyIssuedBy(issuers[0], certificateData); err != nil {
+				return nil, fmt.Errorf("certificate not issued by %s: %v", issuers[0].Subject, err)
+			}
+		}
+		return issuers[0], nil
+	}
+	certificate, found, err := parseCertificateField(certificateData)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("no certificate to find the issuer of")
+	}
+	for _, issuer := range issuers {
+		if certificate.CheckSignatureFrom(issuer) == nil {
+			return issuer, nil
+		}
+	}
+	return nil, errors.New("no issuer of the mount signed the certificate")
+}
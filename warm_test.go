@@ -0,0 +1,117 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestWarmCache(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	source := newTestSource(t, vault, "pki", pki)
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+	vault.setList("pki/certs/revoked", []string{toVaultSerial(revoked.SerialNumber)})
+
+	warmed, err := source.warmCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warmed != 1 {
+		t.Errorf("warmed %d revoked certificates, want 1", warmed)
+	}
+	path := "pki/cert/" + toVaultSerial(revoked.SerialNumber)
+	reads := vault.readCount(path)
+	if reads != 1 {
+		t.Errorf("warmup read the certificate %d times, want once for all request hashes", reads)
+	}
+	for _, hash := range requestHashes {
+		der, _, err := source.Response(pki.request(t, revoked.SerialNumber, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response := pki.parse(t, der); response.Status != ocsp.Revoked {
+			t.Errorf("got status %d for hash %v, want revoked", response.Status, hash)
+		}
+	}
+	if vault.readCount(path) != reads {
+		t.Errorf("requests read vault %d times, want all answered from the warmed cache", vault.readCount(path)-reads)
+	}
+	if source.cacheHits != uint64(len(requestHashes)) {
+		t.Errorf("got %d cache hits, want %d", source.cacheHits, len(requestHashes))
+	}
+}
+
+func TestWarmCacheMultipleIssuers(t *testing.T) {
+	vault := newFakeVault(t)
+	first := newTestPKI(t, "First CA", time.Now().Add(24*time.Hour))
+	second := newTestPKI(t, "Second CA", time.Now().Add(24*time.Hour))
+	vault.setList("pki/issuers", []string{"first", "second"})
+	vault.set("pki/issuer/first", map[string]interface{}{"certificate": pemCertificate(first.ca)})
+	vault.set("pki/issuer/second", map[string]interface{}{"certificate": pemCertificate(second.ca)})
+	source, err := NewVaultSource("pki", issuerSelection{}, first.responder, &first.responderKey, vault.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := second.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+	vault.setList("pki/certs/revoked", []string{toVaultSerial(revoked.SerialNumber)})
+
+	warmed, err := source.warmCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warmed != 1 {
+		t.Errorf("warmed %d revoked certificates, want 1", warmed)
+	}
+	path := "pki/cert/" + toVaultSerial(revoked.SerialNumber)
+	if reads := vault.readCount(path); reads != 1 {
+		t.Errorf("warmup read the certificate %d times, want once to find its issuer and revocation", reads)
+	}
+	for _, hash := range requestHashes {
+		der, _, err := source.Response(second.request(t, revoked.SerialNumber, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the responder of the first CA signs for both
+		response, err := ocsp.ParseResponse(der, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != ocsp.Revoked {
+			t.Errorf("got status %d for hash %v, want revoked", response.Status, hash)
+		}
+	}
+	if reads := vault.readCount(path); reads != 1 {
+		t.Errorf("requests read vault %d times, want all answered from the warmed cache", reads-1)
+	}
+}
+
+func TestWarmCacheFromCRL(t *testing.T) {
+	vault := newFakeVault(t)
+	pki := newTestPKI(t, "Test CA", time.Now().Add(24*time.Hour))
+	revoked := pki.issue(t, nextTestSerial(), time.Now().Add(time.Hour))
+	vault.addCertificate("pki", revoked, time.Now().Add(-time.Minute))
+	vault.setList("pki/certs/revoked", []string{toVaultSerial(revoked.SerialNumber)})
+	vault.setRaw("pki/crl", pki.crl(t, pkix.RevokedCertificate{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now().Add(-time.Minute)}))
+	mounts := newTestMounts(t, vault, newTestConfiguration(t, "-crlRefresh", "1h", "-warmCache"), pki, "pki")
+	source := mounts.sources()[0]
+
+	if reads := vault.readCount("pki/cert/" + toVaultSerial(revoked.SerialNumber)); reads != 0 {
+		t.Errorf("warmup read the certificate %d times, want its revocation from the CRL", reads)
+	}
+	if _, _, err := source.Response(pki.request(t, revoked.SerialNumber, crypto.SHA256)); err != nil {
+		t.Fatal(err)
+	}
+	if source.cacheHits != 1 {
+		t.Errorf("got %d cache hits, want the warmed response", source.cacheHits)
+	}
+}